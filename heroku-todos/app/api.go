@@ -0,0 +1,141 @@
+package app
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// apiPrefix is where the versioned JSON API is served. The unversioned
+// routes the web page used first stay as they are.
+const apiPrefix = "/api/v1"
+
+func (a *AppHandler) mountAPI(r *mux.Router) {
+	api := r.PathPrefix(apiPrefix).Subrouter()
+	api.HandleFunc("/todos", a.apiGetTodosHandler).Methods("GET")
+	api.HandleFunc("/todos", a.apiAddTodoHandler).Methods("POST")
+	api.HandleFunc("/todos/{id:[0-9]+}", a.apiGetTodoHandler).Methods("GET")
+	api.HandleFunc("/todos/{id:[0-9]+}", a.apiUpdateTodoHandler).Methods("PATCH")
+	api.HandleFunc("/todos/{id:[0-9]+}", a.apiRemoveTodoHandler).Methods("DELETE")
+	api.HandleFunc("/todos/{id:[0-9]+}/completion", a.apiCompleteTodoHandler(true)).Methods("PUT")
+	api.HandleFunc("/todos/{id:[0-9]+}/completion", a.apiCompleteTodoHandler(false)).Methods("DELETE")
+	api.HandleFunc("/me", a.apiMeHandler).Methods("GET")
+	api.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeProblem(w, r, http.StatusNotFound, "no such API route")
+	})
+	api.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeProblem(w, r, http.StatusMethodNotAllowed, r.Method+" is not allowed here")
+	})
+}
+
+type TodoInput struct {
+	Name string `json:"name"`
+}
+
+// decodeJSON reads the request body into v, answering with a problem and
+// returning false when it can't.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		writeProblem(w, r, http.StatusUnsupportedMediaType, "send the body as application/json")
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		if isBodyTooLarge(err) {
+			writeProblem(w, r, http.StatusRequestEntityTooLarge, "request body too large")
+			return false
+		}
+		writeProblem(w, r, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func todoURL(id int) string {
+	return apiPrefix + "/todos/" + strconv.Itoa(id)
+}
+
+func (a *AppHandler) apiGetTodosHandler(w http.ResponseWriter, r *http.Request) {
+	a.rd.JSON(w, http.StatusOK, a.db.GetTodos(r.Context(), a.getUserID(r)))
+}
+
+func (a *AppHandler) apiGetTodoHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	todo := a.db.GetTodo(r.Context(), a.getUserID(r), id)
+	if todo == nil {
+		writeProblem(w, r, http.StatusNotFound, "no todo with id "+strconv.Itoa(id))
+		return
+	}
+	a.rd.JSON(w, http.StatusOK, todo)
+}
+
+func (a *AppHandler) apiAddTodoHandler(w http.ResponseWriter, r *http.Request) {
+	var input TodoInput
+	if !decodeJSON(w, r, &input) {
+		return
+	}
+	input, err := input.Validate()
+	if err != nil {
+		writeValidationProblem(w, r, err)
+		return
+	}
+	todo := a.db.AddTodo(r.Context(), a.getUserID(r), input.Name)
+	w.Header().Set("Location", todoURL(todo.ID))
+	a.rd.JSON(w, http.StatusCreated, todo)
+}
+
+// apiUpdateTodoHandler renames a todo.
+func (a *AppHandler) apiUpdateTodoHandler(w http.ResponseWriter, r *http.Request) {
+	var input TodoInput
+	if !decodeJSON(w, r, &input) {
+		return
+	}
+	input, err := input.Validate()
+	if err != nil {
+		writeValidationProblem(w, r, err)
+		return
+	}
+	userID := a.getUserID(r)
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	if !a.db.RenameTodo(r.Context(), userID, id, input.Name) {
+		writeProblem(w, r, http.StatusNotFound, "no todo with id "+strconv.Itoa(id))
+		return
+	}
+	a.rd.JSON(w, http.StatusOK, a.db.GetTodo(r.Context(), userID, id))
+}
+
+func (a *AppHandler) apiRemoveTodoHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	if !a.db.RemoveTodo(r.Context(), a.getUserID(r), id) {
+		writeProblem(w, r, http.StatusNotFound, "no todo with id "+strconv.Itoa(id))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiCompleteTodoHandler marks a todo completed when its completion is put
+// and not completed when it is deleted.
+func (a *AppHandler) apiCompleteTodoHandler(complete bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := a.getUserID(r)
+		id, _ := strconv.Atoi(mux.Vars(r)["id"])
+		if !a.db.CompleteTodo(r.Context(), userID, id, complete) {
+			writeProblem(w, r, http.StatusNotFound, "no todo with id "+strconv.Itoa(id))
+			return
+		}
+		a.rd.JSON(w, http.StatusOK, a.db.GetTodo(r.Context(), userID, id))
+	}
+}
+
+func (a *AppHandler) apiMeHandler(w http.ResponseWriter, r *http.Request) {
+	userID := a.getUserID(r)
+	user := a.db.GetUser(r.Context(), userID)
+	if user == nil {
+		writeProblem(w, r, http.StatusNotFound, "the signed in user no longer exists")
+		return
+	}
+	a.rd.JSON(w, http.StatusOK, Me{user, a.db.GetIdentities(r.Context(), userID)})
+}
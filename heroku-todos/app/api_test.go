@@ -0,0 +1,116 @@
+package app
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"tuckersWeb/todos/model"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// decodeProblem checks that resp is a problem with status.
+func decodeProblem(t *testing.T, resp *http.Response, status int) Problem {
+	defer resp.Body.Close()
+	assert.Equal(t, status, resp.StatusCode)
+	assert.Equal(t, problemContentType, resp.Header.Get("Content-Type"))
+	var problem Problem
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&problem))
+	assert.Equal(t, status, problem.Status)
+	assert.Equal(t, http.StatusText(status), problem.Title)
+	return problem
+}
+
+func TestAPI(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	ah := MakeHandler(testConfig())
+	defer ah.Close()
+
+	ts := httptest.NewServer(ah)
+	defer ts.Close()
+
+	// Signed out API calls get 401 instead of the sign in page
+	resp, err := newTestClient().Get(ts.URL + "/api/v1/todos")
+	assert.NoError(err)
+	assert.NotEmpty(resp.Header.Get("WWW-Authenticate"))
+	problem := decodeProblem(t, resp, http.StatusUnauthorized)
+	assert.Equal("/api/v1/todos", problem.Instance)
+	req, _ := http.NewRequest("GET", ts.URL+"/api/v1/todos", nil)
+	req.Header.Set("Authorization", "Bearer not-a-token")
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(err)
+	decodeProblem(t, resp, http.StatusUnauthorized)
+
+	client := newTestClient()
+	devSignIn(t, client, ts.URL, url.Values{"sub": {"alice"}, "email": {"alice@example.com"}})
+	do := func(method, path, contentType, body string) *http.Response {
+		var reader io.Reader
+		if body != "" {
+			reader = strings.NewReader(body)
+		}
+		req, _ := http.NewRequest(method, ts.URL+path, reader)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		resp, err := client.Do(req)
+		assert.NoError(err)
+		return resp
+	}
+
+	decodeProblem(t, do("POST", "/api/v1/todos", "application/json", `{"name": "  "}`), http.StatusUnprocessableEntity)
+	decodeProblem(t, do("POST", "/api/v1/todos", "application/json", `{"name": `), http.StatusBadRequest)
+	decodeProblem(t, do("POST", "/api/v1/todos", "application/x-www-form-urlencoded", "name=todo"), http.StatusUnsupportedMediaType)
+
+	resp = do("POST", "/api/v1/todos", "application/json; charset=utf-8", `{"name": "Write the API"}`)
+	assert.Equal(http.StatusCreated, resp.StatusCode)
+	var todo model.Todo
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&todo))
+	assert.Equal("Write the API", todo.Name)
+	assert.Equal(todoURL(todo.ID), resp.Header.Get("Location"))
+
+	resp = do("GET", resp.Header.Get("Location"), "", "")
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	resp = do("PUT", todoURL(todo.ID)+"/completion", "", "")
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&todo))
+	assert.True(todo.Completed)
+	resp = do("DELETE", todoURL(todo.ID)+"/completion", "", "")
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&todo))
+	assert.False(todo.Completed)
+
+	var todos []*model.Todo
+	resp = do("GET", "/api/v1/todos", "", "")
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&todos))
+	assert.Equal(1, len(todos))
+
+	// Deleted todos are gone from every route
+	resp = do("DELETE", todoURL(todo.ID), "", "")
+	assert.Equal(http.StatusNoContent, resp.StatusCode)
+	decodeProblem(t, do("DELETE", todoURL(todo.ID), "", ""), http.StatusNotFound)
+	decodeProblem(t, do("PUT", todoURL(todo.ID)+"/completion", "", ""), http.StatusNotFound)
+	decodeProblem(t, do("GET", todoURL(todo.ID), "", ""), http.StatusNotFound)
+
+	decodeProblem(t, do("GET", "/api/v1/lists", "", ""), http.StatusNotFound)
+	decodeProblem(t, do("PATCH", "/api/v1/todos", "", ""), http.StatusMethodNotAllowed)
+
+	// State changes need the CSRF token like the rest of the app
+	req, _ = http.NewRequest("DELETE", ts.URL+"/api/v1/todos/1", nil)
+	resp, err = (&http.Client{Jar: client.Jar}).Do(req)
+	assert.NoError(err)
+	decodeProblem(t, resp, http.StatusForbidden)
+
+	resp = do("GET", "/api/v1/me", "", "")
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	var me Me
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&me))
+	assert.Equal("alice@example.com", me.Email)
+}
@@ -1,56 +1,99 @@
 package app
 
 import (
+	"context"
 	"net/http"
-	"os"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"tuckersWeb/todos/auth"
+	"tuckersWeb/todos/config"
+	"tuckersWeb/todos/logging"
+	"tuckersWeb/todos/mail"
 	"tuckersWeb/todos/model"
 
 	"github.com/gorilla/mux"
-	"github.com/gorilla/sessions"
+	"github.com/sirupsen/logrus"
 	"github.com/unrolled/render"
 	"github.com/urfave/negroni"
+	"google.golang.org/grpc"
 )
 
-var store = sessions.NewCookieStore([]byte(os.Getenv("SESSION_KEY")))
-var rd *render.Render = render.New()
-
 type AppHandler struct {
 	http.Handler
-	db model.DBHandler
+	router    *mux.Router
+	cfg       *config.Config
+	db        model.DBHandler
+	providers *auth.Registry
+	mailer    mail.Mailer
+	limiter   *RateLimiter
+	logger    *logrus.Logger
+	events    *todoEvents
+	assets    *assets
+	store     *DBStore
+	rd        *render.Render
+
+	metrics    *metrics
+	grpcServer *grpc.Server
+
+	// shutdown is closed once the server starts draining. Long-lived
+	// streams end when it is.
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+
+	loginThrottle   *throttle
+	loginIPThrottle *throttle
+	mailThrottle    *throttle
 }
 
-var getSesssionID = func(r *http.Request) string {
-	session, err := store.Get(r, "session")
-	if err != nil {
-		return ""
+func (a *AppHandler) getUserID(r *http.Request) int {
+	// set by CheckSignin for access tokens
+	if userID, ok := r.Context().Value(userIDContextKey).(int); ok {
+		return userID
 	}
 
-	// Set some session values.
-	val := session.Values["id"]
-	if val == nil {
-		return ""
+	session, err := a.store.Get(r, "session")
+	if err != nil {
+		return 0
 	}
-	return val.(string)
-}
 
-func (a *AppHandler) indexHandler(w http.ResponseWriter, r *http.Request) {
-	http.Redirect(w, r, "/todo.html", http.StatusTemporaryRedirect)
+	val, ok := session.Values["user_id"].(int)
+	if !ok {
+		return 0
+	}
+	return val
 }
 
 func (a *AppHandler) getTodoListHandler(w http.ResponseWriter, r *http.Request) {
-	sessionId := getSesssionID(r)
-	list := a.db.GetTodos(sessionId)
-	rd.JSON(w, http.StatusOK, list)
+	userID := a.getUserID(r)
+	list := a.db.GetTodos(r.Context(), userID)
+	a.rd.JSON(w, http.StatusOK, list)
 }
 
 func (a *AppHandler) addTodoHandler(w http.ResponseWriter, r *http.Request) {
-	sessionId := getSesssionID(r)
-	name := r.FormValue("name")
-	todo := a.db.AddTodo(name, sessionId)
-	rd.JSON(w, http.StatusCreated, todo)
+	userID := a.getUserID(r)
+	if err := r.ParseForm(); isBodyTooLarge(err) {
+		writeProblem(w, r, http.StatusRequestEntityTooLarge, "request body too large")
+		return
+	}
+	input, err := TodoInput{Name: r.FormValue("name")}.Validate()
+	if err != nil {
+		if wantsHTML(r) {
+			a.renderTodos(w, r, http.StatusUnprocessableEntity, todosPage{Error: err.Error(), Name: r.FormValue("name")})
+			return
+		}
+		writeValidationProblem(w, r, err)
+		return
+	}
+	todo := a.db.AddTodo(r.Context(), userID, input.Name)
+	if wantsHTML(r) {
+		seeOther(w, r)
+		return
+	}
+	a.rd.JSON(w, http.StatusCreated, todo)
 }
 
 type Success struct {
@@ -60,71 +103,218 @@ type Success struct {
 func (a *AppHandler) removeTodoHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, _ := strconv.Atoi(vars["id"])
-	ok := a.db.RemoveTodo(id)
+	ok := a.db.RemoveTodo(r.Context(), a.getUserID(r), id)
+	if wantsHTML(r) {
+		seeOther(w, r)
+		return
+	}
 	if ok {
-		rd.JSON(w, http.StatusOK, Success{true})
+		a.rd.JSON(w, http.StatusOK, Success{true})
 	} else {
-		rd.JSON(w, http.StatusOK, Success{false})
+		a.rd.JSON(w, http.StatusOK, Success{false})
 	}
 }
 
+// legacyCompleteTodoHandler serves the old GET /complete-todo route, which
+// changes state through a GET.
+func (a *AppHandler) legacyCompleteTodoHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	w.Header().Set("Deprecation", "true")
+	w.Header().Set("Link", "</todos/"+vars["id"]+`/completion>; rel="successor-version"`)
+	a.completeTodoHandler(w, r)
+}
+
 func (a *AppHandler) completeTodoHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, _ := strconv.Atoi(vars["id"])
 	complete := r.FormValue("complete") == "true"
-	ok := a.db.CompleteTodo(id, complete)
+	ok := a.db.CompleteTodo(r.Context(), a.getUserID(r), id, complete)
+	if wantsHTML(r) {
+		seeOther(w, r)
+		return
+	}
 	if ok {
-		rd.JSON(w, http.StatusOK, Success{true})
+		a.rd.JSON(w, http.StatusOK, Success{true})
 	} else {
-		rd.JSON(w, http.StatusOK, Success{false})
+		a.rd.JSON(w, http.StatusOK, Success{false})
 	}
 }
 
+type Me struct {
+	*model.User
+	Identities []*model.Identity `json:"identities"`
+}
+
+func (a *AppHandler) meHandler(w http.ResponseWriter, r *http.Request) {
+	userID := a.getUserID(r)
+	user := a.db.GetUser(r.Context(), userID)
+	if user == nil {
+		a.rd.JSON(w, http.StatusNotFound, Success{false})
+		return
+	}
+	a.rd.JSON(w, http.StatusOK, Me{user, a.db.GetIdentities(r.Context(), userID)})
+}
+
+// Logger is the logger configured for the app, for logging outside of
+// requests.
+func (a *AppHandler) Logger() *logrus.Logger {
+	return a.logger
+}
+
 func (a *AppHandler) Close() {
 	a.db.Close()
 }
 
-func CheckSignin(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-	// if request URL is /signin.html, then next()
-	if strings.Contains(r.URL.Path, "/signin") ||
-		strings.Contains(r.URL.Path, "/auth") {
+// signedOutAssets are the files in public/ that the sign in page and the
+// API docs load besides their own.
+var signedOutAssets = map[string]bool{"csrf.js": true, "todo.css": true}
+
+// isSignedOutAsset reports whether urlPath names one of signedOutAssets,
+// under its own name or a hashed one.
+func (a *AppHandler) isSignedOutAsset(urlPath string) bool {
+	asset, _ := a.assets.lookup(urlPath)
+	return asset != nil && signedOutAssets[asset.name]
+}
+
+func (a *AppHandler) CheckSignin(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	// if request URL is /signin.html, a sign in route or the API docs, then next()
+	if strings.HasPrefix(r.URL.Path, "/signin") ||
+		strings.HasPrefix(r.URL.Path, "/auth/") ||
+		strings.HasPrefix(r.URL.Path, devIdPPath+"/") ||
+		r.URL.Path == cliTokenPath ||
+		r.URL.Path == "/openapi.json" ||
+		strings.HasPrefix(r.URL.Path, "/docs.") ||
+		a.isSignedOutAsset(r.URL.Path) {
 		next(w, r)
 		return
 	}
 
-	// if user already signed in
-	sessionID := getSesssionID(r)
-	if sessionID != "" {
+	// if script sent a personal access token
+	if secret, ok := bearerToken(r); ok {
+		a.checkAccessToken(w, r, next, secret)
+		return
+	}
+
+	// if user already signed in with a provider or a local account
+	userID := a.getUserID(r)
+	if userID != 0 {
+		logging.AddFields(r.Context(), logrus.Fields{"user_id": userID})
 		next(w, r)
 		return
 	}
 
+	// API clients get told instead of redirected to a page
+	if isAPIRequest(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="todos"`)
+		writeProblem(w, r, http.StatusUnauthorized, "sign in or send an access token")
+		return
+	}
+
 	// if not user sign in
-	// redirect singin.html
-	http.Redirect(w, r, "/signin.html", http.StatusTemporaryRedirect)
+	// redirect singin.html, coming back to the page after
+	signin := "/signin.html"
+	if r.Method == "GET" && r.URL.Path != "/" && returnToPaths[r.URL.Path] {
+		signin += "?" + url.Values{"return_to": {r.URL.RequestURI()}}.Encode()
+	}
+	http.Redirect(w, r, signin, http.StatusTemporaryRedirect)
 }
 
-func MakeHandler(filepath string) *AppHandler {
+// MakeHandler builds the app from cfg, which should have been validated.
+func MakeHandler(cfg *config.Config) *AppHandler {
 	r := mux.NewRouter()
+	logger := newLogger(cfg)
+	dbConn := string(cfg.DatabaseURL)
+	db := model.NewDBHandler(logging.NewContext(context.Background(), logrus.NewEntry(logger)), dbConn)
+	m := newMetrics(db, cfg.SessionIdleTimeout)
+	events := newTodoEvents()
+	a := &AppHandler{
+		router: r,
+		cfg:    cfg,
+		logger: logger,
+		events: events,
+		assets: loadAssets(cfg.AssetsDir),
+		db: &publishingDB{
+			DBHandler: &instrumentedDB{
+				DBHandler: db,
+				backend:   model.Backend(dbConn),
+				duration:  m.dbDuration,
+			},
+			events: events,
+		},
+		mailer:   newMailer(cfg),
+		metrics:  m,
+		shutdown: make(chan struct{}),
+
+		loginThrottle:   newThrottle(5, 15*time.Minute),
+		loginIPThrottle: newThrottle(20, 15*time.Minute),
+		mailThrottle:    newThrottle(3, time.Hour),
+	}
+	a.rd = newRender(a.assets)
+	a.store = NewDBStore(a.db, cfg.SessionIdleTimeout, cfg.SessionAbsoluteTimeout, []byte(cfg.SessionKey))
+	a.providers = a.newProviderRegistry()
+	a.limiter = newRateLimiter(a.db, cfg.RateLimitStore, a.getUserID)
 	n := negroni.New(
-		negroni.NewRecovery(),
-		negroni.NewLogger(),
-		negroni.HandlerFunc(CheckSignin),
-		negroni.NewStatic(http.Dir("public")))
+		negroni.HandlerFunc(a.LogRequests),
+		negroni.HandlerFunc(SetCSP),
+		negroni.HandlerFunc(limitBody),
+		negroni.HandlerFunc(a.CheckSignin),
+		a.limiter,
+		negroni.HandlerFunc(a.CheckCSRF),
+		a.assets)
 	n.UseHandler(r)
 
-	a := &AppHandler{
-		Handler: n,
-		db:      model.NewDBHandler(filepath),
-	}
+	// Probes and scrapes stay out of the middleware, which would redirect
+	// them to sign in or give each one a session and a rate limit bucket.
+	top := http.NewServeMux()
+	top.HandleFunc("/healthz", a.healthzHandler)
+	top.HandleFunc("/readyz", a.readyzHandler)
+	top.HandleFunc("/metrics", a.metricsHandler)
+	top.Handle("/", n)
+	secure := negroni.New(negroni.HandlerFunc(a.SetClientIP), negroni.HandlerFunc(a.SecureHeaders))
+	secure.UseHandler(top)
+	a.Handler = secure
+
+	r.Use(logRoute)
 
 	r.HandleFunc("/todos", a.getTodoListHandler).Methods("GET")
 	r.HandleFunc("/todos", a.addTodoHandler).Methods("POST")
 	r.HandleFunc("/todos/{id:[0-9]+}", a.removeTodoHandler).Methods("DELETE")
-	r.HandleFunc("/complete-todo/{id:[0-9]+}", a.completeTodoHandler).Methods("GET")
-	r.HandleFunc("/auth/google/login", googleLoginHandler)
-	r.HandleFunc("/auth/google/callback", googleAuthCallback)
-	r.HandleFunc("/", a.indexHandler)
+	r.HandleFunc("/todos/{id:[0-9]+}/completion", a.completeTodoHandler).Methods("PUT")
+	// HTML forms can only post
+	r.HandleFunc("/todos/{id:[0-9]+}/completion", a.completeTodoHandler).Methods("POST")
+	r.HandleFunc("/todos/{id:[0-9]+}/delete", a.removeTodoHandler).Methods("POST")
+	r.HandleFunc("/complete-todo/{id:[0-9]+}", a.legacyCompleteTodoHandler).Methods("GET")
+	r.HandleFunc("/me", a.meHandler).Methods("GET")
+	r.HandleFunc("/sessions", a.getSessionsHandler).Methods("GET")
+	r.HandleFunc("/sessions", a.removeSessionsHandler).Methods("DELETE")
+	r.HandleFunc("/sessions/{id:[0-9]+}", a.removeSessionHandler).Methods("DELETE")
+	r.HandleFunc("/tokens", a.getTokensHandler).Methods("GET")
+	r.HandleFunc("/tokens", a.addTokenHandler).Methods("POST")
+	r.HandleFunc("/tokens/{id:[0-9]+}", a.removeTokenHandler).Methods("DELETE")
+	r.HandleFunc("/auth/logout", a.logoutHandler).Methods("POST")
+	r.HandleFunc("/auth/providers", a.providersHandler).Methods("GET")
+	r.HandleFunc("/auth/local/signup", a.localSignupHandler).Methods("POST")
+	r.HandleFunc("/auth/local/verify", a.localVerifyHandler).Methods("GET")
+	r.HandleFunc("/auth/local/login", a.localLoginHandler).Methods("POST")
+	r.HandleFunc("/auth/local/forgot", a.localForgotHandler).Methods("POST")
+	r.HandleFunc("/auth/local/reset", a.localResetHandler).Methods("POST")
+	r.HandleFunc("/auth/{provider}/login", a.loginHandler)
+	r.HandleFunc("/auth/{provider}/callback", a.authCallback)
+	r.HandleFunc(cliAuthorizePath, a.cliAuthorizeHandler).Methods("GET")
+	r.HandleFunc(cliAuthorizePath, a.cliApproveHandler).Methods("POST")
+	r.HandleFunc(cliTokenPath, a.cliTokenHandler).Methods("POST")
+	r.HandleFunc("/", a.indexHandler).Methods("GET")
+	r.HandleFunc("/todo.html", a.todoPageHandler).Methods("GET")
+	// The sign in page doesn't look like the others
+	r.HandleFunc("/signin.html", a.pageHandler("signin", "bare")).Methods("GET")
+	r.HandleFunc("/docs.html", a.pageHandler("docs", "")).Methods("GET")
+	r.HandleFunc("/sessions.html", a.pageHandler("sessions", "")).Methods("GET")
+	r.HandleFunc("/tokens.html", a.pageHandler("tokens", "")).Methods("GET")
+	a.mountAPI(r)
+	r.Handle(graphqlPath, a.newGraphQLHandler()).Methods("GET", "POST")
+	if cfg.DevIdP {
+		a.mountDevIdP(r)
+	}
 
 	return a
 }
@@ -1,6 +1,7 @@
 package app
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -10,23 +11,23 @@ import (
 	"strconv"
 	"testing"
 
+	"tuckersWeb/todos/config"
 	"tuckersWeb/todos/model"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestTodos(t *testing.T) {
-	getSesssionID = func(r *http.Request) string {
-		return "testsessionId"
-	}
 	os.Remove("./test.db")
 	assert := assert.New(t)
-	ah := MakeHandler(os.Getenv("DATABASE_URL"))
+	ah := MakeHandler(testConfig())
 	defer ah.Close()
 
 	ts := httptest.NewServer(ah)
 	defer ts.Close()
-	resp, err := http.PostForm(ts.URL+"/todos", url.Values{"name": {"Test todo"}})
+	client := newTestClient()
+	devSignIn(t, client, ts.URL, url.Values{"sub": {"tester"}, "email": {"test@example.com"}})
+	resp, err := client.PostForm(ts.URL+"/todos", url.Values{"name": {"Test todo"}})
 	assert.NoError(err)
 	assert.Equal(http.StatusCreated, resp.StatusCode)
 	var todo model.Todo
@@ -34,7 +35,7 @@ func TestTodos(t *testing.T) {
 	assert.NoError(err)
 	assert.Equal(todo.Name, "Test todo")
 	id1 := todo.ID
-	resp, err = http.PostForm(ts.URL+"/todos", url.Values{"name": {"Test todo2"}})
+	resp, err = client.PostForm(ts.URL+"/todos", url.Values{"name": {"Test todo2"}})
 	assert.NoError(err)
 	assert.Equal(http.StatusCreated, resp.StatusCode)
 	err = json.NewDecoder(resp.Body).Decode(&todo)
@@ -42,7 +43,7 @@ func TestTodos(t *testing.T) {
 	assert.Equal(todo.Name, "Test todo2")
 	id2 := todo.ID
 
-	resp, err = http.Get(ts.URL + "/todos")
+	resp, err = client.Get(ts.URL + "/todos")
 	assert.NoError(err)
 	assert.Equal(http.StatusOK, resp.StatusCode)
 	todos := []*model.Todo{}
@@ -59,10 +60,11 @@ func TestTodos(t *testing.T) {
 		}
 	}
 
-	resp, err = http.Get(ts.URL + "/complete-todo/" + strconv.Itoa(id1) + "?complete=true")
+	req, _ := http.NewRequest("PUT", ts.URL+"/todos/"+strconv.Itoa(id1)+"/completion?complete=true", nil)
+	resp, err = client.Do(req)
 	assert.NoError(err)
 	assert.Equal(http.StatusOK, resp.StatusCode)
-	resp, err = http.Get(ts.URL + "/todos")
+	resp, err = client.Get(ts.URL + "/todos")
 	assert.NoError(err)
 	assert.Equal(http.StatusOK, resp.StatusCode)
 	todos = []*model.Todo{}
@@ -75,11 +77,11 @@ func TestTodos(t *testing.T) {
 		}
 	}
 
-	req, _ := http.NewRequest("DELETE", ts.URL+"/todos/"+strconv.Itoa(id1), nil)
-	resp, err = http.DefaultClient.Do(req)
+	req, _ = http.NewRequest("DELETE", ts.URL+"/todos/"+strconv.Itoa(id1), nil)
+	resp, err = client.Do(req)
 	assert.NoError(err)
 	assert.Equal(http.StatusOK, resp.StatusCode)
-	resp, err = http.Get(ts.URL + "/todos")
+	resp, err = client.Get(ts.URL + "/todos")
 	assert.NoError(err)
 	assert.Equal(http.StatusOK, resp.StatusCode)
 	todos = []*model.Todo{}
@@ -89,4 +91,88 @@ func TestTodos(t *testing.T) {
 	for _, t := range todos {
 		assert.Equal(t.ID, id2)
 	}
+
+	client = newTestClient()
+	devSignIn(t, client, ts.URL, url.Values{"sub": {"other"}, "email": {"other@example.com"}})
+	resp, err = client.Get(ts.URL + "/todos")
+	assert.NoError(err)
+	todos = []*model.Todo{}
+	err = json.NewDecoder(resp.Body).Decode(&todos)
+	assert.NoError(err)
+	assert.Equal(0, len(todos))
+	req, _ = http.NewRequest("DELETE", ts.URL+"/todos/"+strconv.Itoa(id2), nil)
+	resp, err = client.Do(req)
+	assert.NoError(err)
+	var success Success
+	err = json.NewDecoder(resp.Body).Decode(&success)
+	assert.NoError(err)
+	assert.False(success.Success)
+}
+
+func TestMe(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	ah := MakeHandler(testConfig())
+	defer ah.Close()
+
+	ts := httptest.NewServer(ah)
+	defer ts.Close()
+
+	user := ah.db.SignInUser(context.Background(), &model.Identity{Provider: "dev", Subject: "tester", Email: "old@example.com"})
+	client := newTestClient()
+	devSignIn(t, client, ts.URL, url.Values{"sub": {"tester"}, "email": {"test@example.com"}, "picture": {"https://example.com/me.png"}})
+
+	resp, err := client.Get(ts.URL + "/me")
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	var me Me
+	err = json.NewDecoder(resp.Body).Decode(&me)
+	assert.NoError(err)
+	assert.Equal(user.ID, me.ID)
+	assert.Equal("test@example.com", me.Email)
+	assert.Equal("https://example.com/me.png", me.Picture)
+	assert.Equal(1, len(me.Identities))
+	assert.Equal("dev", me.Identities[0].Provider)
+}
+
+func testDBConn() string {
+	if dbConn := os.Getenv("DATABASE_URL"); dbConn != "" {
+		return dbConn
+	}
+	return "./test.db"
+}
+
+// testConfig signs tests in through the development identity provider.
+func testConfig() *config.Config {
+	cfg := config.Default()
+	cfg.DatabaseURL = config.Secret(testDBConn())
+	cfg.SessionKey = "test-session-key-0123456789abcdef"
+	cfg.DevIdP = true
+	return cfg
+}
+
+func TestHandlersDontShareState(t *testing.T) {
+	if os.Getenv("DATABASE_URL") != "" {
+		t.Skip("needs two SQLite databases")
+	}
+	os.Remove("./test.db")
+	os.Remove("./test2.db")
+	defer os.Remove("./test2.db")
+	assert := assert.New(t)
+	first := MakeHandler(testConfig())
+	defer first.Close()
+	ts := httptest.NewServer(first)
+	defer ts.Close()
+	client := newTestClient()
+	devSignIn(t, client, ts.URL, url.Values{"sub": {"alice"}})
+
+	// A second handler on another database leaves the first one's
+	// sessions where they are
+	cfg := testConfig()
+	cfg.DatabaseURL = "./test2.db"
+	second := MakeHandler(cfg)
+	defer second.Close()
+	resp, err := client.Get(ts.URL + "/todos")
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
 }
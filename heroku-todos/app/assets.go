@@ -0,0 +1,239 @@
+package app
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"html/template"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tuckersWeb/todos/web"
+
+	"github.com/unrolled/render"
+)
+
+// Files in public/ are served under their own name, which browsers check
+// back on every use, and under a name carrying a hash of their content,
+// such as /todo.3f2a1b9c4d.js, which pages link to and browsers keep for a
+// year.
+const (
+	assetHashLength        = 10
+	immutableCacheControl  = "public, max-age=31536000, immutable"
+	revalidateCacheControl = "no-cache"
+)
+
+type asset struct {
+	name        string
+	hash        string
+	contentType string
+	data        []byte
+	// gzipped is data compressed ahead of time, or nil when compressing
+	// doesn't make it smaller.
+	gzipped []byte
+}
+
+// assets serves public/ and holds the templates/ of fsys. Files are read
+// once, except in development, where they are read on every request so
+// that edits show without a restart.
+type assets struct {
+	fsys fs.FS
+	dev  bool
+
+	mu    sync.Mutex
+	files map[string]*asset
+}
+
+func newAssets(fsys fs.FS, dev bool) *assets {
+	return &assets{fsys: fsys, dev: dev, files: map[string]*asset{}}
+}
+
+// loadAssets serves the copies embedded in the binary, or those in dir
+// when it is set.
+func loadAssets(dir string) *assets {
+	if dir == "" {
+		return newAssets(web.FS, false)
+	}
+	return newAssets(os.DirFS(dir), true)
+}
+
+// get returns public/name, or nil if there is no such file.
+func (s *assets) get(name string) *asset {
+	if name == "" {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a, ok := s.files[name]; ok {
+		return a
+	}
+
+	data, err := fs.ReadFile(s.fsys, path.Join("public", name))
+	if err != nil {
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	a := &asset{
+		name:        name,
+		hash:        hex.EncodeToString(sum[:])[:assetHashLength],
+		contentType: mime.TypeByExtension(path.Ext(name)),
+		data:        data,
+	}
+	if a.contentType == "" {
+		a.contentType = http.DetectContentType(data)
+	}
+	if compressible(a.contentType) {
+		var buf bytes.Buffer
+		zw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		zw.Write(data)
+		zw.Close()
+		if buf.Len() < len(data) {
+			a.gzipped = buf.Bytes()
+		}
+	}
+	if !s.dev {
+		s.files[name] = a
+	}
+	return a
+}
+
+func compressible(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return strings.HasPrefix(mediaType, "text/") ||
+		mediaType == "application/javascript" ||
+		mediaType == "application/json" ||
+		mediaType == "image/svg+xml"
+}
+
+// URL is the hashed URL of public/name, for templates to link to.
+func (s *assets) URL(name string) string {
+	a := s.get(name)
+	if a == nil {
+		return "/" + name
+	}
+	ext := path.Ext(name)
+	return "/" + strings.TrimSuffix(name, ext) + "." + a.hash + ext
+}
+
+// lookup finds the file a request path names, and whether the path
+// carries its current hash.
+func (s *assets) lookup(urlPath string) (*asset, bool) {
+	name := strings.TrimPrefix(path.Clean(urlPath), "/")
+	if a := s.get(name); a != nil {
+		return a, false
+	}
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	dot := strings.LastIndex(base, ".")
+	if dot < 0 {
+		return nil, false
+	}
+	hash := base[dot+1:]
+	if _, err := hex.DecodeString(hash); err != nil || len(hash) != assetHashLength {
+		return nil, false
+	}
+	a := s.get(base[:dot] + ext)
+	if a == nil {
+		return nil, false
+	}
+	// Pages of the previous release may still ask for the old content,
+	// which is gone. They get the current one, but mustn't keep it.
+	return a, a.hash == hash
+}
+
+// ServeHTTP serves public/ in front of the routes, like negroni.Static.
+func (s *assets) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		next(w, r)
+		return
+	}
+	a, current := s.lookup(r.URL.Path)
+	if a == nil {
+		next(w, r)
+		return
+	}
+
+	h := w.Header()
+	if current {
+		h.Set("Cache-Control", immutableCacheControl)
+	} else {
+		h.Set("Cache-Control", revalidateCacheControl)
+	}
+	h.Set("Content-Type", a.contentType)
+	data, etag := a.data, `"`+a.hash+`"`
+	if a.gzipped != nil {
+		h.Add("Vary", "Accept-Encoding")
+		if acceptsGzip(r) {
+			data, etag = a.gzipped, `"`+a.hash+`-gzip"`
+			h.Set("Content-Encoding", "gzip")
+		}
+	}
+	h.Set("ETag", etag)
+	http.ServeContent(w, r, a.name, time.Time{}, bytes.NewReader(data))
+}
+
+// acceptsGzip reports whether gzip, or any coding, has a non-zero quality
+// in the Accept-Encoding of r.
+func acceptsGzip(r *http.Request) bool {
+	anyCoding := false
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(part, ";")
+		ok := true
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[len("q="):], 64)
+				ok = err == nil && q > 0
+			}
+		}
+		switch strings.TrimSpace(params[0]) {
+		case "gzip":
+			return ok
+		case "*":
+			anyCoding = ok
+		}
+	}
+	return anyCoding
+}
+
+// templateFS lets render compile the templates in an fs.FS.
+type templateFS struct {
+	fs.FS
+}
+
+func (t templateFS) Walk(root string, walkFn filepath.WalkFunc) error {
+	return fs.WalkDir(t.FS, root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return walkFn(p, nil, err)
+		}
+		info, err := d.Info()
+		return walkFn(p, info, err)
+	})
+}
+
+func (t templateFS) ReadFile(name string) ([]byte, error) {
+	return fs.ReadFile(t.FS, name)
+}
+
+// newRender renders JSON and the pages in templates/, which link to files
+// in public/ with {{ asset "todo.js" }}. Pages in the "bare" layout bring
+// their own head and scripts.
+func newRender(s *assets) *render.Render {
+	return render.New(render.Options{
+		Directory:     "templates",
+		FileSystem:    templateFS{s.fsys},
+		Extensions:    []string{".html"},
+		Layout:        "layout",
+		Funcs:         []template.FuncMap{{"asset": s.URL}},
+		IsDevelopment: s.dev,
+	})
+}
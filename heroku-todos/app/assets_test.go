@@ -0,0 +1,156 @@
+package app
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAssets(t *testing.T) {
+	assert := assert.New(t)
+	script := strings.Repeat("console.log('todos');\n", 20)
+	s := newAssets(fstest.MapFS{
+		"public/todo.js":  {Data: []byte(script)},
+		"public/logo.png": {Data: []byte("\x89PNG\r\n\x1a\n")},
+	}, false)
+
+	serve := func(method, path string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+			http.NotFound(w, r)
+		})
+		return w
+	}
+
+	url := s.URL("todo.js")
+	assert.Regexp(`^/todo\.[0-9a-f]{10}\.js$`, url)
+	assert.Equal("/missing.js", s.URL("missing.js"))
+
+	w := serve("GET", url, nil)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(script, w.Body.String())
+	assert.Equal("text/javascript; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(immutableCacheControl, w.Header().Get("Cache-Control"))
+	assert.Equal("Accept-Encoding", w.Header().Get("Vary"))
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(etag)
+
+	// The plain name and old hashes are served, but checked back on
+	w = serve("GET", "/todo.js", nil)
+	assert.Equal(script, w.Body.String())
+	assert.Equal(revalidateCacheControl, w.Header().Get("Cache-Control"))
+	assert.Equal(etag, w.Header().Get("ETag"))
+	w = serve("GET", "/todo.0123456789.js", nil)
+	assert.Equal(script, w.Body.String())
+	assert.Equal(revalidateCacheControl, w.Header().Get("Cache-Control"))
+
+	w = serve("GET", "/todo.js", http.Header{"If-None-Match": {etag}})
+	assert.Equal(http.StatusNotModified, w.Code)
+	assert.Empty(w.Body.String())
+
+	w = serve("GET", url, http.Header{"Accept-Encoding": {"gzip, deflate, br"}})
+	assert.Equal("gzip", w.Header().Get("Content-Encoding"))
+	assert.NotEqual(etag, w.Header().Get("ETag"))
+	assert.Equal("text/javascript; charset=utf-8", w.Header().Get("Content-Type"))
+	zr, err := gzip.NewReader(w.Body)
+	if assert.NoError(err) {
+		body, _ := ioutil.ReadAll(zr)
+		assert.Equal(script, string(body))
+	}
+	w = serve("GET", url, http.Header{"Accept-Encoding": {"gzip;q=0, *"}})
+	assert.Empty(w.Header().Get("Content-Encoding"))
+	assert.Equal(script, w.Body.String())
+
+	// Images are already compressed
+	w = serve("GET", "/logo.png", http.Header{"Accept-Encoding": {"gzip"}})
+	assert.Equal("image/png", w.Header().Get("Content-Type"))
+	assert.Empty(w.Header().Get("Content-Encoding"))
+	assert.Empty(w.Header().Get("Vary"))
+
+	assert.Equal(http.StatusNotFound, serve("GET", "/missing.js", nil).Code)
+	assert.Equal(http.StatusNotFound, serve("GET", "/todo.zzzzzzzzzz.js", nil).Code)
+	assert.Equal(http.StatusNotFound, serve("GET", "/../public/todo.js", nil).Code)
+	assert.Equal(http.StatusNotFound, serve("POST", "/todo.js", nil).Code)
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	assert := assert.New(t)
+	for header, want := range map[string]bool{
+		"":                    false,
+		"gzip":                true,
+		"deflate, gzip;q=1.0": true,
+		"br;q=1, gzip;q=0.5":  true,
+		"gzip;q=0":            false,
+		"gzip; q=0.000":       false,
+		"*":                   true,
+		"*;q=0":               false,
+		"gzip;q=0, *":         false,
+		"identity":            false,
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", header)
+		assert.Equal(want, acceptsGzip(r), header)
+	}
+}
+
+func TestAssetsDevOverride(t *testing.T) {
+	assert := assert.New(t)
+	fsys := fstest.MapFS{"public/todo.css": {Data: []byte("body {}")}}
+	s := newAssets(fsys, true)
+	before := s.URL("todo.css")
+
+	// Edits show without a restart
+	fsys["public/todo.css"] = &fstest.MapFile{Data: []byte("body { color: red }")}
+	assert.NotEqual(before, s.URL("todo.css"))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/todo.css", nil), nil)
+	assert.Equal("body { color: red }", w.Body.String())
+}
+
+func TestEmbeddedAssets(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	ah := MakeHandler(testConfig())
+	defer ah.Close()
+
+	// The tests run in app/, where there is no public/
+	resp := httptest.NewRecorder()
+	ah.ServeHTTP(resp, httptest.NewRequest("GET", "/signin.html", nil))
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Contains(resp.Header().Get("Content-Type"), "text/html")
+	assert.Contains(resp.Body.String(), "<html")
+}
+
+func TestPagesLinkHashedAssets(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	ah := MakeHandler(testConfig())
+	defer ah.Close()
+
+	ts := httptest.NewServer(ah)
+	defer ts.Close()
+	client := newTestClient()
+	devSignIn(t, client, ts.URL, url.Values{"sub": {"alice"}, "email": {"alice@example.com"}})
+	for page, own := range map[string]string{"signin": "signin.js", "docs": "docs.js", "sessions": "sessions.js", "tokens": "tokens.js"} {
+		resp, err := client.Get(ts.URL + "/" + page + ".html")
+		assert.NoError(err)
+		assert.Equal(http.StatusOK, resp.StatusCode, page)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		nonce := assertScriptsNonced(t, resp, string(body))
+		assert.Contains(string(body), `<script nonce="`+nonce+`" src="`+ah.assets.URL(own)+`"></script>`, page)
+		assert.Contains(string(body), `<script nonce="`+nonce+`" src="`+ah.assets.URL("csrf.js")+`"></script>`, page)
+	}
+}
@@ -0,0 +1,170 @@
+package app
+
+import (
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"tuckersWeb/todos/model"
+)
+
+// The command-line client signs in like a native OAuth app (RFC 8252): it
+// sends the browser to cliAuthorizePath with a loopback redirect_uri and a
+// PKCE challenge, and exchanges the code it gets back at cliTokenPath for
+// an access token.
+const (
+	cliAuthorizePath = "/cli/authorize"
+	cliTokenPath     = "/cli/token"
+	// cliCodePurpose keeps the codes in the table of emailed tokens, which
+	// are single use and expire the same way.
+	cliCodePurpose   = "cli-login"
+	cliCodeTTL       = 5 * time.Minute
+	cliTokenDays     = 90
+	defaultCLIName   = "todo CLI"
+	maxCLINameLength = 100
+)
+
+type cliGrant struct {
+	RedirectURI string
+	State       string
+	Challenge   string
+	Name        string
+	CSRFToken   string
+}
+
+// parseCLIGrant reads the authorization request from the query or the
+// consent form, answering with 400 and returning nil when it is invalid.
+func parseCLIGrant(w http.ResponseWriter, r *http.Request) *cliGrant {
+	grant := &cliGrant{
+		RedirectURI: r.FormValue("redirect_uri"),
+		State:       r.FormValue("state"),
+		Challenge:   r.FormValue("code_challenge"),
+		Name:        strings.TrimSpace(r.FormValue("name")),
+	}
+	if !isLoopbackURL(grant.RedirectURI) {
+		http.Error(w, "redirect_uri must be an http URL on the loopback interface", http.StatusBadRequest)
+		return nil
+	}
+	if grant.State == "" || grant.Challenge == "" || r.FormValue("code_challenge_method") != "S256" {
+		http.Error(w, "state and a PKCE S256 code_challenge are required", http.StatusBadRequest)
+		return nil
+	}
+	if grant.Name == "" || len(grant.Name) > maxCLINameLength {
+		grant.Name = defaultCLIName
+	}
+	return grant
+}
+
+// isLoopbackURL accepts only URLs that nothing but a program on the user's
+// machine can receive.
+func isLoopbackURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "http" || u.User != nil || u.Fragment != "" {
+		return false
+	}
+	host := u.Hostname()
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func cliCodeHash(code, challenge string) string {
+	return hashToken(code + "." + challenge)
+}
+
+var cliConsentTemplate = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Sign in the command-line client</title></head>
+<body>
+<h1>Sign in the command-line client</h1>
+<p>{{.Name}} is asking for an access token that can read and change your todos.
+Only allow it if you just ran <code>todo login</code>.</p>
+<form method="post">
+<input type="hidden" name="redirect_uri" value="{{.RedirectURI}}">
+<input type="hidden" name="state" value="{{.State}}">
+<input type="hidden" name="code_challenge" value="{{.Challenge}}">
+<input type="hidden" name="code_challenge_method" value="S256">
+<input type="hidden" name="name" value="{{.Name}}">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<button type="submit" name="approve" value="true">Allow</button>
+<button type="submit" name="approve" value="false">Deny</button>
+</form>
+</body>
+</html>
+`))
+
+// cliAuthorizeHandler asks the signed in user to allow the client.
+func (a *AppHandler) cliAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	grant := parseCLIGrant(w, r)
+	if grant == nil {
+		return
+	}
+	session, _ := a.store.Get(r, "session")
+	grant.CSRFToken, _ = session.Values["csrf_token"].(string)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	// Allow is redirected on to the client
+	redirect, _ := url.Parse(grant.RedirectURI)
+	w.Header().Set("Content-Security-Policy", contentSecurityPolicy(cspNonce(r), redirect.Scheme+"://"+redirect.Host))
+	cliConsentTemplate.Execute(w, grant)
+}
+
+// cliApproveHandler sends the browser back to the client with a code, or
+// with access_denied.
+func (a *AppHandler) cliApproveHandler(w http.ResponseWriter, r *http.Request) {
+	grant := parseCLIGrant(w, r)
+	if grant == nil {
+		return
+	}
+	redirect, _ := url.Parse(grant.RedirectURI)
+	params := redirect.Query()
+	params.Set("state", grant.State)
+	if r.FormValue("approve") == "true" {
+		code := randomToken()
+		a.db.CreateEmailToken(r.Context(), a.getUserID(r), cliCodePurpose, cliCodeHash(code, grant.Challenge), time.Now().Add(cliCodeTTL))
+		params.Set("code", code)
+	} else {
+		params.Set("error", "access_denied")
+	}
+	redirect.RawQuery = params.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+// cliTokenHandler exchanges a code and the PKCE verifier it was issued for
+// for an access token.
+func (a *AppHandler) cliTokenHandler(w http.ResponseWriter, r *http.Request) {
+	code := r.PostFormValue("code")
+	verifier := r.PostFormValue("code_verifier")
+	if code == "" || verifier == "" {
+		a.rd.JSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	userID := a.db.UseEmailToken(r.Context(), cliCodePurpose, cliCodeHash(code, codeChallenge(verifier)))
+	if userID == 0 {
+		a.rd.JSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	name := strings.TrimSpace(r.PostFormValue("name"))
+	if name == "" || len(name) > maxCLINameLength {
+		name = defaultCLIName
+	}
+	secret := accessTokenPrefix + randomToken()
+	now := time.Now()
+	token := &model.AccessToken{
+		UserID:    userID,
+		Name:      name,
+		TokenHash: hashToken(secret),
+		Scopes:    []string{"read", "write"},
+		CreatedAt: now,
+		ExpiresAt: now.AddDate(0, 0, cliTokenDays),
+	}
+	token.ID = a.db.CreateAccessToken(r.Context(), token)
+	w.Header().Set("Cache-Control", "no-store")
+	a.rd.JSON(w, http.StatusCreated, NewAccessToken{token, secret})
+}
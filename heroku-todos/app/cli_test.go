@@ -0,0 +1,102 @@
+package app
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsLoopbackURL(t *testing.T) {
+	assert := assert.New(t)
+	assert.True(isLoopbackURL("http://127.0.0.1:41234/callback"))
+	assert.True(isLoopbackURL("http://[::1]:41234/callback"))
+	assert.True(isLoopbackURL("http://localhost:41234/"))
+	assert.False(isLoopbackURL("https://127.0.0.1:41234/callback"))
+	assert.False(isLoopbackURL("http://127.0.0.1.evil.example/callback"))
+	assert.False(isLoopbackURL("http://evil.example@127.0.0.1/"))
+	assert.False(isLoopbackURL("http://10.0.0.1/callback"))
+	assert.False(isLoopbackURL("/callback"))
+}
+
+func TestCLILogin(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	ah := MakeHandler(testConfig())
+	defer ah.Close()
+
+	ts := httptest.NewServer(ah)
+	defer ts.Close()
+
+	verifier := randomToken()
+	grant := url.Values{
+		"redirect_uri":          {"http://127.0.0.1:41234/callback"},
+		"state":                 {"xyz"},
+		"code_challenge":        {codeChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+		"name":                  {"laptop"},
+	}
+	authorizeURL := ts.URL + cliAuthorizePath + "?" + grant.Encode()
+
+	// Signed out browsers sign in first and come back
+	browser := newTestClient()
+	resp, err := browser.Get(authorizeURL)
+	assert.NoError(err)
+	location, _ := url.Parse(resp.Header.Get("Location"))
+	assert.Equal("/signin.html", location.Path)
+	assert.Equal(safeReturnTo(location.Query().Get("return_to")), location.Query().Get("return_to"))
+
+	devSignIn(t, browser, ts.URL, url.Values{"sub": {"alice"}, "email": {"alice@example.com"}})
+	resp, err = browser.Get(ts.URL + cliAuthorizePath + "?" + strings.Replace(grant.Encode(), "127.0.0.1", "evil.example", 1))
+	assert.NoError(err)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	resp, err = browser.Get(authorizeURL)
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Contains(resp.Header.Get("Content-Security-Policy"), "form-action 'self' http://127.0.0.1:41234")
+	page, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Contains(string(page), "laptop")
+
+	approve := func(answer string) url.Values {
+		form := url.Values{"approve": {answer}}
+		for k, v := range grant {
+			form[k] = v
+		}
+		resp, err := browser.PostForm(ts.URL+cliAuthorizePath, form)
+		assert.NoError(err)
+		assert.Equal(http.StatusFound, resp.StatusCode)
+		location, _ := url.Parse(resp.Header.Get("Location"))
+		assert.Equal("127.0.0.1:41234", location.Host)
+		assert.Equal("xyz", location.Query().Get("state"))
+		return location.Query()
+	}
+	assert.Equal("access_denied", approve("false").Get("error"))
+	code := approve("true").Get("code")
+	assert.NotEmpty(code)
+
+	// The exchange needs no session, only the code and its verifier
+	exchange := func(code, verifier string) *http.Response {
+		resp, err := http.PostForm(ts.URL+cliTokenPath, url.Values{"code": {code}, "code_verifier": {verifier}, "name": {"laptop"}})
+		assert.NoError(err)
+		return resp
+	}
+	assert.Equal(http.StatusBadRequest, exchange(code, randomToken()).StatusCode)
+	resp = exchange(code, verifier)
+	assert.Equal(http.StatusCreated, resp.StatusCode)
+	var token NewAccessToken
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&token))
+	assert.Equal("laptop", token.Name)
+	assert.Equal([]string{"read", "write"}, token.Scopes)
+	assert.Equal(http.StatusBadRequest, exchange(code, verifier).StatusCode)
+
+	resp, err = http.DefaultClient.Do(bearerRequest("GET", ts.URL+"/api/v1/me", token.Token))
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+}
@@ -0,0 +1,14 @@
+package app
+
+// contextKey names the values the middleware puts in request contexts.
+type contextKey int
+
+const (
+	// userIDContextKey holds the user of a request signed in with an
+	// access token.
+	userIDContextKey contextKey = iota
+	// cspNonceContextKey holds the nonce scripts of the page need
+	cspNonceContextKey
+	clientIPContextKey
+	httpsContextKey
+)
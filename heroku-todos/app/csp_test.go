@@ -0,0 +1,83 @@
+package app
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"tuckersWeb/todos/web"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var noncePattern = regexp.MustCompile(`script-src 'nonce-([^']+)' 'strict-dynamic'`)
+
+// assertScriptsNonced checks that the policy of resp only runs scripts with
+// its nonce, and that every script of body has it.
+func assertScriptsNonced(t *testing.T, resp *http.Response, body string) string {
+	policy := resp.Header.Get("Content-Security-Policy")
+	assert.NotContains(t, policy, "unsafe-inline")
+	match := noncePattern.FindStringSubmatch(policy)
+	if !assert.NotNil(t, match, "no nonce in %q", policy) {
+		return ""
+	}
+	assert.True(t, strings.Count(body, "<script") > 0)
+	assert.Equal(t, strings.Count(body, "<script"), strings.Count(body, `<script nonce="`+match[1]+`"`))
+	return match[1]
+}
+
+func TestXSSNeverInterpreted(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	ah := MakeHandler(testConfig())
+	defer ah.Close()
+
+	ts := httptest.NewServer(ah)
+	defer ts.Close()
+	browser := newTestClient()
+	devSignIn(t, browser, ts.URL, url.Values{"sub": {"alice"}, "email": {"alice@example.com"}})
+
+	malicious := `<img src=x onerror=alert(1)><script>alert(2)</script>`
+	resp, err := browser.PostForm(ts.URL+"/todos", url.Values{"name": {malicious}})
+	assert.NoError(err)
+	assert.Equal(http.StatusCreated, resp.StatusCode)
+	added, _ := ioutil.ReadAll(resp.Body)
+	assert.NotContains(string(added), "<")
+
+	get := func(path string) (*http.Response, string) {
+		resp, err := browser.Get(ts.URL + path)
+		assert.NoError(err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(body)
+	}
+	resp, page := get("/")
+	assert.NotContains(page, "<img")
+	assert.NotContains(page, "<script>alert")
+	assert.Contains(page, "&lt;img src=x onerror=alert(1)&gt;&lt;script&gt;alert(2)&lt;/script&gt;")
+	nonce := assertScriptsNonced(t, resp, page)
+
+	resp, page = get("/")
+	assert.NotEqual(nonce, assertScriptsNonced(t, resp, page))
+
+	// Pages loading their content with scripts get the nonce too
+	resp, page = get("/sessions.html")
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assertScriptsNonced(t, resp, page)
+	assert.Empty(resp.Header.Get("ETag"))
+
+	// The script adding todos puts names in as text
+	script, err := fs.ReadFile(web.FS, "public/todo.js")
+	assert.NoError(err)
+	for _, line := range strings.Split(string(script), "\n") {
+		if strings.Contains(line, "item.name") {
+			assert.Contains(line, "createTextNode(", "todo.js uses item.name as markup: %s", line)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package app
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/sessions"
+)
+
+const (
+	// csrfCookieName is readable by scripts, which echo it back in the
+	// csrfHeaderName header or the csrfFormField of plain forms.
+	csrfCookieName = "XSRF-TOKEN"
+	csrfHeaderName = "X-CSRF-Token"
+	csrfFormField  = "csrf_token"
+)
+
+// changesState reports whether the request may modify data. GET
+// /complete-todo is a deprecated route that still does.
+func changesState(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return strings.HasPrefix(r.URL.Path, "/complete-todo/")
+	}
+	return true
+}
+
+// CheckCSRF keeps a synchronizer token in the session and rejects state
+// changing requests that don't send it back. Requests signed in with an
+// access token, and the command-line client's code exchange, carry no
+// ambient credentials and are let through.
+func (a *AppHandler) CheckCSRF(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if _, ok := r.Context().Value(userIDContextKey).(int); ok || r.URL.Path == cliTokenPath {
+		next(w, r)
+		return
+	}
+
+	session, _ := a.store.Get(r, "session")
+	token, _ := session.Values["csrf_token"].(string)
+	if token == "" {
+		token = newCSRFToken(w, r, session)
+		if err := session.Save(r, w); err != nil {
+			serverError(w, r, "failed to save session", err)
+			return
+		}
+	} else if c, err := r.Cookie(csrfCookieName); err != nil || c.Value != token {
+		setCSRFCookie(w, r, token)
+	}
+
+	if changesState(r) {
+		sent := r.Header.Get(csrfHeaderName)
+		if sent == "" {
+			if err := r.ParseForm(); isBodyTooLarge(err) {
+				httpError(w, r, "request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			sent = r.PostFormValue(csrfFormField)
+		}
+		if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+			httpError(w, r, "invalid CSRF token", http.StatusForbidden)
+			return
+		}
+	}
+	next(w, r)
+}
+
+// newCSRFToken puts a new token into session, which the caller saves, and
+// hands it to scripts.
+func newCSRFToken(w http.ResponseWriter, r *http.Request, session *sessions.Session) string {
+	token := randomToken()
+	session.Values["csrf_token"] = token
+	setCSRFCookie(w, r, token)
+	return token
+}
+
+func setCSRFCookie(w http.ResponseWriter, r *http.Request, token string) {
+	http.SetCookie(w, &http.Cookie{Name: csrfCookieName, Value: token, Path: "/", Secure: isHTTPS(r), SameSite: http.SameSiteStrictMode})
+}
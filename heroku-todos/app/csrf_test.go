@@ -0,0 +1,116 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"tuckersWeb/todos/model"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCSRF(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	ah := MakeHandler(testConfig())
+	defer ah.Close()
+	ah.providers.Register(&stubProvider{"alpha"})
+
+	ts := httptest.NewServer(ah)
+	defer ts.Close()
+
+	// A browser that doesn't send the token back, like a cross-site form
+	jar, _ := cookiejar.New(nil)
+	browser := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp := signIn(t, browser, ts.URL, "alpha", "alice")
+	assert.Equal(http.StatusTemporaryRedirect, resp.StatusCode)
+	resp, err := browser.Get(ts.URL + "/todos")
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	u, _ := url.Parse(ts.URL)
+	var token string
+	for _, c := range jar.Cookies(u) {
+		if c.Name == csrfCookieName {
+			token = c.Value
+		}
+	}
+	assert.NotEmpty(token)
+
+	resp, err = browser.PostForm(ts.URL+"/todos", url.Values{"name": {"forged"}})
+	assert.NoError(err)
+	assert.Equal(http.StatusForbidden, resp.StatusCode)
+	resp, err = browser.PostForm(ts.URL+"/todos", url.Values{"name": {"forged"}, csrfFormField: {"wrong"}})
+	assert.NoError(err)
+	assert.Equal(http.StatusForbidden, resp.StatusCode)
+
+	resp, err = browser.PostForm(ts.URL+"/todos", url.Values{"name": {"from a form"}, csrfFormField: {token}})
+	assert.NoError(err)
+	assert.Equal(http.StatusCreated, resp.StatusCode)
+	var todo model.Todo
+	err = json.NewDecoder(resp.Body).Decode(&todo)
+	assert.NoError(err)
+	id := strconv.Itoa(todo.ID)
+
+	req, _ := http.NewRequest("PUT", ts.URL+"/todos/"+id+"/completion", strings.NewReader("complete=true"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err = browser.Do(req)
+	assert.NoError(err)
+	assert.Equal(http.StatusForbidden, resp.StatusCode)
+	req.Body, _ = req.GetBody()
+	req.Header.Set(csrfHeaderName, token)
+	resp, err = browser.Do(req)
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	// The old GET route still works for scripts that send the token
+	resp, err = browser.Get(ts.URL + "/complete-todo/" + id + "?complete=false")
+	assert.NoError(err)
+	assert.Equal(http.StatusForbidden, resp.StatusCode)
+	req, _ = http.NewRequest("GET", ts.URL+"/complete-todo/"+id+"?complete=false", nil)
+	req.Header.Set(csrfHeaderName, token)
+	resp, err = browser.Do(req)
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("true", resp.Header.Get("Deprecation"))
+	assert.Equal(`</todos/`+id+`/completion>; rel="successor-version"`, resp.Header.Get("Link"))
+
+	// Signing out needs the token too
+	resp, err = browser.PostForm(ts.URL+"/auth/logout", nil)
+	assert.NoError(err)
+	assert.Equal(http.StatusForbidden, resp.StatusCode)
+
+	// Signing in again hands out a new token
+	signIn(t, browser, ts.URL, "alpha", "alice")
+	resp, err = browser.PostForm(ts.URL+"/todos", url.Values{"name": {"stale"}, csrfFormField: {token}})
+	assert.NoError(err)
+	assert.Equal(http.StatusForbidden, resp.StatusCode)
+
+	// Access tokens aren't sent by browsers on their own and need no CSRF token
+	user := ah.db.SignInUser(context.Background(), &model.Identity{Provider: "alpha", Subject: "alice"})
+	tdp := "tdp_" + randomToken()
+	ah.db.CreateAccessToken(context.Background(), &model.AccessToken{UserID: user.ID, Name: "ci", TokenHash: hashToken(tdp), Scopes: []string{"read", "write"}, ExpiresAt: time.Now().Add(time.Hour)})
+	resp, err = http.DefaultClient.Do(bearerRequest("POST", ts.URL+"/todos?name=ci", tdp))
+	assert.NoError(err)
+	assert.Equal(http.StatusCreated, resp.StatusCode)
+
+	// A read-only token can't complete todos through the old GET route
+	readOnly := "tdp_" + randomToken()
+	ah.db.CreateAccessToken(context.Background(), &model.AccessToken{UserID: user.ID, Name: "ro", TokenHash: hashToken(readOnly), Scopes: []string{"read"}, ExpiresAt: time.Now().Add(time.Hour)})
+	resp, err = http.DefaultClient.Do(bearerRequest("GET", ts.URL+"/complete-todo/"+id+"?complete=true", readOnly))
+	assert.NoError(err)
+	assert.Equal(http.StatusForbidden, resp.StatusCode)
+}
@@ -0,0 +1,216 @@
+package app
+
+import (
+	"context"
+	"time"
+
+	"tuckersWeb/todos/model"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// instrumentedDB times every call into the database it wraps.
+type instrumentedDB struct {
+	model.DBHandler
+	backend  string
+	duration *prometheus.HistogramVec
+}
+
+func (d *instrumentedDB) observe(method string, start time.Time) {
+	d.duration.WithLabelValues(method, d.backend).Observe(time.Since(start).Seconds())
+}
+
+func (d *instrumentedDB) SignInUser(ctx context.Context, identity *model.Identity) *model.User {
+	defer d.observe("SignInUser", time.Now())
+	return d.DBHandler.SignInUser(ctx, identity)
+}
+
+func (d *instrumentedDB) LinkIdentity(ctx context.Context, userID int, identity *model.Identity) bool {
+	defer d.observe("LinkIdentity", time.Now())
+	return d.DBHandler.LinkIdentity(ctx, userID, identity)
+}
+
+func (d *instrumentedDB) GetUser(ctx context.Context, id int) *model.User {
+	defer d.observe("GetUser", time.Now())
+	return d.DBHandler.GetUser(ctx, id)
+}
+
+func (d *instrumentedDB) GetUsers(ctx context.Context, ids []int) []*model.User {
+	defer d.observe("GetUsers", time.Now())
+	return d.DBHandler.GetUsers(ctx, ids)
+}
+
+func (d *instrumentedDB) GetIdentities(ctx context.Context, userID int) []*model.Identity {
+	defer d.observe("GetIdentities", time.Now())
+	return d.DBHandler.GetIdentities(ctx, userID)
+}
+
+func (d *instrumentedDB) GetIdentitiesByUsers(ctx context.Context, ids []int) map[int][]*model.Identity {
+	defer d.observe("GetIdentitiesByUsers", time.Now())
+	return d.DBHandler.GetIdentitiesByUsers(ctx, ids)
+}
+
+func (d *instrumentedDB) CreateLocalAccount(ctx context.Context, email string, passwordHash []byte) *model.User {
+	defer d.observe("CreateLocalAccount", time.Now())
+	return d.DBHandler.CreateLocalAccount(ctx, email, passwordHash)
+}
+
+func (d *instrumentedDB) GetLocalAccount(ctx context.Context, email string) *model.LocalAccount {
+	defer d.observe("GetLocalAccount", time.Now())
+	return d.DBHandler.GetLocalAccount(ctx, email)
+}
+
+func (d *instrumentedDB) SetPasswordHash(ctx context.Context, userID int, passwordHash []byte) bool {
+	defer d.observe("SetPasswordHash", time.Now())
+	return d.DBHandler.SetPasswordHash(ctx, userID, passwordHash)
+}
+
+func (d *instrumentedDB) SetEmailVerified(ctx context.Context, userID int) bool {
+	defer d.observe("SetEmailVerified", time.Now())
+	return d.DBHandler.SetEmailVerified(ctx, userID)
+}
+
+func (d *instrumentedDB) CreateEmailToken(ctx context.Context, userID int, purpose string, tokenHash string, expiresAt time.Time) {
+	defer d.observe("CreateEmailToken", time.Now())
+	d.DBHandler.CreateEmailToken(ctx, userID, purpose, tokenHash, expiresAt)
+}
+
+func (d *instrumentedDB) UseEmailToken(ctx context.Context, purpose string, tokenHash string) int {
+	defer d.observe("UseEmailToken", time.Now())
+	return d.DBHandler.UseEmailToken(ctx, purpose, tokenHash)
+}
+
+func (d *instrumentedDB) CreateSession(ctx context.Context, session *model.Session) int {
+	defer d.observe("CreateSession", time.Now())
+	return d.DBHandler.CreateSession(ctx, session)
+}
+
+func (d *instrumentedDB) GetSession(ctx context.Context, tokenHash string) *model.Session {
+	defer d.observe("GetSession", time.Now())
+	return d.DBHandler.GetSession(ctx, tokenHash)
+}
+
+func (d *instrumentedDB) UpdateSession(ctx context.Context, tokenHash string, userID int, data []byte) bool {
+	defer d.observe("UpdateSession", time.Now())
+	return d.DBHandler.UpdateSession(ctx, tokenHash, userID, data)
+}
+
+func (d *instrumentedDB) TouchSession(ctx context.Context, tokenHash string, lastSeenAt time.Time, ip string) {
+	defer d.observe("TouchSession", time.Now())
+	d.DBHandler.TouchSession(ctx, tokenHash, lastSeenAt, ip)
+}
+
+func (d *instrumentedDB) DeleteSession(ctx context.Context, tokenHash string) bool {
+	defer d.observe("DeleteSession", time.Now())
+	return d.DBHandler.DeleteSession(ctx, tokenHash)
+}
+
+func (d *instrumentedDB) GetUserSessions(ctx context.Context, userID int) []*model.Session {
+	defer d.observe("GetUserSessions", time.Now())
+	return d.DBHandler.GetUserSessions(ctx, userID)
+}
+
+func (d *instrumentedDB) DeleteUserSession(ctx context.Context, userID int, id int) bool {
+	defer d.observe("DeleteUserSession", time.Now())
+	return d.DBHandler.DeleteUserSession(ctx, userID, id)
+}
+
+func (d *instrumentedDB) DeleteUserSessions(ctx context.Context, userID int) int {
+	defer d.observe("DeleteUserSessions", time.Now())
+	return d.DBHandler.DeleteUserSessions(ctx, userID)
+}
+
+func (d *instrumentedDB) DeleteExpiredSessions(ctx context.Context, now time.Time, idleSince time.Time) int {
+	defer d.observe("DeleteExpiredSessions", time.Now())
+	return d.DBHandler.DeleteExpiredSessions(ctx, now, idleSince)
+}
+
+func (d *instrumentedDB) CountActiveSessions(ctx context.Context, now time.Time, idleSince time.Time) int {
+	defer d.observe("CountActiveSessions", time.Now())
+	return d.DBHandler.CountActiveSessions(ctx, now, idleSince)
+}
+
+func (d *instrumentedDB) CreateAccessToken(ctx context.Context, token *model.AccessToken) int {
+	defer d.observe("CreateAccessToken", time.Now())
+	return d.DBHandler.CreateAccessToken(ctx, token)
+}
+
+func (d *instrumentedDB) GetAccessToken(ctx context.Context, tokenHash string) *model.AccessToken {
+	defer d.observe("GetAccessToken", time.Now())
+	return d.DBHandler.GetAccessToken(ctx, tokenHash)
+}
+
+func (d *instrumentedDB) GetAccessTokens(ctx context.Context, userID int) []*model.AccessToken {
+	defer d.observe("GetAccessTokens", time.Now())
+	return d.DBHandler.GetAccessTokens(ctx, userID)
+}
+
+func (d *instrumentedDB) RevokeAccessToken(ctx context.Context, userID int, id int) bool {
+	defer d.observe("RevokeAccessToken", time.Now())
+	return d.DBHandler.RevokeAccessToken(ctx, userID, id)
+}
+
+func (d *instrumentedDB) TouchAccessToken(ctx context.Context, id int, lastUsedAt time.Time, ip string) {
+	defer d.observe("TouchAccessToken", time.Now())
+	d.DBHandler.TouchAccessToken(ctx, id, lastUsedAt, ip)
+}
+
+func (d *instrumentedDB) TakeToken(ctx context.Context, key string, capacity int, interval time.Duration, now time.Time) (model.Bucket, bool) {
+	defer d.observe("TakeToken", time.Now())
+	return d.DBHandler.TakeToken(ctx, key, capacity, interval, now)
+}
+
+func (d *instrumentedDB) DeleteIdleBuckets(ctx context.Context, idleSince time.Time) int {
+	defer d.observe("DeleteIdleBuckets", time.Now())
+	return d.DBHandler.DeleteIdleBuckets(ctx, idleSince)
+}
+
+func (d *instrumentedDB) GetTodos(ctx context.Context, userID int) []*model.Todo {
+	defer d.observe("GetTodos", time.Now())
+	return d.DBHandler.GetTodos(ctx, userID)
+}
+
+func (d *instrumentedDB) FindTodos(ctx context.Context, userID int, filter model.TodoFilter) ([]*model.Todo, int) {
+	defer d.observe("FindTodos", time.Now())
+	return d.DBHandler.FindTodos(ctx, userID, filter)
+}
+
+func (d *instrumentedDB) GetTodo(ctx context.Context, userID int, id int) *model.Todo {
+	defer d.observe("GetTodo", time.Now())
+	return d.DBHandler.GetTodo(ctx, userID, id)
+}
+
+func (d *instrumentedDB) AddTodo(ctx context.Context, userID int, name string) *model.Todo {
+	defer d.observe("AddTodo", time.Now())
+	return d.DBHandler.AddTodo(ctx, userID, name)
+}
+
+func (d *instrumentedDB) RemoveTodo(ctx context.Context, userID int, id int) bool {
+	defer d.observe("RemoveTodo", time.Now())
+	return d.DBHandler.RemoveTodo(ctx, userID, id)
+}
+
+func (d *instrumentedDB) CompleteTodo(ctx context.Context, userID int, id int, complete bool) bool {
+	defer d.observe("CompleteTodo", time.Now())
+	return d.DBHandler.CompleteTodo(ctx, userID, id, complete)
+}
+
+func (d *instrumentedDB) RenameTodo(ctx context.Context, userID int, id int, name string) bool {
+	defer d.observe("RenameTodo", time.Now())
+	return d.DBHandler.RenameTodo(ctx, userID, id, name)
+}
+
+func (d *instrumentedDB) SetTodoTags(ctx context.Context, userID int, id int, tags []string) bool {
+	defer d.observe("SetTodoTags", time.Now())
+	return d.DBHandler.SetTodoTags(ctx, userID, id, tags)
+}
+
+func (d *instrumentedDB) GetTagsByTodos(ctx context.Context, ids []int) map[int][]string {
+	defer d.observe("GetTagsByTodos", time.Now())
+	return d.DBHandler.GetTagsByTodos(ctx, ids)
+}
+
+func (d *instrumentedDB) GetHistoryByTodos(ctx context.Context, ids []int) map[int][]*model.TodoChange {
+	defer d.observe("GetHistoryByTodos", time.Now())
+	return d.DBHandler.GetHistoryByTodos(ctx, ids)
+}
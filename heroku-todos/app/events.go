@@ -0,0 +1,125 @@
+package app
+
+import (
+	"context"
+	"sync"
+
+	"tuckersWeb/todos/model"
+)
+
+const (
+	todoAdded   = "ADDED"
+	todoUpdated = "UPDATED"
+	todoRemoved = "REMOVED"
+)
+
+// todoEventBuffer is how many changes a subscriber may fall behind by
+// before further changes are dropped for it.
+const todoEventBuffer = 16
+
+// todoEvent is a change to one of a user's todos. Todo is nil when the todo
+// was removed.
+type todoEvent struct {
+	Type string
+	ID   int
+	Todo *model.Todo
+}
+
+// todoEvents hands the changes to each user's todos to that user's
+// subscribers in this process.
+type todoEvents struct {
+	mu   sync.Mutex
+	subs map[int]map[chan todoEvent]bool
+}
+
+func newTodoEvents() *todoEvents {
+	return &todoEvents{subs: make(map[int]map[chan todoEvent]bool)}
+}
+
+// subscribe returns the changes to userID's todos until unsubscribe is
+// called, which closes the channel.
+func (e *todoEvents) subscribe(userID int) (events <-chan todoEvent, unsubscribe func()) {
+	ch := make(chan todoEvent, todoEventBuffer)
+	e.mu.Lock()
+	if e.subs[userID] == nil {
+		e.subs[userID] = make(map[chan todoEvent]bool)
+	}
+	e.subs[userID][ch] = true
+	e.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			e.mu.Lock()
+			delete(e.subs[userID], ch)
+			if len(e.subs[userID]) == 0 {
+				delete(e.subs, userID)
+			}
+			e.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+func (e *todoEvents) publish(userID int, event todoEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for ch := range e.subs[userID] {
+		select {
+		case ch <- event:
+		default:
+			// a stuck subscriber must not hold up the request
+		}
+	}
+}
+
+// publishingDB publishes the changes made to todos through it, whichever
+// API they came from.
+type publishingDB struct {
+	model.DBHandler
+	events *todoEvents
+}
+
+func (d *publishingDB) AddTodo(ctx context.Context, userID int, name string) *model.Todo {
+	todo := d.DBHandler.AddTodo(ctx, userID, name)
+	d.events.publish(userID, todoEvent{Type: todoAdded, ID: todo.ID, Todo: todo})
+	return todo
+}
+
+func (d *publishingDB) RemoveTodo(ctx context.Context, userID int, id int) bool {
+	ok := d.DBHandler.RemoveTodo(ctx, userID, id)
+	if ok {
+		d.events.publish(userID, todoEvent{Type: todoRemoved, ID: id})
+	}
+	return ok
+}
+
+func (d *publishingDB) CompleteTodo(ctx context.Context, userID int, id int, complete bool) bool {
+	ok := d.DBHandler.CompleteTodo(ctx, userID, id, complete)
+	if ok {
+		d.updated(ctx, userID, id)
+	}
+	return ok
+}
+
+func (d *publishingDB) RenameTodo(ctx context.Context, userID int, id int, name string) bool {
+	ok := d.DBHandler.RenameTodo(ctx, userID, id, name)
+	if ok {
+		d.updated(ctx, userID, id)
+	}
+	return ok
+}
+
+func (d *publishingDB) SetTodoTags(ctx context.Context, userID int, id int, tags []string) bool {
+	ok := d.DBHandler.SetTodoTags(ctx, userID, id, tags)
+	if ok {
+		d.updated(ctx, userID, id)
+	}
+	return ok
+}
+
+func (d *publishingDB) updated(ctx context.Context, userID int, id int) {
+	if todo := d.DBHandler.GetTodo(ctx, userID, id); todo != nil {
+		d.events.publish(userID, todoEvent{Type: todoUpdated, ID: id, Todo: todo})
+	}
+}
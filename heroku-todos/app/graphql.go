@@ -0,0 +1,716 @@
+package app
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"tuckersWeb/todos/logging"
+	"tuckersWeb/todos/model"
+
+	"github.com/graph-gophers/dataloader"
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/graph-gophers/graphql-transport-ws/graphqlws"
+)
+
+const (
+	graphqlPath = "/graphql"
+	// graphqlMaxDepth bounds how deeply queries may nest.
+	graphqlMaxDepth = 10
+	// graphqlBatchWait is how long a loader collects keys before it loads
+	// them in one query.
+	graphqlBatchWait = 2 * time.Millisecond
+	maxTodosPage     = 100
+	todoCursorPrefix = "todo:"
+)
+
+const graphqlSchema = `
+schema {
+	query: Query
+	mutation: Mutation
+	subscription: Subscription
+}
+
+scalar Time
+
+type Query {
+	me: User!
+	# todos are ordered by id. first is at most 100.
+	todos(completed: Boolean, search: String, tag: String, first: Int = 20, after: String): TodoConnection!
+	todo(id: ID!): Todo
+}
+
+# Mutations must be sent with POST. Those naming a todo that doesn't exist
+# return null.
+type Mutation {
+	addTodo(name: String!, tags: [String!]): Todo!
+	# tags replaces the tags of the todo
+	updateTodo(id: ID!, name: String, completed: Boolean, tags: [String!]): Todo
+	completeTodo(id: ID!, completed: Boolean = true): Todo
+	removeTodo(id: ID!): Boolean!
+}
+
+type Subscription {
+	# todoChanged sends every change to the signed in user's todos, from
+	# whichever API it was made through.
+	todoChanged: TodoEvent!
+}
+
+type Todo {
+	id: ID!
+	name: String!
+	completed: Boolean!
+	createdAt: Time!
+	owner: User!
+	# tags are in alphabetical order
+	tags: [String!]!
+	# history lists the changes to the todo, oldest first
+	history: [TodoChange!]!
+}
+
+enum TodoChangeType {
+	ADDED
+	RENAMED
+	COMPLETED
+	REOPENED
+	TAGGED
+}
+
+# TodoChange has the name and state a change left the todo in.
+type TodoChange {
+	type: TodoChangeType!
+	name: String!
+	completed: Boolean!
+	createdAt: Time!
+}
+
+type TodoConnection {
+	edges: [TodoEdge!]!
+	pageInfo: PageInfo!
+	totalCount: Int!
+}
+
+type TodoEdge {
+	cursor: String!
+	node: Todo!
+}
+
+type PageInfo {
+	hasNextPage: Boolean!
+	endCursor: String
+}
+
+enum TodoEventType {
+	ADDED
+	UPDATED
+	REMOVED
+}
+
+type TodoEvent {
+	type: TodoEventType!
+	id: ID!
+	# todo is null when it was removed
+	todo: Todo
+}
+
+type User {
+	id: ID!
+	email: String!
+	name: String!
+	picture: String!
+	createdAt: Time!
+	lastLoginAt: Time!
+	identities: [Identity!]!
+}
+
+type Identity {
+	provider: String!
+	subject: String!
+	email: String!
+	createdAt: Time!
+}
+`
+
+type graphqlContextKey int
+
+const (
+	graphqlViewerKey graphqlContextKey = iota
+	graphqlLoadersKey
+	graphqlReadOnlyKey
+)
+
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// newGraphQLHandler serves queries and mutations over HTTP and
+// subscriptions over websockets speaking the graphql-ws protocol.
+func (a *AppHandler) newGraphQLHandler() http.Handler {
+	schema := graphql.MustParseSchema(graphqlSchema, &graphqlResolver{a},
+		graphql.MaxDepth(graphqlMaxDepth),
+		graphql.Logger(graphqlLogger{}))
+	ws := graphqlws.NewHandler()
+	// The default upgrader takes connections from any origin, which would
+	// let other sites subscribe with the session cookie.
+	ws.Upgrader.CheckOrigin = nil
+	return ws.NewHandlerFunc(schema, a.graphqlHTTPHandler(schema),
+		graphqlws.WithContextGenerator(graphqlws.ContextGeneratorFunc(a.graphqlConnectionContext)))
+}
+
+func (a *AppHandler) graphqlHTTPHandler(schema *graphql.Schema) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req graphqlRequest
+		ctx := r.Context()
+		if r.Method == "GET" {
+			q := r.URL.Query()
+			req.Query = q.Get("query")
+			req.OperationName = q.Get("operationName")
+			if v := q.Get("variables"); v != "" {
+				if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+					writeProblem(w, r, http.StatusBadRequest, "invalid variables: "+err.Error())
+					return
+				}
+			}
+			// GET isn't checked for CSRF, so it may only read
+			ctx = context.WithValue(ctx, graphqlReadOnlyKey, errMutationOverGET)
+		} else if !decodeJSON(w, r, &req) {
+			return
+		}
+		if req.Query == "" {
+			writeProblem(w, r, http.StatusBadRequest, "query is required")
+			return
+		}
+
+		ctx = context.WithValue(ctx, graphqlViewerKey, a.getUserID(r))
+		ctx = context.WithValue(ctx, graphqlLoadersKey, a.newGraphQLLoaders())
+		a.rd.JSON(w, http.StatusOK, schema.Exec(ctx, req.Query, req.OperationName, req.Variables))
+	}
+}
+
+// graphqlConnectionContext is the context of a websocket connection, which
+// outlives the request that opened it. It gets no loaders, whose cache
+// would go stale over the life of a subscription. The connection was
+// opened with a GET, which only needs read scope, so it may only read.
+func (a *AppHandler) graphqlConnectionContext(ctx context.Context, r *http.Request) (context.Context, error) {
+	ctx = logging.NewContext(ctx, logging.FromContext(r.Context()))
+	ctx = context.WithValue(ctx, graphqlReadOnlyKey, errMutationOverGET)
+	return context.WithValue(ctx, graphqlViewerKey, a.getUserID(r)), nil
+}
+
+type graphqlLogger struct{}
+
+func (graphqlLogger) LogPanic(ctx context.Context, value interface{}) {
+	logging.FromContext(ctx).WithField("panic", fmt.Sprint(value)).Error("panic resolving GraphQL query")
+}
+
+func viewerID(ctx context.Context) int {
+	userID, _ := ctx.Value(graphqlViewerKey).(int)
+	return userID
+}
+
+var (
+	errMutationOverGET = errors.New("mutations must be sent with POST")
+	errNoWriteScope    = errors.New("access token lacks the write scope for mutations")
+)
+
+// checkWritable returns why the request may only read, if it may.
+func checkWritable(ctx context.Context) error {
+	err, _ := ctx.Value(graphqlReadOnlyKey).(error)
+	return err
+}
+
+// Extensions tells GraphQL clients which fields are invalid.
+func (errs ValidationErrors) Extensions() map[string]interface{} {
+	return map[string]interface{}{"code": "VALIDATION_FAILED", "errors": []FieldError(errs)}
+}
+
+// graphqlLoaders batch and cache what nested fields load during one
+// request, so that the owners of a page of todos take one query.
+type graphqlLoaders struct {
+	users      *dataloader.Loader
+	identities *dataloader.Loader
+	tags       *dataloader.Loader
+	history    *dataloader.Loader
+}
+
+type userKey int
+
+func (k userKey) String() string   { return strconv.Itoa(int(k)) }
+func (k userKey) Raw() interface{} { return int(k) }
+
+type todoKey int
+
+func (k todoKey) String() string   { return strconv.Itoa(int(k)) }
+func (k todoKey) Raw() interface{} { return int(k) }
+
+func (a *AppHandler) newGraphQLLoaders() *graphqlLoaders {
+	return &graphqlLoaders{
+		users:      dataloader.NewBatchedLoader(a.batchUsers, dataloader.WithWait(graphqlBatchWait)),
+		identities: dataloader.NewBatchedLoader(a.batchIdentities, dataloader.WithWait(graphqlBatchWait)),
+		tags:       dataloader.NewBatchedLoader(a.batchTags, dataloader.WithWait(graphqlBatchWait)),
+		history:    dataloader.NewBatchedLoader(a.batchHistory, dataloader.WithWait(graphqlBatchWait)),
+	}
+}
+
+func (a *AppHandler) batchUsers(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+	ids := make([]int, len(keys))
+	for i, key := range keys {
+		ids[i] = key.Raw().(int)
+	}
+	byID := make(map[int]*model.User)
+	for _, user := range a.db.GetUsers(ctx, ids) {
+		byID[user.ID] = user
+	}
+	results := make([]*dataloader.Result, len(keys))
+	for i, id := range ids {
+		results[i] = &dataloader.Result{Data: byID[id]}
+	}
+	return results
+}
+
+func (a *AppHandler) batchIdentities(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+	ids := make([]int, len(keys))
+	for i, key := range keys {
+		ids[i] = key.Raw().(int)
+	}
+	byUser := a.db.GetIdentitiesByUsers(ctx, ids)
+	results := make([]*dataloader.Result, len(keys))
+	for i, id := range ids {
+		identities := byUser[id]
+		if identities == nil {
+			identities = []*model.Identity{}
+		}
+		results[i] = &dataloader.Result{Data: identities}
+	}
+	return results
+}
+
+func (a *AppHandler) batchTags(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+	ids := make([]int, len(keys))
+	for i, key := range keys {
+		ids[i] = key.Raw().(int)
+	}
+	byTodo := a.db.GetTagsByTodos(ctx, ids)
+	results := make([]*dataloader.Result, len(keys))
+	for i, id := range ids {
+		tags := byTodo[id]
+		if tags == nil {
+			tags = []string{}
+		}
+		results[i] = &dataloader.Result{Data: tags}
+	}
+	return results
+}
+
+func (a *AppHandler) batchHistory(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+	ids := make([]int, len(keys))
+	for i, key := range keys {
+		ids[i] = key.Raw().(int)
+	}
+	byTodo := a.db.GetHistoryByTodos(ctx, ids)
+	results := make([]*dataloader.Result, len(keys))
+	for i, id := range ids {
+		history := byTodo[id]
+		if history == nil {
+			history = []*model.TodoChange{}
+		}
+		results[i] = &dataloader.Result{Data: history}
+	}
+	return results
+}
+
+func (a *AppHandler) loadUser(ctx context.Context, id int) (*model.User, error) {
+	loaders, ok := ctx.Value(graphqlLoadersKey).(*graphqlLoaders)
+	if !ok {
+		return a.db.GetUser(ctx, id), nil
+	}
+	data, err := loaders.users.Load(ctx, userKey(id))()
+	if err != nil {
+		return nil, err
+	}
+	user, _ := data.(*model.User)
+	return user, nil
+}
+
+func (a *AppHandler) loadIdentities(ctx context.Context, userID int) ([]*model.Identity, error) {
+	loaders, ok := ctx.Value(graphqlLoadersKey).(*graphqlLoaders)
+	if !ok {
+		return a.db.GetIdentities(ctx, userID), nil
+	}
+	data, err := loaders.identities.Load(ctx, userKey(userID))()
+	if err != nil {
+		return nil, err
+	}
+	identities, _ := data.([]*model.Identity)
+	return identities, nil
+}
+
+func (a *AppHandler) loadTags(ctx context.Context, todoID int) ([]string, error) {
+	loaders, ok := ctx.Value(graphqlLoadersKey).(*graphqlLoaders)
+	if !ok {
+		return a.db.GetTagsByTodos(ctx, []int{todoID})[todoID], nil
+	}
+	data, err := loaders.tags.Load(ctx, todoKey(todoID))()
+	if err != nil {
+		return nil, err
+	}
+	tags, _ := data.([]string)
+	return tags, nil
+}
+
+func (a *AppHandler) loadHistory(ctx context.Context, todoID int) ([]*model.TodoChange, error) {
+	loaders, ok := ctx.Value(graphqlLoadersKey).(*graphqlLoaders)
+	if !ok {
+		return a.db.GetHistoryByTodos(ctx, []int{todoID})[todoID], nil
+	}
+	data, err := loaders.history.Load(ctx, todoKey(todoID))()
+	if err != nil {
+		return nil, err
+	}
+	history, _ := data.([]*model.TodoChange)
+	return history, nil
+}
+
+func todoID(id graphql.ID) int {
+	n, err := strconv.Atoi(string(id))
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+func todoCursor(id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(todoCursorPrefix + strconv.Itoa(id)))
+}
+
+func parseTodoCursor(cursor string) (int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err == nil && strings.HasPrefix(string(b), todoCursorPrefix) {
+		if id, err := strconv.Atoi(strings.TrimPrefix(string(b), todoCursorPrefix)); err == nil {
+			return id, nil
+		}
+	}
+	return 0, errors.New("invalid cursor")
+}
+
+// graphqlResolver resolves the fields of Query, Mutation and Subscription.
+type graphqlResolver struct {
+	a *AppHandler
+}
+
+func (q *graphqlResolver) Me(ctx context.Context) (*userResolver, error) {
+	user, err := q.a.loadUser(ctx, viewerID(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, errors.New("the signed in user no longer exists")
+	}
+	return &userResolver{q.a, user}, nil
+}
+
+type todosArgs struct {
+	Completed *bool
+	Search    *string
+	Tag       *string
+	First     int32
+	After     *string
+}
+
+func (q *graphqlResolver) Todos(ctx context.Context, args todosArgs) (*todoConnectionResolver, error) {
+	if args.First < 1 || args.First > maxTodosPage {
+		return nil, errors.New("first must be between 1 and " + strconv.Itoa(maxTodosPage))
+	}
+	after := 0
+	if args.After != nil {
+		var err error
+		if after, err = parseTodoCursor(*args.After); err != nil {
+			return nil, err
+		}
+	}
+
+	filter := model.TodoFilter{Completed: args.Completed, AfterID: after, Limit: int(args.First) + 1}
+	if args.Search != nil {
+		filter.Search = *args.Search
+	}
+	if args.Tag != nil {
+		filter.Tag = *args.Tag
+	}
+	userID := viewerID(ctx)
+	// One more than asked for tells whether there is a next page
+	page, total := q.a.db.FindTodos(ctx, userID, filter)
+	conn := &todoConnectionResolver{totalCount: int32(total)}
+	if len(page) > int(args.First) {
+		page = page[:args.First]
+		conn.hasNextPage = true
+	}
+	for _, todo := range page {
+		conn.edges = append(conn.edges, &todoEdgeResolver{&todoResolver{q.a, todo, userID}})
+	}
+	return conn, nil
+}
+
+func (q *graphqlResolver) Todo(ctx context.Context, args struct{ ID graphql.ID }) *todoResolver {
+	return q.a.todoResolver(ctx, viewerID(ctx), todoID(args.ID))
+}
+
+// todoResolver returns nil when the user has no such todo.
+func (a *AppHandler) todoResolver(ctx context.Context, userID int, id int) *todoResolver {
+	todo := a.db.GetTodo(ctx, userID, id)
+	if todo == nil {
+		return nil
+	}
+	return &todoResolver{a, todo, userID}
+}
+
+func (q *graphqlResolver) AddTodo(ctx context.Context, args struct {
+	Name string
+	Tags *[]string
+}) (*todoResolver, error) {
+	if err := checkWritable(ctx); err != nil {
+		return nil, err
+	}
+	input, err := TodoInput{Name: args.Name}.Validate()
+	if err != nil {
+		return nil, err
+	}
+	var tags []string
+	if args.Tags != nil {
+		if tags, err = validateTags(*args.Tags); err != nil {
+			return nil, err
+		}
+	}
+	userID := viewerID(ctx)
+	todo := q.a.db.AddTodo(ctx, userID, input.Name)
+	if len(tags) > 0 {
+		q.a.db.SetTodoTags(ctx, userID, todo.ID, tags)
+	}
+	return &todoResolver{q.a, todo, userID}, nil
+}
+
+func (q *graphqlResolver) UpdateTodo(ctx context.Context, args struct {
+	ID        graphql.ID
+	Name      *string
+	Completed *bool
+	Tags      *[]string
+}) (*todoResolver, error) {
+	if err := checkWritable(ctx); err != nil {
+		return nil, err
+	}
+	// Nothing is changed unless all of the input is valid
+	var input TodoInput
+	var tags []string
+	var err error
+	if args.Name != nil {
+		if input, err = (TodoInput{Name: *args.Name}).Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if args.Tags != nil {
+		if tags, err = validateTags(*args.Tags); err != nil {
+			return nil, err
+		}
+	}
+	userID, id := viewerID(ctx), todoID(args.ID)
+	if args.Name != nil && !q.a.db.RenameTodo(ctx, userID, id, input.Name) {
+		return nil, nil
+	}
+	if args.Completed != nil && !q.a.db.CompleteTodo(ctx, userID, id, *args.Completed) {
+		return nil, nil
+	}
+	if args.Tags != nil && !q.a.db.SetTodoTags(ctx, userID, id, tags) {
+		return nil, nil
+	}
+	return q.a.todoResolver(ctx, userID, id), nil
+}
+
+func (q *graphqlResolver) CompleteTodo(ctx context.Context, args struct {
+	ID        graphql.ID
+	Completed bool
+}) (*todoResolver, error) {
+	if err := checkWritable(ctx); err != nil {
+		return nil, err
+	}
+	userID, id := viewerID(ctx), todoID(args.ID)
+	if !q.a.db.CompleteTodo(ctx, userID, id, args.Completed) {
+		return nil, nil
+	}
+	return q.a.todoResolver(ctx, userID, id), nil
+}
+
+func (q *graphqlResolver) RemoveTodo(ctx context.Context, args struct{ ID graphql.ID }) (bool, error) {
+	if err := checkWritable(ctx); err != nil {
+		return false, err
+	}
+	return q.a.db.RemoveTodo(ctx, viewerID(ctx), todoID(args.ID)), nil
+}
+
+// TodoChanged streams the user's changes until the subscription is stopped
+// or the server starts shutting down.
+func (q *graphqlResolver) TodoChanged(ctx context.Context) <-chan *todoEventResolver {
+	userID := viewerID(ctx)
+	events, unsubscribe := q.a.events.subscribe(userID)
+	out := make(chan *todoEventResolver)
+	go func() {
+		defer close(out)
+		defer unsubscribe()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-q.a.shutdown:
+				return
+			case event := <-events:
+				select {
+				case out <- &todoEventResolver{q.a, event, userID}:
+				case <-ctx.Done():
+					return
+				case <-q.a.shutdown:
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
+
+type todoResolver struct {
+	a       *AppHandler
+	todo    *model.Todo
+	ownerID int
+}
+
+func (t *todoResolver) ID() graphql.ID          { return graphql.ID(strconv.Itoa(t.todo.ID)) }
+func (t *todoResolver) Name() string            { return t.todo.Name }
+func (t *todoResolver) Completed() bool         { return t.todo.Completed }
+func (t *todoResolver) CreatedAt() graphql.Time { return graphql.Time{Time: t.todo.CreatedAt} }
+
+func (t *todoResolver) Owner(ctx context.Context) (*userResolver, error) {
+	user, err := t.a.loadUser(ctx, t.ownerID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, errors.New("the owner of todo " + strconv.Itoa(t.todo.ID) + " no longer exists")
+	}
+	return &userResolver{t.a, user}, nil
+}
+
+func (t *todoResolver) Tags(ctx context.Context) ([]string, error) {
+	tags, err := t.a.loadTags(ctx, t.todo.ID)
+	if tags == nil {
+		tags = []string{}
+	}
+	return tags, err
+}
+
+func (t *todoResolver) History(ctx context.Context) ([]*todoChangeResolver, error) {
+	history, err := t.a.loadHistory(ctx, t.todo.ID)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*todoChangeResolver, len(history))
+	for i, change := range history {
+		list[i] = &todoChangeResolver{change}
+	}
+	return list, nil
+}
+
+type todoChangeResolver struct {
+	change *model.TodoChange
+}
+
+func (c *todoChangeResolver) Type() string            { return strings.ToUpper(c.change.Type) }
+func (c *todoChangeResolver) Name() string            { return c.change.Name }
+func (c *todoChangeResolver) Completed() bool         { return c.change.Completed }
+func (c *todoChangeResolver) CreatedAt() graphql.Time { return graphql.Time{Time: c.change.CreatedAt} }
+
+type todoConnectionResolver struct {
+	edges       []*todoEdgeResolver
+	hasNextPage bool
+	totalCount  int32
+}
+
+func (c *todoConnectionResolver) Edges() []*todoEdgeResolver { return c.edges }
+func (c *todoConnectionResolver) TotalCount() int32          { return c.totalCount }
+
+func (c *todoConnectionResolver) PageInfo() *pageInfoResolver {
+	info := &pageInfoResolver{hasNextPage: c.hasNextPage}
+	if len(c.edges) > 0 {
+		cursor := c.edges[len(c.edges)-1].Cursor()
+		info.endCursor = &cursor
+	}
+	return info
+}
+
+type todoEdgeResolver struct {
+	node *todoResolver
+}
+
+func (e *todoEdgeResolver) Cursor() string      { return todoCursor(e.node.todo.ID) }
+func (e *todoEdgeResolver) Node() *todoResolver { return e.node }
+
+type pageInfoResolver struct {
+	hasNextPage bool
+	endCursor   *string
+}
+
+func (p *pageInfoResolver) HasNextPage() bool  { return p.hasNextPage }
+func (p *pageInfoResolver) EndCursor() *string { return p.endCursor }
+
+type todoEventResolver struct {
+	a      *AppHandler
+	event  todoEvent
+	userID int
+}
+
+func (e *todoEventResolver) Type() string   { return e.event.Type }
+func (e *todoEventResolver) ID() graphql.ID { return graphql.ID(strconv.Itoa(e.event.ID)) }
+
+func (e *todoEventResolver) Todo() *todoResolver {
+	if e.event.Todo == nil {
+		return nil
+	}
+	return &todoResolver{e.a, e.event.Todo, e.userID}
+}
+
+type userResolver struct {
+	a    *AppHandler
+	user *model.User
+}
+
+func (u *userResolver) ID() graphql.ID            { return graphql.ID(strconv.Itoa(u.user.ID)) }
+func (u *userResolver) Email() string             { return u.user.Email }
+func (u *userResolver) Name() string              { return u.user.Name }
+func (u *userResolver) Picture() string           { return u.user.Picture }
+func (u *userResolver) CreatedAt() graphql.Time   { return graphql.Time{Time: u.user.CreatedAt} }
+func (u *userResolver) LastLoginAt() graphql.Time { return graphql.Time{Time: u.user.LastLoginAt} }
+
+func (u *userResolver) Identities(ctx context.Context) ([]*identityResolver, error) {
+	identities, err := u.a.loadIdentities(ctx, u.user.ID)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*identityResolver, len(identities))
+	for i, identity := range identities {
+		list[i] = &identityResolver{identity}
+	}
+	return list, nil
+}
+
+type identityResolver struct {
+	identity *model.Identity
+}
+
+func (i *identityResolver) Provider() string        { return i.identity.Provider }
+func (i *identityResolver) Subject() string         { return i.identity.Subject }
+func (i *identityResolver) Email() string           { return i.identity.Email }
+func (i *identityResolver) CreatedAt() graphql.Time { return graphql.Time{Time: i.identity.CreatedAt} }
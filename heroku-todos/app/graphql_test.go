@@ -0,0 +1,536 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"tuckersWeb/todos/model"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+type graphqlTestResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []struct {
+		Message    string                 `json:"message"`
+		Extensions map[string]interface{} `json:"extensions"`
+	} `json:"errors"`
+}
+
+// countingDB counts the calls loading users and todos.
+type countingDB struct {
+	model.DBHandler
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (d *countingDB) count(method string) {
+	d.mu.Lock()
+	d.calls[method]++
+	d.mu.Unlock()
+}
+
+func (d *countingDB) GetUser(ctx context.Context, id int) *model.User {
+	d.count("GetUser")
+	return d.DBHandler.GetUser(ctx, id)
+}
+
+func (d *countingDB) GetUsers(ctx context.Context, ids []int) []*model.User {
+	d.count("GetUsers")
+	return d.DBHandler.GetUsers(ctx, ids)
+}
+
+func (d *countingDB) GetIdentities(ctx context.Context, userID int) []*model.Identity {
+	d.count("GetIdentities")
+	return d.DBHandler.GetIdentities(ctx, userID)
+}
+
+func (d *countingDB) GetIdentitiesByUsers(ctx context.Context, ids []int) map[int][]*model.Identity {
+	d.count("GetIdentitiesByUsers")
+	return d.DBHandler.GetIdentitiesByUsers(ctx, ids)
+}
+
+func (d *countingDB) GetTodos(ctx context.Context, userID int) []*model.Todo {
+	d.count("GetTodos")
+	return d.DBHandler.GetTodos(ctx, userID)
+}
+
+func (d *countingDB) GetTagsByTodos(ctx context.Context, ids []int) map[int][]string {
+	d.count("GetTagsByTodos")
+	return d.DBHandler.GetTagsByTodos(ctx, ids)
+}
+
+func (d *countingDB) GetHistoryByTodos(ctx context.Context, ids []int) map[int][]*model.TodoChange {
+	d.count("GetHistoryByTodos")
+	return d.DBHandler.GetHistoryByTodos(ctx, ids)
+}
+
+func TestGraphQL(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	ah := MakeHandler(testConfig())
+	defer ah.Close()
+
+	ts := httptest.NewServer(ah)
+	defer ts.Close()
+
+	// Signed out queries are told to sign in
+	resp, err := newTestClient().Post(ts.URL+"/graphql", "application/json", strings.NewReader(`{"query": "{ me { id } }"}`))
+	assert.NoError(err)
+	decodeProblem(t, resp, http.StatusUnauthorized)
+
+	client := newTestClient()
+	devSignIn(t, client, ts.URL, url.Values{"sub": {"alice"}, "email": {"alice@example.com"}})
+	decode := func(resp *http.Response, v interface{}) graphqlTestResponse {
+		defer resp.Body.Close()
+		assert.Equal(http.StatusOK, resp.StatusCode)
+		var out graphqlTestResponse
+		assert.NoError(json.NewDecoder(resp.Body).Decode(&out))
+		if v != nil && len(out.Data) > 0 {
+			assert.NoError(json.Unmarshal(out.Data, v))
+		}
+		return out
+	}
+	post := func(query string, variables map[string]interface{}, v interface{}) graphqlTestResponse {
+		body, _ := json.Marshal(graphqlRequest{Query: query, Variables: variables})
+		resp, err := client.Post(ts.URL+"/graphql", "application/json", bytes.NewReader(body))
+		assert.NoError(err)
+		return decode(resp, v)
+	}
+	get := func(query string, v interface{}) graphqlTestResponse {
+		resp, err := client.Get(ts.URL + "/graphql?" + url.Values{"query": {query}}.Encode())
+		assert.NoError(err)
+		return decode(resp, v)
+	}
+
+	var added struct {
+		AddTodo struct {
+			ID   string
+			Name string
+		}
+	}
+	ids := []string{}
+	for _, name := range []string{"Write the schema", "Batch the loaders", "Ship it"} {
+		out := post(`mutation($name: String!) { addTodo(name: $name) { id name } }`, map[string]interface{}{"name": name}, &added)
+		assert.Empty(out.Errors)
+		assert.Equal(name, added.AddTodo.Name)
+		ids = append(ids, added.AddTodo.ID)
+	}
+
+	out := post(`mutation { addTodo(name: "  ") { id } }`, nil, nil)
+	if assert.Len(out.Errors, 1) {
+		assert.Equal("VALIDATION_FAILED", out.Errors[0].Extensions["code"])
+	}
+
+	// GET isn't checked for CSRF and must not change anything
+	out = get(`mutation { removeTodo(id: "`+ids[0]+`") }`, nil)
+	if assert.Len(out.Errors, 1) {
+		assert.Contains(out.Errors[0].Message, "POST")
+	}
+
+	// The owners of a page of todos take one query
+	counter := &countingDB{DBHandler: ah.db, calls: map[string]int{}}
+	ah.db = counter
+	type page struct {
+		Me    struct{ Email string }
+		Todos struct {
+			TotalCount int
+			Edges      []struct {
+				Node struct {
+					ID    string
+					Name  string
+					Owner struct{ Email string }
+				}
+			}
+			PageInfo struct {
+				HasNextPage bool
+				EndCursor   string
+			}
+		}
+	}
+	var first page
+	out = get(`{ me { email } todos(first: 2) { totalCount edges { node { id name owner { email } } } pageInfo { hasNextPage endCursor } } }`, &first)
+	assert.Empty(out.Errors)
+	assert.Equal("alice@example.com", first.Me.Email)
+	assert.Equal(3, first.Todos.TotalCount)
+	if assert.Len(first.Todos.Edges, 2) {
+		assert.Equal(ids[0], first.Todos.Edges[0].Node.ID)
+		assert.Equal("alice@example.com", first.Todos.Edges[1].Node.Owner.Email)
+	}
+	assert.True(first.Todos.PageInfo.HasNextPage)
+	assert.Equal(1, counter.calls["GetUsers"])
+	assert.Equal(0, counter.calls["GetUser"])
+	ah.db = counter.DBHandler
+
+	var second page
+	out = get(`{ todos(first: 2, after: "`+first.Todos.PageInfo.EndCursor+`") { edges { node { id } } pageInfo { hasNextPage } } }`, &second)
+	assert.Empty(out.Errors)
+	if assert.Len(second.Todos.Edges, 1) {
+		assert.Equal(ids[2], second.Todos.Edges[0].Node.ID)
+	}
+	assert.False(second.Todos.PageInfo.HasNextPage)
+	out = get(`{ todos(after: "bogus") { totalCount } }`, nil)
+	assert.NotEmpty(out.Errors)
+
+	var updated struct {
+		UpdateTodo *struct {
+			Name      string
+			Completed bool
+		}
+	}
+	out = post(`mutation($id: ID!) { updateTodo(id: $id, name: "Ship it today", completed: true) { name completed } }`,
+		map[string]interface{}{"id": ids[2]}, &updated)
+	assert.Empty(out.Errors)
+	if assert.NotNil(updated.UpdateTodo) {
+		assert.Equal("Ship it today", updated.UpdateTodo.Name)
+		assert.True(updated.UpdateTodo.Completed)
+	}
+	post(`mutation { updateTodo(id: "9999", completed: true) { name } }`, nil, &updated)
+	assert.Nil(updated.UpdateTodo)
+
+	var filtered page
+	out = get(`{ todos(completed: true, search: "SHIP") { totalCount edges { node { id } } } }`, &filtered)
+	assert.Empty(out.Errors)
+	assert.Equal(1, filtered.Todos.TotalCount)
+
+	var removed struct{ RemoveTodo bool }
+	post(`mutation($id: ID!) { removeTodo(id: $id) }`, map[string]interface{}{"id": ids[0]}, &removed)
+	assert.True(removed.RemoveTodo)
+	post(`mutation($id: ID!) { removeTodo(id: $id) }`, map[string]interface{}{"id": ids[0]}, &removed)
+	assert.False(removed.RemoveTodo)
+	var one struct{ Todo *struct{ ID string } }
+	get(`{ todo(id: "`+ids[0]+`") { id } }`, &one)
+	assert.Nil(one.Todo)
+
+	// Other users see none of alice's todos
+	bob := newTestClient()
+	devSignIn(t, bob, ts.URL, url.Values{"sub": {"bob"}, "email": {"bob@example.com"}})
+	resp, err = bob.Get(ts.URL + "/graphql?" + url.Values{"query": {`{ todo(id: "` + ids[1] + `") { id } }`}}.Encode())
+	assert.NoError(err)
+	decode(resp, &one)
+	assert.Nil(one.Todo)
+}
+
+func TestGraphQLTagsAndHistory(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	ah := MakeHandler(testConfig())
+	defer ah.Close()
+
+	ts := httptest.NewServer(ah)
+	defer ts.Close()
+	client := newTestClient()
+	devSignIn(t, client, ts.URL, url.Values{"sub": {"alice"}, "email": {"alice@example.com"}})
+	post := func(query string, variables map[string]interface{}, v interface{}) graphqlTestResponse {
+		body, _ := json.Marshal(graphqlRequest{Query: query, Variables: variables})
+		resp, err := client.Post(ts.URL+"/graphql", "application/json", bytes.NewReader(body))
+		assert.NoError(err)
+		defer resp.Body.Close()
+		var out graphqlTestResponse
+		assert.NoError(json.NewDecoder(resp.Body).Decode(&out))
+		if v != nil && len(out.Data) > 0 {
+			assert.NoError(json.Unmarshal(out.Data, v))
+		}
+		return out
+	}
+
+	var added struct{ AddTodo struct{ ID string } }
+	out := post(`mutation { addTodo(name: "Buy milk", tags: ["shopping", "home", "shopping"]) { id } }`, nil, &added)
+	assert.Empty(out.Errors)
+	milk := added.AddTodo.ID
+	post(`mutation { addTodo(name: "Take 100% of the leave") { id } }`, nil, &added)
+	out = post(`mutation($id: ID!) { updateTodo(id: $id, name: "Buy oat milk", completed: true, tags: ["errands"]) { id } }`,
+		map[string]interface{}{"id": milk}, nil)
+	assert.Empty(out.Errors)
+
+	// Invalid tags change nothing
+	out = post(`mutation($id: ID!) { updateTodo(id: $id, name: "Buy cream", tags: [" "]) { id } }`,
+		map[string]interface{}{"id": milk}, nil)
+	if assert.Len(out.Errors, 1) {
+		assert.Equal("VALIDATION_FAILED", out.Errors[0].Extensions["code"])
+	}
+
+	counter := &countingDB{DBHandler: ah.db, calls: map[string]int{}}
+	ah.db = counter
+	type change struct {
+		Type      string
+		Name      string
+		Completed bool
+	}
+	var page struct {
+		Todos struct {
+			TotalCount int
+			Edges      []struct {
+				Node struct {
+					ID      string
+					Tags    []string
+					History []change
+				}
+			}
+		}
+	}
+	out = post(`{ todos { totalCount edges { node { id tags history { type name completed } } } } }`, nil, &page)
+	assert.Empty(out.Errors)
+	if assert.Len(page.Todos.Edges, 2) {
+		assert.Equal([]string{"errands"}, page.Todos.Edges[0].Node.Tags)
+		assert.Equal([]change{
+			{"ADDED", "Buy milk", false},
+			{"TAGGED", "Buy milk", false},
+			{"RENAMED", "Buy oat milk", false},
+			{"COMPLETED", "Buy oat milk", true},
+			{"TAGGED", "Buy oat milk", true},
+		}, page.Todos.Edges[0].Node.History)
+		assert.Empty(page.Todos.Edges[1].Node.Tags)
+		assert.Len(page.Todos.Edges[1].Node.History, 1)
+	}
+	// Filtering and paging is left to the database
+	assert.Equal(0, counter.calls["GetTodos"])
+	assert.Equal(1, counter.calls["GetTagsByTodos"])
+	assert.Equal(1, counter.calls["GetHistoryByTodos"])
+	ah.db = counter.DBHandler
+
+	out = post(`{ todos(tag: "errands") { totalCount edges { node { id } } } }`, nil, &page)
+	assert.Empty(out.Errors)
+	if assert.Equal(1, page.Todos.TotalCount) {
+		assert.Equal(milk, page.Todos.Edges[0].Node.ID)
+	}
+	// Search is for text, not patterns
+	out = post(`{ todos(search: "0%") { totalCount } }`, nil, &page)
+	assert.Empty(out.Errors)
+	assert.Equal(1, page.Todos.TotalCount)
+	out = post(`{ todos(search: "k%") { totalCount } }`, nil, &page)
+	assert.Empty(out.Errors)
+	assert.Equal(0, page.Todos.TotalCount)
+}
+
+func TestGraphQLIdentitiesBatched(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	ah := MakeHandler(testConfig())
+	defer ah.Close()
+
+	ctx := context.Background()
+	alice := ah.db.SignInUser(ctx, &model.Identity{Provider: "alpha", Subject: "alice"})
+	ah.db.LinkIdentity(ctx, alice.ID, &model.Identity{Provider: "beta", Subject: "alice"})
+	bob := ah.db.SignInUser(ctx, &model.Identity{Provider: "alpha", Subject: "bob"})
+	counter := &countingDB{DBHandler: ah.db, calls: map[string]int{}}
+	ah.db = counter
+
+	ctx = context.WithValue(ctx, graphqlLoadersKey, ah.newGraphQLLoaders())
+	var wg sync.WaitGroup
+	loaded := make([][]*model.Identity, 3)
+	for i, id := range []int{alice.ID, bob.ID, bob.ID + 1} {
+		wg.Add(1)
+		go func(i, id int) {
+			defer wg.Done()
+			loaded[i], _ = ah.loadIdentities(ctx, id)
+		}(i, id)
+	}
+	wg.Wait()
+	assert.Len(loaded[0], 2)
+	if assert.Len(loaded[1], 1) {
+		assert.Equal("bob", loaded[1][0].Subject)
+	}
+	assert.NotNil(loaded[2])
+	assert.Empty(loaded[2])
+	assert.Equal(1, counter.calls["GetIdentitiesByUsers"])
+	assert.Equal(0, counter.calls["GetIdentities"])
+}
+
+func TestGraphQLSubscription(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	ah := MakeHandler(testConfig())
+	defer ah.Close()
+
+	ts := httptest.NewServer(ah)
+	defer ts.Close()
+
+	client := newTestClient()
+	devSignIn(t, client, ts.URL, url.Values{"sub": {"alice"}, "email": {"alice@example.com"}})
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/graphql"
+	dialer := websocket.Dialer{Jar: client.Jar, Subprotocols: []string{"graphql-ws"}}
+
+	// Other sites can't subscribe with the user's cookie
+	_, resp, err := dialer.Dial(wsURL, http.Header{"Origin": {"https://evil.example"}})
+	assert.Error(err)
+	if assert.NotNil(resp) {
+		assert.Equal(http.StatusForbidden, resp.StatusCode)
+	}
+
+	conn, _, err := dialer.Dial(wsURL, nil)
+	if !assert.NoError(err) {
+		return
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	type message struct {
+		ID      string          `json:"id,omitempty"`
+		Type    string          `json:"type"`
+		Payload json.RawMessage `json:"payload,omitempty"`
+	}
+	assert.NoError(conn.WriteJSON(message{Type: "connection_init", Payload: json.RawMessage(`{}`)}))
+	var msg message
+	assert.NoError(conn.ReadJSON(&msg))
+	assert.Equal("connection_ack", msg.Type)
+
+	start, _ := json.Marshal(graphqlRequest{Query: `subscription { todoChanged { type id todo { name owner { email } } } }`})
+	assert.NoError(conn.WriteJSON(message{ID: "1", Type: "start", Payload: start}))
+
+	// Changes made through the REST API reach the subscriber. The first
+	// add may happen before the subscription starts, so add until one does.
+	var event struct {
+		Data struct {
+			TodoChanged struct {
+				Type string
+				ID   string
+				Todo *struct {
+					Name  string
+					Owner struct{ Email string }
+				}
+			}
+		}
+	}
+	received := make(chan error, 1)
+	go func() {
+		err := conn.ReadJSON(&msg)
+		if err == nil {
+			err = json.Unmarshal(msg.Payload, &event)
+		}
+		received <- err
+	}()
+	add := func() {
+		req, _ := http.NewRequest("POST", ts.URL+"/api/v1/todos", strings.NewReader(`{"name": "Live"}`))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		assert.NoError(err)
+		resp.Body.Close()
+	}
+	add()
+	for waiting := true; waiting; {
+		select {
+		case err := <-received:
+			assert.NoError(err)
+			waiting = false
+		case <-time.After(50 * time.Millisecond):
+			add()
+		}
+	}
+	assert.Equal("data", msg.Type)
+	assert.Equal("1", msg.ID)
+	assert.Equal(todoAdded, event.Data.TodoChanged.Type)
+	if assert.NotNil(event.Data.TodoChanged.Todo) {
+		assert.Equal("Live", event.Data.TodoChanged.Todo.Name)
+		assert.Equal("alice@example.com", event.Data.TodoChanged.Todo.Owner.Email)
+	}
+
+	// Draining ends the subscription; any further adds arrive first
+	ah.BeginShutdown()
+	for msg.Type == "data" {
+		assert.NoError(conn.ReadJSON(&msg))
+	}
+	assert.Equal("complete", msg.Type)
+	assert.Equal("1", msg.ID)
+}
+
+func TestGraphQLSocketReadOnly(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	ah := MakeHandler(testConfig())
+	defer ah.Close()
+
+	ts := httptest.NewServer(ah)
+	defer ts.Close()
+
+	browser := newTestClient()
+	devSignIn(t, browser, ts.URL, url.Values{"sub": {"alice"}, "email": {"alice@example.com"}})
+	readOnly := createToken(t, browser, ts.URL, url.Values{"name": {"dashboard"}, "scope": {"read"}})
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/graphql"
+	dialer := websocket.Dialer{Subprotocols: []string{"graphql-ws"}}
+	conn, _, err := dialer.Dial(wsURL, http.Header{"Authorization": {"Bearer " + readOnly.Token}})
+	if !assert.NoError(err) {
+		return
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	type message struct {
+		ID      string          `json:"id,omitempty"`
+		Type    string          `json:"type"`
+		Payload json.RawMessage `json:"payload,omitempty"`
+	}
+	assert.NoError(conn.WriteJSON(message{Type: "connection_init", Payload: json.RawMessage(`{}`)}))
+	var msg message
+	assert.NoError(conn.ReadJSON(&msg))
+	assert.Equal("connection_ack", msg.Type)
+
+	// Mutations sent over the socket are refused, whatever the token
+	start, _ := json.Marshal(graphqlRequest{Query: `mutation { addTodo(name: "sneaky") { id } }`})
+	assert.NoError(conn.WriteJSON(message{ID: "1", Type: "start", Payload: start}))
+	assert.NoError(conn.ReadJSON(&msg))
+	assert.Equal("data", msg.Type)
+	var result struct {
+		Data   *struct{ AddTodo *struct{ ID string } }
+		Errors []struct{ Message string }
+	}
+	assert.NoError(json.Unmarshal(msg.Payload, &result))
+	if assert.Len(result.Errors, 1) {
+		assert.Equal("mutations must be sent with POST", result.Errors[0].Message)
+	}
+	resp, err := browser.Get(ts.URL + "/todos")
+	assert.NoError(err)
+	var todos []*model.Todo
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&todos))
+	assert.Empty(todos)
+}
+
+func TestGraphQLAccessTokenScopes(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	ah := MakeHandler(testConfig())
+	defer ah.Close()
+	ah.providers.Register(&stubProvider{"alpha"})
+
+	ts := httptest.NewServer(ah)
+	defer ts.Close()
+	browser := newTestClient()
+	signIn(t, browser, ts.URL, "alpha", "alice")
+	readOnly := createToken(t, browser, ts.URL, url.Values{"name": {"dashboard"}, "scope": {"read"}})
+	readWrite := createToken(t, browser, ts.URL, url.Values{"name": {"ci"}, "scope": {"read", "write"}})
+
+	post := func(token, query string) graphqlTestResponse {
+		req, _ := http.NewRequest("POST", ts.URL+"/graphql", strings.NewReader(`{"query": "`+query+`"}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(err)
+		defer resp.Body.Close()
+		assert.Equal(http.StatusOK, resp.StatusCode)
+		var out graphqlTestResponse
+		assert.NoError(json.NewDecoder(resp.Body).Decode(&out))
+		return out
+	}
+
+	// Queries only need read, whichever method they are sent with
+	out := post(readOnly.Token, `{ me { id } }`)
+	assert.Empty(out.Errors)
+	out = post(readOnly.Token, `mutation { addTodo(name: \"nope\") { id } }`)
+	if assert.Len(out.Errors, 1) {
+		assert.Contains(out.Errors[0].Message, "write scope")
+	}
+	out = post(readWrite.Token, `mutation { addTodo(name: \"from ci\") { id } }`)
+	assert.Empty(out.Errors)
+	assert.Len(ah.db.GetTodos(context.Background(), 1), 1)
+}
@@ -0,0 +1,276 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"sort"
+	"time"
+
+	"tuckersWeb/todos/logging"
+	"tuckersWeb/todos/model"
+	"tuckersWeb/todos/todopb"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcReadMethods need the read scope. Every other method needs write.
+var grpcReadMethods = map[string]bool{
+	"/todos.v1.TodoService/List":  true,
+	"/todos.v1.TodoService/Get":   true,
+	"/todos.v1.TodoService/Watch": true,
+}
+
+// NewGRPCServer serves the TodoService to clients sending an access token.
+func (a *AppHandler) NewGRPCServer() *grpc.Server {
+	s := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(a.grpcUnaryInterceptor),
+		grpc.ChainStreamInterceptor(a.grpcStreamInterceptor),
+	)
+	todopb.RegisterTodoServiceServer(s, &todoServer{a: a})
+	return s
+}
+
+// ServeGRPC serves gs on ln in the background. Serve stops it along with
+// the HTTP server, before it closes the database.
+func (a *AppHandler) ServeGRPC(gs *grpc.Server, ln net.Listener) {
+	a.grpcServer = gs
+	go func() {
+		if err := gs.Serve(ln); err != nil {
+			a.logger.WithError(err).Error("gRPC server stopped")
+		}
+	}()
+}
+
+func (a *AppHandler) grpcUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	ctx = a.grpcLogContext(ctx, info.FullMethod)
+	defer a.logRPC(ctx, time.Now(), &err)
+	if ctx, err = a.authenticateRPC(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (a *AppHandler) grpcStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	ctx := a.grpcLogContext(ss.Context(), info.FullMethod)
+	defer a.logRPC(ctx, time.Now(), &err)
+	if ctx, err = a.authenticateRPC(ctx, info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, &serverStream{ss, ctx})
+}
+
+// serverStream replaces the context of a stream.
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+func (a *AppHandler) grpcLogContext(ctx context.Context, method string) context.Context {
+	return logging.NewContext(ctx, a.logger.WithFields(logrus.Fields{
+		"request_id": newRequestID(),
+		"rpc":        method,
+		"remote_ip":  peerIP(ctx),
+	}))
+}
+
+// logRPC logs one line for the call once it returns with *err. Panics are
+// logged and answered with Internal, as LogRequests does for HTTP.
+func (a *AppHandler) logRPC(ctx context.Context, start time.Time, err *error) {
+	logger := logging.FromContext(ctx)
+	if p := recover(); p != nil {
+		logger.WithFields(logrus.Fields{
+			"panic": fmt.Sprint(p),
+			"stack": string(debug.Stack()),
+		}).Error("panic serving rpc")
+		*err = status.Error(codes.Internal, "internal error")
+	}
+
+	code := status.Code(*err)
+	entry := logger.WithFields(logrus.Fields{
+		"code":       code.String(),
+		"latency_ms": float64(time.Since(start)) / float64(time.Millisecond),
+	})
+	if code == codes.Internal || code == codes.Unknown {
+		entry.Error("rpc served")
+	} else {
+		entry.Info("rpc served")
+	}
+}
+
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// authenticateRPC signs the call in as the owner of its access token if the
+// token is valid and has the scope the method needs.
+func (a *AppHandler) authenticateRPC(ctx context.Context, method string) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return nil, status.Error(codes.Unauthenticated, "send an access token as authorization: Bearer <token>")
+	}
+	secret, ok := parseBearer(values[0])
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "the authorization must use the Bearer scheme")
+	}
+	token := a.validAccessToken(ctx, secret)
+	if token == nil {
+		return nil, status.Error(codes.Unauthenticated, "invalid or expired access token")
+	}
+
+	scope := "write"
+	if grpcReadMethods[method] {
+		scope = "read"
+	}
+	if !token.HasScope(scope) {
+		return nil, status.Errorf(codes.PermissionDenied, "access token lacks the %s scope for this call", scope)
+	}
+
+	a.touchAccessToken(ctx, token, peerIP(ctx))
+	logging.AddFields(ctx, logrus.Fields{"user_id": token.UserID, "access_token_id": token.ID})
+	return context.WithValue(ctx, userIDContextKey, token.UserID), nil
+}
+
+func rpcUserID(ctx context.Context) int {
+	userID, _ := ctx.Value(userIDContextKey).(int)
+	return userID
+}
+
+func todoProto(todo *model.Todo) *todopb.Todo {
+	return &todopb.Todo{
+		Id:        int64(todo.ID),
+		Name:      todo.Name,
+		Completed: todo.Completed,
+		CreatedAt: timestamppb.New(todo.CreatedAt),
+	}
+}
+
+func noSuchTodo(id int64) error {
+	return status.Errorf(codes.NotFound, "no todo with id %d", id)
+}
+
+// invalidArgument reports validation errors with a BadRequest detail
+// listing each field, like the problems of the HTTP API.
+func invalidArgument(err error) error {
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	detail := &errdetails.BadRequest{}
+	for _, e := range errs {
+		detail.FieldViolations = append(detail.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field:       e.Field,
+			Description: e.Message,
+		})
+	}
+	st, _ := status.New(codes.InvalidArgument, errs.Error()).WithDetails(detail)
+	return st.Err()
+}
+
+type todoServer struct {
+	todopb.UnimplementedTodoServiceServer
+	a *AppHandler
+}
+
+func (s *todoServer) List(ctx context.Context, req *todopb.ListRequest) (*todopb.ListResponse, error) {
+	todos := s.a.db.GetTodos(ctx, rpcUserID(ctx))
+	sort.Slice(todos, func(i, j int) bool { return todos[i].ID < todos[j].ID })
+	resp := &todopb.ListResponse{}
+	for _, todo := range todos {
+		resp.Todos = append(resp.Todos, todoProto(todo))
+	}
+	return resp, nil
+}
+
+func (s *todoServer) Get(ctx context.Context, req *todopb.GetRequest) (*todopb.Todo, error) {
+	todo := s.a.db.GetTodo(ctx, rpcUserID(ctx), int(req.Id))
+	if todo == nil {
+		return nil, noSuchTodo(req.Id)
+	}
+	return todoProto(todo), nil
+}
+
+func (s *todoServer) Create(ctx context.Context, req *todopb.CreateRequest) (*todopb.Todo, error) {
+	input, err := TodoInput{Name: req.Name}.Validate()
+	if err != nil {
+		return nil, invalidArgument(err)
+	}
+	return todoProto(s.a.db.AddTodo(ctx, rpcUserID(ctx), input.Name)), nil
+}
+
+func (s *todoServer) Update(ctx context.Context, req *todopb.UpdateRequest) (*todopb.Todo, error) {
+	input, err := TodoInput{Name: req.Name}.Validate()
+	if err != nil {
+		return nil, invalidArgument(err)
+	}
+	userID := rpcUserID(ctx)
+	if !s.a.db.RenameTodo(ctx, userID, int(req.Id), input.Name) {
+		return nil, noSuchTodo(req.Id)
+	}
+	return s.Get(ctx, &todopb.GetRequest{Id: req.Id})
+}
+
+func (s *todoServer) Complete(ctx context.Context, req *todopb.CompleteRequest) (*todopb.Todo, error) {
+	if !s.a.db.CompleteTodo(ctx, rpcUserID(ctx), int(req.Id), req.Completed) {
+		return nil, noSuchTodo(req.Id)
+	}
+	return s.Get(ctx, &todopb.GetRequest{Id: req.Id})
+}
+
+func (s *todoServer) Delete(ctx context.Context, req *todopb.DeleteRequest) (*todopb.DeleteResponse, error) {
+	if !s.a.db.RemoveTodo(ctx, rpcUserID(ctx), int(req.Id)) {
+		return nil, noSuchTodo(req.Id)
+	}
+	return &todopb.DeleteResponse{}, nil
+}
+
+var todoEventTypes = map[string]todopb.TodoEvent_Type{
+	todoAdded:   todopb.TodoEvent_ADDED,
+	todoUpdated: todopb.TodoEvent_UPDATED,
+	todoRemoved: todopb.TodoEvent_REMOVED,
+}
+
+// Watch ends with Unavailable when the server starts draining, so that
+// clients reconnect to another instance.
+func (s *todoServer) Watch(req *todopb.WatchRequest, stream todopb.TodoService_WatchServer) error {
+	ctx := stream.Context()
+	events, unsubscribe := s.a.events.subscribe(rpcUserID(ctx))
+	defer unsubscribe()
+	for {
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-s.a.shutdown:
+			return status.Error(codes.Unavailable, "server is shutting down")
+		case event := <-events:
+			msg := &todopb.TodoEvent{Type: todoEventTypes[event.Type], Id: int64(event.ID)}
+			if event.Todo != nil {
+				msg.Todo = todoProto(event.Todo)
+			}
+			if err := stream.Send(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
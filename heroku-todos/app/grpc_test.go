@@ -0,0 +1,125 @@
+package app
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"tuckersWeb/todos/todopb"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestGRPC(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	ah := MakeHandler(testConfig())
+	defer ah.Close()
+
+	ts := httptest.NewServer(ah)
+	defer ts.Close()
+	browser := newTestClient()
+	devSignIn(t, browser, ts.URL, url.Values{"sub": {"alice"}, "email": {"alice@example.com"}})
+	readWrite := createToken(t, browser, ts.URL, url.Values{"name": {"service"}, "scope": {"read", "write"}})
+	readOnly := createToken(t, browser, ts.URL, url.Values{"name": {"dashboard"}, "scope": {"read"}})
+
+	lis := bufconn.Listen(1 << 20)
+	gs := ah.NewGRPCServer()
+	go gs.Serve(lis)
+	defer gs.Stop()
+	conn, err := grpc.Dial("bufnet", grpc.WithInsecure(), grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+		return lis.Dial()
+	}))
+	if !assert.NoError(err) {
+		return
+	}
+	defer conn.Close()
+	client := todopb.NewTodoServiceClient(conn)
+	withToken := func(token string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+	}
+	ctx := withToken(readWrite.Token)
+
+	_, err = client.List(context.Background(), &todopb.ListRequest{})
+	assert.Equal(codes.Unauthenticated, status.Code(err))
+	_, err = client.List(withToken("tdp_not-a-token"), &todopb.ListRequest{})
+	assert.Equal(codes.Unauthenticated, status.Code(err))
+	_, err = client.Create(withToken(readOnly.Token), &todopb.CreateRequest{Name: "Read only"})
+	assert.Equal(codes.PermissionDenied, status.Code(err))
+
+	_, err = client.Create(ctx, &todopb.CreateRequest{Name: " "})
+	st := status.Convert(err)
+	assert.Equal(codes.InvalidArgument, st.Code())
+	if assert.Len(st.Details(), 1) {
+		badRequest := st.Details()[0].(*errdetails.BadRequest)
+		assert.Equal("name", badRequest.FieldViolations[0].Field)
+	}
+
+	todo, err := client.Create(ctx, &todopb.CreateRequest{Name: "Define the service"})
+	assert.NoError(err)
+	assert.Equal("Define the service", todo.Name)
+	assert.False(todo.Completed)
+	_, err = client.Create(ctx, &todopb.CreateRequest{Name: "Test it over bufconn"})
+	assert.NoError(err)
+
+	list, err := client.List(withToken(readOnly.Token), &todopb.ListRequest{})
+	assert.NoError(err)
+	if assert.Len(list.Todos, 2) {
+		assert.Equal(todo.Id, list.Todos[0].Id)
+	}
+
+	todo, err = client.Update(ctx, &todopb.UpdateRequest{Id: todo.Id, Name: "Define TodoService"})
+	assert.NoError(err)
+	assert.Equal("Define TodoService", todo.Name)
+	todo, err = client.Complete(ctx, &todopb.CompleteRequest{Id: todo.Id, Completed: true})
+	assert.NoError(err)
+	assert.True(todo.Completed)
+	got, err := client.Get(ctx, &todopb.GetRequest{Id: todo.Id})
+	assert.NoError(err)
+	assert.Equal("Define TodoService", got.Name)
+	assert.True(got.Completed)
+
+	_, err = client.Delete(ctx, &todopb.DeleteRequest{Id: todo.Id})
+	assert.NoError(err)
+	_, err = client.Get(ctx, &todopb.GetRequest{Id: todo.Id})
+	assert.Equal(codes.NotFound, status.Code(err))
+	_, err = client.Delete(ctx, &todopb.DeleteRequest{Id: todo.Id})
+	assert.Equal(codes.NotFound, status.Code(err))
+	_, err = client.Complete(ctx, &todopb.CompleteRequest{Id: todo.Id, Completed: true})
+	assert.Equal(codes.NotFound, status.Code(err))
+
+	// Changes made over HTTP reach watchers until the server drains
+	watchCtx, cancel := context.WithTimeout(withToken(readOnly.Token), 5*time.Second)
+	defer cancel()
+	stream, err := client.Watch(watchCtx, &todopb.WatchRequest{})
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Eventually(func() bool {
+		ah.events.mu.Lock()
+		defer ah.events.mu.Unlock()
+		return len(ah.events.subs) == 1
+	}, time.Second, 10*time.Millisecond)
+	resp, err := browser.PostForm(ts.URL+"/todos", url.Values{"name": {"Added in the browser"}})
+	assert.NoError(err)
+	resp.Body.Close()
+	event, err := stream.Recv()
+	if assert.NoError(err) {
+		assert.Equal(todopb.TodoEvent_ADDED, event.Type)
+		assert.Equal("Added in the browser", event.Todo.Name)
+	}
+
+	ah.BeginShutdown()
+	_, err = stream.Recv()
+	assert.Equal(codes.Unavailable, status.Code(err))
+}
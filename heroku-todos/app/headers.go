@@ -0,0 +1,63 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// isHTTPS reports whether the client reached the app over https, as
+// SecureHeaders found out.
+func isHTTPS(r *http.Request) bool {
+	if https, ok := r.Context().Value(httpsContextKey).(bool); ok {
+		return https
+	}
+	return r.TLS != nil
+}
+
+// forwardedProto returns the scheme the client used according to
+// X-Forwarded-Proto, which Heroku's router sets since it ends TLS. Without
+// TRUST_PROXY it returns "", since clients can send any.
+func (a *AppHandler) forwardedProto(r *http.Request) string {
+	if !a.cfg.TrustProxy {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(r.Header.Get("X-Forwarded-Proto")))
+}
+
+// SecureHeaders sends requests the router received over plain http to
+// https, and gives every response the headers that keep browsers from
+// sniffing content types, framing pages, leaking URLs in Referer and
+// going back to http.
+func (a *AppHandler) SecureHeaders(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	proto := a.forwardedProto(r)
+	if a.cfg.HTTPSRedirect && proto == "http" {
+		// The Host header could name any site
+		u, _ := url.Parse(a.cfg.DomainName)
+		target := "https://" + u.Host + r.URL.RequestURI()
+		// 308 makes browsers post forms again, which 301 turns into a GET
+		code := http.StatusPermanentRedirect
+		if r.Method == "GET" || r.Method == "HEAD" {
+			code = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, target, code)
+		return
+	}
+
+	https := r.TLS != nil || proto == "https"
+	r = r.WithContext(context.WithValue(r.Context(), httpsContextKey, https))
+	h := w.Header()
+	if a.cfg.HSTSMaxAge > 0 && https {
+		h.Set("Strict-Transport-Security", "max-age="+strconv.Itoa(int(a.cfg.HSTSMaxAge/time.Second)))
+	}
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("X-Frame-Options", "DENY")
+	h.Set("Referrer-Policy", a.cfg.ReferrerPolicy)
+	if a.cfg.PermissionsPolicy != "" {
+		h.Set("Permissions-Policy", a.cfg.PermissionsPolicy)
+	}
+	next(w, r)
+}
@@ -0,0 +1,133 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecureHeaders(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	cfg := testConfig()
+	cfg.DomainName = "https://todos.example.com"
+	cfg.TrustProxy = true
+	ah := MakeHandler(cfg)
+	defer ah.Close()
+
+	get := func(method, target, proto string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		if proto != "" {
+			req.Header.Set("X-Forwarded-Proto", proto)
+		}
+		res := httptest.NewRecorder()
+		ah.ServeHTTP(res, req)
+		return res
+	}
+	cookies := func(res *httptest.ResponseRecorder) map[string]*http.Cookie {
+		byName := map[string]*http.Cookie{}
+		for _, c := range res.Result().Cookies() {
+			byName[c.Name] = c
+		}
+		return byName
+	}
+
+	// Plain http, as in development: no HSTS and no Secure cookies
+	res := get("GET", "/signin.html", "")
+	assert.Equal(http.StatusOK, res.Code)
+	assert.Equal("nosniff", res.Header().Get("X-Content-Type-Options"))
+	assert.Equal("DENY", res.Header().Get("X-Frame-Options"))
+	assert.Equal("strict-origin-when-cross-origin", res.Header().Get("Referrer-Policy"))
+	assert.Contains(res.Header().Get("Permissions-Policy"), "camera=()")
+	assert.Contains(res.Header().Get("Content-Security-Policy"), "frame-ancestors 'none'")
+	assert.Empty(res.Header().Get("Strict-Transport-Security"))
+	session := cookies(res)["session"]
+	if assert.NotNil(session) {
+		assert.True(session.HttpOnly)
+		assert.Equal(http.SameSiteLaxMode, session.SameSite)
+		assert.False(session.Secure)
+	}
+
+	// Behind the router over https
+	res = get("GET", "/signin.html", "https")
+	assert.Equal("max-age=31536000", res.Header().Get("Strict-Transport-Security"))
+	session, csrf := cookies(res)["session"], cookies(res)[csrfCookieName]
+	if assert.NotNil(session) && assert.NotNil(csrf) {
+		assert.True(session.Secure)
+		assert.True(csrf.Secure)
+		assert.False(csrf.HttpOnly)
+		assert.Equal(http.SameSiteStrictMode, csrf.SameSite)
+	}
+
+	// Probes get the headers too
+	res = get("GET", "/healthz", "https")
+	assert.Equal("nosniff", res.Header().Get("X-Content-Type-Options"))
+	assert.NotEmpty(res.Header().Get("Strict-Transport-Security"))
+
+	// Behind the router over http
+	res = get("GET", "/todos?done=true", "http")
+	assert.Equal(http.StatusMovedPermanently, res.Code)
+	assert.Equal("https://todos.example.com/todos?done=true", res.Header().Get("Location"))
+	assert.Empty(res.Header().Get("Set-Cookie"))
+	res = get("POST", "/todos", "HTTP")
+	assert.Equal(http.StatusPermanentRedirect, res.Code)
+	assert.True(strings.HasPrefix(res.Header().Get("Location"), "https://todos.example.com/"))
+
+	// The redirect goes to the app whatever the Host header says
+	req := httptest.NewRequest("GET", "//evil.example/", nil)
+	req.Host = "evil.example"
+	req.Header.Set("X-Forwarded-Proto", "http")
+	res = httptest.NewRecorder()
+	ah.ServeHTTP(res, req)
+	assert.Equal("https://todos.example.com//evil.example/", res.Header().Get("Location"))
+}
+
+func TestSecureHeadersUntrustedProxy(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	ah := MakeHandler(testConfig())
+	defer ah.Close()
+
+	// Without TRUST_PROXY anyone could have sent X-Forwarded-Proto
+	for _, proto := range []string{"http", "https"} {
+		req := httptest.NewRequest("GET", "/signin.html", nil)
+		req.Header.Set("X-Forwarded-Proto", proto)
+		res := httptest.NewRecorder()
+		ah.ServeHTTP(res, req)
+		assert.Equal(http.StatusOK, res.Code)
+		assert.Empty(res.Header().Get("Strict-Transport-Security"))
+		for _, c := range res.Result().Cookies() {
+			assert.False(c.Secure, c.Name)
+		}
+	}
+}
+
+func TestSecureHeadersConfigured(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	cfg := testConfig()
+	cfg.TrustProxy = true
+	cfg.HTTPSRedirect = false
+	cfg.HSTSMaxAge = 0
+	cfg.ReferrerPolicy = "no-referrer"
+	cfg.PermissionsPolicy = ""
+	ah := MakeHandler(cfg)
+	defer ah.Close()
+
+	req := httptest.NewRequest("GET", "/signin.html", nil)
+	req.Header.Set("X-Forwarded-Proto", "http")
+	res := httptest.NewRecorder()
+	ah.ServeHTTP(res, req)
+	assert.Equal(http.StatusOK, res.Code)
+	assert.Equal("no-referrer", res.Header().Get("Referrer-Policy"))
+	assert.Empty(res.Header().Get("Permissions-Policy"))
+
+	req.Header.Set("X-Forwarded-Proto", "https")
+	res = httptest.NewRecorder()
+	ah.ServeHTTP(res, req)
+	assert.Empty(res.Header().Get("Strict-Transport-Security"))
+}
@@ -0,0 +1,111 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"tuckersWeb/todos/logging"
+
+	"github.com/sirupsen/logrus"
+)
+
+// readyTimeout bounds how long /readyz waits for the database.
+var readyTimeout = 2 * time.Second
+
+type componentHealth struct {
+	Status    string  `json:"status"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMs float64 `json:"latency_ms,omitempty"`
+	Applied   *int    `json:"applied,omitempty"`
+	Latest    *int    `json:"latest,omitempty"`
+	// err is what went wrong, which is logged but not shown, since
+	// /readyz is public.
+	err error
+}
+
+type health struct {
+	Status     string                      `json:"status"`
+	Components map[string]*componentHealth `json:"components,omitempty"`
+}
+
+// BeginShutdown makes /readyz fail so that load balancers stop sending
+// requests while the server drains the ones in flight, and ends streams.
+func (a *AppHandler) BeginShutdown() {
+	a.shutdownOnce.Do(func() { close(a.shutdown) })
+}
+
+func (a *AppHandler) isShuttingDown() bool {
+	select {
+	case <-a.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// healthzHandler answers as long as the process can serve requests at all.
+func (a *AppHandler) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	a.rd.JSON(w, http.StatusOK, health{Status: "ok"})
+}
+
+// readyzHandler answers 200 only when the server can serve todos: it isn't
+// shutting down, the database answers and its schema is up to date.
+func (a *AppHandler) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	server := &componentHealth{Status: "ok"}
+	if a.isShuttingDown() {
+		server = &componentHealth{Status: "fail", Error: "shutting down"}
+	}
+	components := map[string]*componentHealth{
+		"server":     server,
+		"database":   a.checkDatabase(ctx),
+		"migrations": a.checkMigrations(ctx),
+	}
+
+	status := http.StatusOK
+	result := health{Status: "ok", Components: components}
+	for name, c := range components {
+		if c.Status != "ok" {
+			status = http.StatusServiceUnavailable
+			result.Status = "fail"
+			if name != "server" {
+				fields := logrus.Fields{"component": name, "error": c.Error}
+				if c.err != nil {
+					fields["error"] = c.err.Error()
+				}
+				logging.FromContext(r.Context()).WithFields(fields).Warn("readiness check failed")
+			}
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	a.rd.JSON(w, status, result)
+}
+
+func (a *AppHandler) checkDatabase(ctx context.Context) *componentHealth {
+	start := time.Now()
+	err := a.db.Ping(ctx)
+	c := &componentHealth{Status: "ok", LatencyMs: float64(time.Since(start)) / float64(time.Millisecond)}
+	if err != nil {
+		c.Status = "fail"
+		c.Error = "unavailable"
+		c.err = err
+	}
+	return c
+}
+
+func (a *AppHandler) checkMigrations(ctx context.Context) *componentHealth {
+	applied, latest, err := a.db.SchemaVersion(ctx)
+	if err != nil {
+		return &componentHealth{Status: "fail", Error: "unavailable", err: err}
+	}
+	c := &componentHealth{Status: "ok", Applied: &applied, Latest: &latest}
+	if applied < latest {
+		c.Status = "fail"
+		c.Error = "database schema is behind"
+	}
+	return c
+}
@@ -0,0 +1,61 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealth(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	ah := MakeHandler(testConfig())
+
+	ts := httptest.NewServer(ah)
+	defer ts.Close()
+
+	// Probes are answered without signing in
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(ts.URL + "/healthz")
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Empty(resp.Cookies())
+
+	ready := func() (int, health) {
+		resp, err := client.Get(ts.URL + "/readyz")
+		assert.NoError(err)
+		defer resp.Body.Close()
+		var h health
+		assert.NoError(json.NewDecoder(resp.Body).Decode(&h))
+		return resp.StatusCode, h
+	}
+	code, h := ready()
+	assert.Equal(http.StatusOK, code)
+	assert.Equal("ok", h.Status)
+	assert.Equal("ok", h.Components["database"].Status)
+	assert.Equal("ok", h.Components["migrations"].Status)
+	assert.Equal(*h.Components["migrations"].Latest, *h.Components["migrations"].Applied)
+
+	ah.BeginShutdown()
+	code, h = ready()
+	assert.Equal(http.StatusServiceUnavailable, code)
+	assert.Equal("fail", h.Status)
+	assert.Equal("fail", h.Components["server"].Status)
+	assert.Equal("ok", h.Components["database"].Status)
+
+	// Liveness doesn't depend on the database
+	ah.Close()
+	code, h = ready()
+	assert.Equal(http.StatusServiceUnavailable, code)
+	assert.Equal("fail", h.Components["database"].Status)
+	assert.Equal("unavailable", h.Components["database"].Error)
+	resp, err = client.Get(ts.URL + "/healthz")
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+}
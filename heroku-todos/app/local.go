@@ -0,0 +1,250 @@
+package app
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	netmail "net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"tuckersWeb/todos/config"
+	"tuckersWeb/todos/logging"
+	"tuckersWeb/todos/mail"
+	"tuckersWeb/todos/model"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	minPasswordLength = 8
+	// bcrypt ignores everything after the first 72 bytes
+	maxPasswordLength = 72
+
+	verifyEmailPurpose   = "verify-email"
+	verifyEmailTTL       = 24 * time.Hour
+	resetPasswordPurpose = "reset-password"
+	resetPasswordTTL     = time.Hour
+)
+
+// dummyPasswordHash is compared against when an email has no account so
+// that unknown emails take as long to reject as wrong passwords.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+func newMailer(cfg *config.Config) mail.Mailer {
+	if cfg.SMTPAddr != "" {
+		return mail.NewSMTPMailer(cfg.SMTPAddr, cfg.SMTPUsername, string(cfg.SMTPPassword), cfg.MailFrom)
+	}
+	return mail.NewLogMailer()
+}
+
+// normalizeEmail accepts a bare address and lower-cases it so each email
+// maps to one local account.
+func normalizeEmail(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	addr, err := netmail.ParseAddress(s)
+	if err != nil || addr.Address != s {
+		return "", false
+	}
+	return strings.ToLower(addr.Address), true
+}
+
+func validPassword(password string) bool {
+	return len(password) >= minPasswordLength && len(password) <= maxPasswordLength
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// redirectSignin sends the browser back to the sign in page with a message
+// or error code for signin.js to show.
+func redirectSignin(w http.ResponseWriter, r *http.Request, key, code string) {
+	http.Redirect(w, r, "/signin.html?"+url.Values{key: {code}}.Encode(), http.StatusSeeOther)
+}
+
+// serverError logs err and tells the browser no more than msg.
+func serverError(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	logging.FromContext(r.Context()).WithError(err).Error(msg)
+	http.Error(w, msg, http.StatusInternalServerError)
+}
+
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)+1))
+	http.Error(w, "too many attempts, try again later", http.StatusTooManyRequests)
+}
+
+// sendEmailToken mails a single-use link carrying a new token for purpose.
+func (a *AppHandler) sendEmailToken(r *http.Request, userID int, email, purpose string) error {
+	if ok, _ := a.mailThrottle.Allow(email); !ok {
+		return nil
+	}
+	a.mailThrottle.Hit(email)
+
+	token := randomToken()
+	msg := &mail.Message{To: email}
+	switch purpose {
+	case verifyEmailPurpose:
+		a.db.CreateEmailToken(r.Context(), userID, purpose, hashToken(token), time.Now().Add(verifyEmailTTL))
+		msg.Subject = "Verify your Todos account"
+		msg.Body = "Open this link to verify your email address and sign in:\n\n" +
+			a.cfg.DomainName + "/auth/local/verify?" + url.Values{"token": {token}}.Encode()
+	case resetPasswordPurpose:
+		a.db.CreateEmailToken(r.Context(), userID, purpose, hashToken(token), time.Now().Add(resetPasswordTTL))
+		msg.Subject = "Reset your Todos password"
+		msg.Body = "Open this link to choose a new password:\n\n" +
+			a.cfg.DomainName + "/signin.html?" + url.Values{"reset_token": {token}}.Encode() +
+			"\n\nIf you didn't ask for a password reset, you can ignore this email."
+	}
+	return a.mailer.Send(r.Context(), msg)
+}
+
+func (a *AppHandler) localSignupHandler(w http.ResponseWriter, r *http.Request) {
+	email, ok := normalizeEmail(r.FormValue("email"))
+	if !ok {
+		redirectSignin(w, r, "error", "invalid-email")
+		return
+	}
+	password := r.FormValue("password")
+	if !validPassword(password) {
+		redirectSignin(w, r, "error", "invalid-password")
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		serverError(w, r, "failed to hash password", err)
+		return
+	}
+
+	userID := 0
+	if user := a.db.CreateLocalAccount(r.Context(), email, hash); user != nil {
+		userID = user.ID
+	} else if account := a.db.GetLocalAccount(r.Context(), email); !account.Verified {
+		// Signing up again resends the verification email. The response is
+		// the same either way so that it doesn't reveal registered emails.
+		// The new password replaces the old one, which could have been set
+		// by someone other than the owner of the address.
+		a.db.SetPasswordHash(r.Context(), account.UserID, hash)
+		userID = account.UserID
+	}
+	if userID != 0 {
+		if err := a.sendEmailToken(r, userID, email, verifyEmailPurpose); err != nil {
+			serverError(w, r, "failed to send verification email", err)
+			return
+		}
+	}
+	redirectSignin(w, r, "message", "verify-sent")
+}
+
+func (a *AppHandler) localVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	userID := a.db.UseEmailToken(r.Context(), verifyEmailPurpose, hashToken(r.FormValue("token")))
+	if userID == 0 || !a.db.SetEmailVerified(r.Context(), userID) {
+		redirectSignin(w, r, "error", "invalid-token")
+		return
+	}
+	user := a.db.GetUser(r.Context(), userID)
+	if err := a.saveUserSession(w, r, user, "local"); err != nil {
+		serverError(w, r, "failed to save session", err)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (a *AppHandler) localLoginHandler(w http.ResponseWriter, r *http.Request) {
+	email, valid := normalizeEmail(r.FormValue("email"))
+	ip := clientIP(r)
+	// Guesses at an account are counted per address they come from, so
+	// that nobody else can lock its owner out.
+	key := ip + " " + email
+	if ok, retryAfter := a.loginIPThrottle.Allow(ip); !ok {
+		tooManyRequests(w, retryAfter)
+		return
+	}
+	if !valid {
+		a.loginIPThrottle.Hit(ip)
+		redirectSignin(w, r, "error", "invalid-login")
+		return
+	}
+	if ok, retryAfter := a.loginThrottle.Allow(key); !ok {
+		tooManyRequests(w, retryAfter)
+		return
+	}
+
+	account := a.db.GetLocalAccount(r.Context(), email)
+	hash := dummyPasswordHash
+	if account != nil {
+		hash = account.PasswordHash
+	}
+	err := bcrypt.CompareHashAndPassword(hash, []byte(r.FormValue("password")))
+	if account == nil || err != nil {
+		a.loginThrottle.Hit(key)
+		a.loginIPThrottle.Hit(ip)
+		redirectSignin(w, r, "error", "invalid-login")
+		return
+	}
+	if !account.Verified {
+		redirectSignin(w, r, "error", "unverified")
+		return
+	}
+	a.loginThrottle.Reset(key)
+
+	user := a.db.SignInUser(r.Context(), &model.Identity{Provider: "local", Subject: email, Email: email})
+	if err := a.saveUserSession(w, r, user, "local"); err != nil {
+		serverError(w, r, "failed to save session", err)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (a *AppHandler) localForgotHandler(w http.ResponseWriter, r *http.Request) {
+	email, ok := normalizeEmail(r.FormValue("email"))
+	if !ok {
+		redirectSignin(w, r, "error", "invalid-email")
+		return
+	}
+	if account := a.db.GetLocalAccount(r.Context(), email); account != nil {
+		if err := a.sendEmailToken(r, account.UserID, email, resetPasswordPurpose); err != nil {
+			serverError(w, r, "failed to send password reset email", err)
+			return
+		}
+	}
+	redirectSignin(w, r, "message", "reset-sent")
+}
+
+func (a *AppHandler) localResetHandler(w http.ResponseWriter, r *http.Request) {
+	password := r.FormValue("password")
+	if !validPassword(password) {
+		http.Redirect(w, r, "/signin.html?"+url.Values{
+			"reset_token": {r.FormValue("token")},
+			"error":       {"invalid-password"},
+		}.Encode(), http.StatusSeeOther)
+		return
+	}
+	userID := a.db.UseEmailToken(r.Context(), resetPasswordPurpose, hashToken(r.FormValue("token")))
+	if userID == 0 {
+		redirectSignin(w, r, "error", "invalid-token")
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		serverError(w, r, "failed to hash password", err)
+		return
+	}
+	a.db.SetPasswordHash(r.Context(), userID, hash)
+	// The reset link proves the address just like the verification link
+	a.db.SetEmailVerified(r.Context(), userID)
+	// Whoever knew the old password is signed out
+	a.db.DeleteUserSessions(r.Context(), userID)
+	redirectSignin(w, r, "message", "password-reset")
+}
@@ -0,0 +1,253 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"tuckersWeb/todos/mail"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var tokenRegexp = regexp.MustCompile(`token=([A-Za-z0-9_-]+)`)
+
+// lastToken returns the token of the last link written to the mail log.
+func lastToken(out *bytes.Buffer) string {
+	matches := tokenRegexp.FindAllStringSubmatch(out.String(), -1)
+	if len(matches) == 0 {
+		return ""
+	}
+	return matches[len(matches)-1][1]
+}
+
+func TestLocalAccount(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	ah := MakeHandler(testConfig())
+	defer ah.Close()
+	out := &bytes.Buffer{}
+	ah.mailer = &mail.LogMailer{Out: out}
+
+	ts := httptest.NewServer(ah)
+	defer ts.Close()
+	client := newTestClient()
+
+	resp, err := client.PostForm(ts.URL+"/auth/local/signup", url.Values{"email": {"Alice@Example.com"}, "password": {"short"}})
+	assert.NoError(err)
+	assert.Equal("/signin.html?error=invalid-password", resp.Header.Get("Location"))
+
+	resp, err = client.PostForm(ts.URL+"/auth/local/signup", url.Values{"email": {"Alice@Example.com"}, "password": {"correct horse"}})
+	assert.NoError(err)
+	assert.Equal(http.StatusSeeOther, resp.StatusCode)
+	assert.Equal("/signin.html?message=verify-sent", resp.Header.Get("Location"))
+	assert.Contains(out.String(), "To: alice@example.com")
+	verifyToken := lastToken(out)
+	assert.NotEmpty(verifyToken)
+
+	// Unverified accounts can't sign in
+	resp, err = client.PostForm(ts.URL+"/auth/local/login", url.Values{"email": {"alice@example.com"}, "password": {"correct horse"}})
+	assert.NoError(err)
+	assert.Equal("/signin.html?error=unverified", resp.Header.Get("Location"))
+
+	resp, err = client.Get(ts.URL + "/auth/local/verify?token=" + verifyToken)
+	assert.NoError(err)
+	assert.Equal("/", resp.Header.Get("Location"))
+	resp, err = client.Get(ts.URL + "/me")
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	var me Me
+	err = json.NewDecoder(resp.Body).Decode(&me)
+	assert.NoError(err)
+	assert.Equal("alice@example.com", me.Email)
+	assert.Equal("local", me.Identities[0].Provider)
+
+	// Verification links are single-use
+	resp, err = newTestClient().Get(ts.URL + "/auth/local/verify?token=" + verifyToken)
+	assert.NoError(err)
+	assert.Equal("/signin.html?error=invalid-token", resp.Header.Get("Location"))
+
+	// Signing up again doesn't reveal or replace the account
+	resp, err = newTestClient().PostForm(ts.URL+"/auth/local/signup", url.Values{"email": {"alice@example.com"}, "password": {"other password"}})
+	assert.NoError(err)
+	assert.Equal("/signin.html?message=verify-sent", resp.Header.Get("Location"))
+
+	client = newTestClient()
+	resp, err = client.PostForm(ts.URL+"/auth/local/login", url.Values{"email": {"alice@example.com"}, "password": {"correct horse"}})
+	assert.NoError(err)
+	assert.Equal("/", resp.Header.Get("Location"))
+	resp, err = client.Get(ts.URL + "/me")
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	resp, err = newTestClient().PostForm(ts.URL+"/auth/local/forgot", url.Values{"email": {"alice@example.com"}})
+	assert.NoError(err)
+	assert.Equal("/signin.html?message=reset-sent", resp.Header.Get("Location"))
+	resetToken := lastToken(out)
+	resp, err = newTestClient().PostForm(ts.URL+"/auth/local/reset", url.Values{"token": {resetToken}, "password": {"battery staple"}})
+	assert.NoError(err)
+	assert.Equal("/signin.html?message=password-reset", resp.Header.Get("Location"))
+
+	resp, err = newTestClient().PostForm(ts.URL+"/auth/local/login", url.Values{"email": {"alice@example.com"}, "password": {"correct horse"}})
+	assert.NoError(err)
+	assert.Equal("/signin.html?error=invalid-login", resp.Header.Get("Location"))
+	resp, err = newTestClient().PostForm(ts.URL+"/auth/local/login", url.Values{"email": {"alice@example.com"}, "password": {"battery staple"}})
+	assert.NoError(err)
+	assert.Equal("/", resp.Header.Get("Location"))
+}
+
+func TestLocalLoginThrottle(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	cfg := testConfig()
+	cfg.TrustProxy = true
+	ah := MakeHandler(cfg)
+	defer ah.Close()
+	ah.mailer = &mail.LogMailer{Out: &bytes.Buffer{}}
+
+	ts := httptest.NewServer(ah)
+	defer ts.Close()
+	login := func(ip, email string) *http.Response {
+		req, _ := http.NewRequest("POST", ts.URL+"/auth/local/login", strings.NewReader(url.Values{"email": {email}, "password": {"guess guess"}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Forwarded-For", ip)
+		resp, err := newTestClient().Do(req)
+		assert.NoError(err)
+		return resp
+	}
+
+	for i := 0; i < 5; i++ {
+		assert.Equal("/signin.html?error=invalid-login", login("203.0.113.1", "bob@example.com").Header.Get("Location"))
+	}
+	resp := login("203.0.113.1", "bob@example.com")
+	assert.Equal(http.StatusTooManyRequests, resp.StatusCode)
+	assert.NotEmpty(resp.Header.Get("Retry-After"))
+
+	// Someone guessing bob's password locks out neither other accounts
+	// nor bob signing in from elsewhere
+	assert.Equal("/signin.html?error=invalid-login", login("203.0.113.1", "carol@example.com").Header.Get("Location"))
+	assert.Equal("/signin.html?error=invalid-login", login("198.51.100.1", "bob@example.com").Header.Get("Location"))
+
+	// Invalid addresses don't share a bucket, but count towards the
+	// limit of the address they come from
+	for i := 0; i < 20; i++ {
+		assert.Equal("/signin.html?error=invalid-login", login("198.51.100.2", "not an email").Header.Get("Location"))
+	}
+	assert.Equal(http.StatusTooManyRequests, login("198.51.100.2", "dave@example.com").StatusCode)
+	assert.Equal("/signin.html?error=invalid-login", login("198.51.100.3", "not an email").Header.Get("Location"))
+}
+
+var scriptRegexp = regexp.MustCompile(`<script[^>]* src="([^"]+)"`)
+
+func TestSigninPageSignedOut(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	ah := MakeHandler(testConfig())
+	defer ah.Close()
+	ah.mailer = &mail.LogMailer{Out: &bytes.Buffer{}}
+
+	ts := httptest.NewServer(ah)
+	defer ts.Close()
+	// A browser that only sends the token if csrf.js put it in the form
+	jar, _ := cookiejar.New(nil)
+	browser := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := browser.Get(ts.URL + "/signin.html")
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	page, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	var scripts []string
+	for _, match := range scriptRegexp.FindAllStringSubmatch(string(page), -1) {
+		if !strings.HasPrefix(match[1], "https://") {
+			scripts = append(scripts, "/"+strings.TrimPrefix(match[1], "/"))
+		}
+	}
+	assert.Contains(scripts, ah.assets.URL("csrf.js"))
+	for _, script := range scripts {
+		resp, err := browser.Get(ts.URL + script)
+		assert.NoError(err)
+		assert.Equal(http.StatusOK, resp.StatusCode, script)
+		assert.Contains(resp.Header.Get("Content-Type"), "javascript", script)
+	}
+
+	u, _ := url.Parse(ts.URL)
+	var token string
+	for _, c := range jar.Cookies(u) {
+		if c.Name == csrfCookieName {
+			token = c.Value
+		}
+	}
+	assert.NotEmpty(token)
+	resp, err = browser.PostForm(ts.URL+"/auth/local/signup", url.Values{"email": {"bob@example.com"}, "password": {"correct horse"}, csrfFormField: {token}})
+	assert.NoError(err)
+	assert.Equal(http.StatusSeeOther, resp.StatusCode)
+	assert.Equal("/signin.html?message=verify-sent", resp.Header.Get("Location"))
+}
+
+func TestMailedLinksIgnoreHost(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	cfg := testConfig()
+	cfg.DomainName = "https://todos.example.com"
+	ah := MakeHandler(cfg)
+	defer ah.Close()
+	out := &bytes.Buffer{}
+	ah.mailer = &mail.LogMailer{Out: out}
+
+	ts := httptest.NewServer(ah)
+	defer ts.Close()
+	req, _ := http.NewRequest("POST", ts.URL+"/auth/local/signup", strings.NewReader(url.Values{"email": {"alice@example.com"}, "password": {"correct horse"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Host = "evil.example"
+	resp, err := newTestClient().Do(req)
+	assert.NoError(err)
+	assert.Equal(http.StatusSeeOther, resp.StatusCode)
+	assert.Contains(out.String(), "https://todos.example.com/auth/local/verify?token=")
+	assert.NotContains(out.String(), "evil.example")
+}
+
+func TestLocalSignupTwice(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	ah := MakeHandler(testConfig())
+	defer ah.Close()
+	out := &bytes.Buffer{}
+	ah.mailer = &mail.LogMailer{Out: out}
+
+	ts := httptest.NewServer(ah)
+	defer ts.Close()
+
+	// Someone signs up with the address before its owner does
+	signup := func(password string) {
+		resp, err := newTestClient().PostForm(ts.URL+"/auth/local/signup", url.Values{"email": {"alice@example.com"}, "password": {password}})
+		assert.NoError(err)
+		assert.Equal("/signin.html?message=verify-sent", resp.Header.Get("Location"))
+	}
+	signup("squatter password")
+	signup("owner password")
+	resp, err := newTestClient().Get(ts.URL + "/auth/local/verify?token=" + lastToken(out))
+	assert.NoError(err)
+	assert.Equal("/", resp.Header.Get("Location"))
+
+	login := func(password string) string {
+		resp, err := newTestClient().PostForm(ts.URL+"/auth/local/login", url.Values{"email": {"alice@example.com"}, "password": {password}})
+		assert.NoError(err)
+		return resp.Header.Get("Location")
+	}
+	assert.Equal("/signin.html?error=invalid-login", login("squatter password"))
+	assert.Equal("/", login("owner password"))
+}
@@ -0,0 +1,67 @@
+package app
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	ah := MakeHandler(testConfig())
+	defer ah.Close()
+
+	ts := httptest.NewServer(ah)
+	defer ts.Close()
+
+	scrape := func(token string) *http.Response {
+		req, _ := http.NewRequest("GET", ts.URL+"/metrics", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(err)
+		return resp
+	}
+
+	// Without METRICS_TOKEN there is nothing to scrape
+	resp := scrape("")
+	assert.Equal(http.StatusNotFound, resp.StatusCode)
+
+	ah.cfg.MetricsToken = "scrape-secret"
+	resp = scrape("")
+	assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+	assert.NotEmpty(resp.Header.Get("WWW-Authenticate"))
+	resp = scrape("wrong-secret")
+	assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+
+	client := newTestClient()
+	devSignIn(t, client, ts.URL, url.Values{"sub": {"alice"}})
+	resp, err := client.Get(ts.URL + "/todos")
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	resp, err = client.Get(ts.URL + "/todos")
+	assert.NoError(err)
+
+	resp = scrape("scrape-secret")
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	body := string(data)
+	assert.Contains(body, `todos_http_requests_total{method="GET",route="/todos",status="200"} 2`)
+	assert.Contains(body, `todos_http_request_duration_seconds_count{method="GET",route="/todos",status="200"} 2`)
+	assert.Contains(body, `todos_db_query_duration_seconds_count{backend="sqlite",method="GetTodos"} 2`)
+	assert.Contains(body, `todos_oauth_logins_total{provider="dev",result="success"} 1`)
+	assert.Contains(body, "todos_active_sessions 1")
+	assert.Contains(body, "todos_db_open_connections")
+	assert.Contains(body, "go_goroutines")
+
+	// Scrapes don't show up as requests
+	assert.NotContains(body, `route="/metrics"`)
+}
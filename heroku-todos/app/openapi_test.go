@@ -0,0 +1,87 @@
+package app
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"tuckersWeb/todos/web"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// undocumentedRoutes are left out of the spec on purpose.
+var undocumentedRoutes = map[string]bool{
+	// The development identity provider isn't part of the app
+	devIdPPath + "/": true,
+}
+
+type openAPISpec struct {
+	OpenAPI    string                                `json:"openapi"`
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components map[string]map[string]json.RawMessage `json:"components"`
+}
+
+func loadSpec(t *testing.T) (*openAPISpec, []byte) {
+	data, err := fs.ReadFile(web.FS, "public/openapi.json")
+	assert.NoError(t, err)
+	var spec openAPISpec
+	assert.NoError(t, json.Unmarshal(data, &spec))
+	return &spec, data
+}
+
+// varPattern drops the regexp of mux path variables, {id:[0-9]+} being {id}
+// in OpenAPI.
+var varPattern = regexp.MustCompile(`\{([^:}]+):[^}]+\}`)
+
+func TestOpenAPICoversRoutes(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	ah := MakeHandler(testConfig())
+	defer ah.Close()
+	spec, _ := loadSpec(t)
+	assert.Equal("3.0.3", spec.OpenAPI)
+
+	routes := 0
+	err := ah.router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		if route.GetHandler() == nil {
+			// The prefix of a subrouter, whose routes are walked next
+			return nil
+		}
+		tmpl, err := route.GetPathTemplate()
+		if err != nil || undocumentedRoutes[tmpl] {
+			return nil
+		}
+		routes++
+		path := varPattern.ReplaceAllString(tmpl, "{$1}")
+		ops, ok := spec.Paths[path]
+		if !assert.True(ok, "%s is registered but missing from openapi.json", path) {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			// Routes for any method are documented as what browsers send
+			methods = []string{"GET"}
+		}
+		for _, method := range methods {
+			assert.Contains(ops, strings.ToLower(method), "%s %s is registered but missing from openapi.json", method, path)
+		}
+		return nil
+	})
+	assert.NoError(err)
+	assert.True(routes > 20)
+}
+
+func TestOpenAPIRefsResolve(t *testing.T) {
+	assert := assert.New(t)
+	spec, data := loadSpec(t)
+	refs := regexp.MustCompile(`"\$ref": "#/components/([a-zA-Z]+)/([a-zA-Z]+)"`).FindAllStringSubmatch(string(data), -1)
+	assert.NotEmpty(refs)
+	for _, ref := range refs {
+		assert.Contains(spec.Components[ref[1]], ref[2], "%s/%s is referenced but not defined", ref[1], ref[2])
+	}
+}
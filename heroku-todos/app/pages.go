@@ -0,0 +1,91 @@
+package app
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"tuckersWeb/todos/model"
+
+	"github.com/unrolled/render"
+)
+
+// todosPage is what web/templates/todos.html shows.
+type todosPage struct {
+	User *model.User
+	// LinkProviders are the providers not yet linked to the user's account
+	LinkProviders []string
+	Todos         []*model.Todo
+	CSRFToken     string
+	// Nonce lets the scripts of the page run
+	Nonce string
+	// Error and Name are set when adding the todo Name failed
+	Error string
+	Name  string
+}
+
+// wantsHTML reports whether the request was posted by a plain HTML form,
+// rather than a script, and should be answered with a page.
+func wantsHTML(r *http.Request) bool {
+	return r.Method == "POST" && strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// seeOther sends a form back to the todo list once it is handled, so that
+// reloading the page doesn't post the form again.
+func seeOther(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// renderTodos renders the todo list of the signed in user with page's
+// error, if any.
+func (a *AppHandler) renderTodos(w http.ResponseWriter, r *http.Request, status int, page todosPage) {
+	userID := a.getUserID(r)
+	page.User = a.db.GetUser(r.Context(), userID)
+	if page.User == nil {
+		http.Redirect(w, r, "/signin.html", http.StatusTemporaryRedirect)
+		return
+	}
+	linked := map[string]bool{}
+	for _, identity := range a.db.GetIdentities(r.Context(), userID) {
+		linked[identity.Provider] = true
+	}
+	for _, name := range a.providers.Names() {
+		if !linked[name] {
+			page.LinkProviders = append(page.LinkProviders, name)
+		}
+	}
+	page.Todos = a.db.GetTodos(r.Context(), userID)
+	sort.Slice(page.Todos, func(i, j int) bool { return page.Todos[i].ID < page.Todos[j].ID })
+	session, _ := a.store.Get(r, "session")
+	page.CSRFToken, _ = session.Values["csrf_token"].(string)
+	page.Nonce = cspNonce(r)
+
+	w.Header().Set("Cache-Control", "no-store")
+	a.rd.HTML(w, status, "todos", page)
+}
+
+// scriptedPage is what the pages that load their content with scripts
+// show.
+type scriptedPage struct {
+	// Nonce lets the scripts of the page run
+	Nonce string
+}
+
+// pageHandler renders web/templates/name.html in layout, or in the default
+// one when it is "".
+func (a *AppHandler) pageHandler(name string, layout string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		a.rd.HTML(w, http.StatusOK, name, scriptedPage{Nonce: cspNonce(r)}, render.HTMLOptions{Layout: layout})
+	}
+}
+
+func (a *AppHandler) indexHandler(w http.ResponseWriter, r *http.Request) {
+	a.renderTodos(w, r, http.StatusOK, todosPage{})
+}
+
+// todoPageHandler keeps links to the page that used to build the list in
+// the browser working.
+func (a *AppHandler) todoPageHandler(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, "/", http.StatusMovedPermanently)
+}
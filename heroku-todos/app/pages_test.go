@@ -0,0 +1,163 @@
+package app
+
+import (
+	"flag"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"tuckersWeb/todos/model"
+	"tuckersWeb/todos/web"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/unrolled/render"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// assertGolden compares got with testdata/name, which -update rewrites.
+func assertGolden(t *testing.T, name string, got []byte) {
+	path := filepath.Join("testdata", name)
+	if *update {
+		os.MkdirAll("testdata", 0755)
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v, run go test -update to create it", err)
+	}
+	assert.Equal(t, string(want), string(got), "%s differs, run go test -update if the change is intended", path)
+}
+
+// goldenRender renders the real templates, linking to stand-ins for the
+// files in public/ so that the golden files don't change with every edit
+// of a script.
+func goldenRender(t *testing.T) *render.Render {
+	fsys := fstest.MapFS{}
+	err := fs.WalkDir(web.FS, "templates", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(web.FS, p)
+		fsys[p] = &fstest.MapFile{Data: data}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"todo.css", "csrf.js", "todo.js"} {
+		fsys["public/"+name] = &fstest.MapFile{Data: []byte(name)}
+	}
+	return newRender(newAssets(fsys, false))
+}
+
+func TestTodosPageGolden(t *testing.T) {
+	rd := goldenRender(t)
+	created := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	page := todosPage{
+		User:          &model.User{ID: 1, Email: "alice@example.com", Picture: "https://example.com/alice.png"},
+		LinkProviders: []string{"github", "google"},
+		Todos: []*model.Todo{
+			{ID: 1, Name: "Render the list on the server", Completed: true, CreatedAt: created},
+			{ID: 2, Name: "Escape <b>names</b> & \"quotes\"", CreatedAt: created},
+		},
+		CSRFToken: "test-csrf-token",
+		Nonce:     "test-nonce",
+	}
+	tests := map[string]todosPage{
+		"todos.golden.html": page,
+		"todos_invalid.golden.html": {
+			User:      &model.User{ID: 2, Email: "bob@example.com"},
+			CSRFToken: "test-csrf-token",
+			Nonce:     "test-nonce",
+			Error:     "name: is required",
+			Name:      " ",
+		},
+	}
+	for name, page := range tests {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			rd.HTML(w, http.StatusOK, "todos", page)
+			assert.Equal(t, "text/html; charset=UTF-8", w.Header().Get("Content-Type"))
+			assertGolden(t, name, w.Body.Bytes())
+		})
+	}
+}
+
+func TestTodoForms(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	ah := MakeHandler(testConfig())
+	defer ah.Close()
+
+	ts := httptest.NewServer(ah)
+	defer ts.Close()
+	browser := newTestClient()
+	devSignIn(t, browser, ts.URL, url.Values{"sub": {"alice"}, "email": {"alice@example.com"}})
+
+	page := func() (int, string) {
+		resp, err := browser.Get(ts.URL + "/")
+		assert.NoError(err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode, string(body)
+	}
+	// post sends a form the way browsers do, without scripts
+	post := func(path string, form url.Values) *http.Response {
+		req, _ := http.NewRequest("POST", ts.URL+path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+		resp, err := browser.Do(req)
+		assert.NoError(err)
+		return resp
+	}
+
+	status, body := page()
+	assert.Equal(http.StatusOK, status)
+	assert.Contains(body, "alice@example.com")
+	assert.Contains(body, `<form class="add-items d-flex" method="post" action="/todos">`)
+
+	resp := post("/todos", url.Values{"name": {"Work without scripts"}})
+	assert.Equal(http.StatusSeeOther, resp.StatusCode)
+	assert.Equal("/", resp.Header.Get("Location"))
+	_, body = page()
+	assert.Contains(body, "Work without scripts")
+
+	// Invalid names come back in the form with the error
+	resp = post("/todos", url.Values{"name": {strings.Repeat("x", 201)}})
+	assert.Equal(http.StatusUnprocessableEntity, resp.StatusCode)
+	invalid, _ := ioutil.ReadAll(resp.Body)
+	assert.Contains(string(invalid), "is-invalid")
+	assert.Contains(string(invalid), `value="`+strings.Repeat("x", 201)+`"`)
+
+	resp = post("/todos/1/completion", url.Values{"complete": {"true"}})
+	assert.Equal(http.StatusSeeOther, resp.StatusCode)
+	_, body = page()
+	assert.Contains(body, `<li id="1" class="completed">`)
+	assert.Contains(body, `name="complete" value="false"`)
+
+	resp = post("/todos/1/delete", nil)
+	assert.Equal(http.StatusSeeOther, resp.StatusCode)
+	_, body = page()
+	assert.NotContains(body, "Work without scripts")
+
+	// Scripts still get JSON
+	resp, err := browser.PostForm(ts.URL+"/todos", url.Values{"name": {"Sent by todo.js"}})
+	assert.NoError(err)
+	assert.Equal(http.StatusCreated, resp.StatusCode)
+
+	resp, err = browser.Get(ts.URL + "/todo.html")
+	assert.NoError(err)
+	assert.Equal(http.StatusMovedPermanently, resp.StatusCode)
+	assert.Equal("/", resp.Header.Get("Location"))
+}
@@ -0,0 +1,55 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+const problemContentType = "application/problem+json"
+
+// Problem is an RFC 7807 problem details object, the body of every error
+// the API answers with.
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	// Errors lists what is wrong with each field of invalid input.
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	writeProblemDetails(w, r, Problem{Status: status, Detail: detail})
+}
+
+// writeProblemDetails fills in the fields of p that follow from its status
+// and the request, and writes it.
+func writeProblemDetails(w http.ResponseWriter, r *http.Request, p Problem) {
+	if p.Type == "" {
+		p.Type = "about:blank"
+	}
+	if p.Title == "" {
+		p.Title = http.StatusText(p.Status)
+	}
+	p.Instance = r.URL.Path
+	w.Header().Set("Content-Type", problemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+func isAPIRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, apiPrefix+"/") || r.URL.Path == graphqlPath
+}
+
+// httpError answers API requests with a problem and everything else, which
+// browsers and old scripts call, with plain text.
+func httpError(w http.ResponseWriter, r *http.Request, detail string, status int) {
+	if isAPIRequest(r) {
+		writeProblem(w, r, status, detail)
+		return
+	}
+	http.Error(w, detail, status)
+}
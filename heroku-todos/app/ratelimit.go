@@ -0,0 +1,148 @@
+package app
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tuckersWeb/todos/model"
+)
+
+// bucketSweepInterval is how often buckets that refilled long ago are
+// dropped from the store.
+const bucketSweepInterval = 10 * time.Minute
+
+// RateLimit allows Requests requests in a burst and refills them over Per.
+type RateLimit struct {
+	Requests int
+	Per      time.Duration
+}
+
+func (l RateLimit) interval() time.Duration {
+	return l.Per / time.Duration(l.Requests)
+}
+
+type routeLimit struct {
+	name    string
+	method  string
+	pattern string
+	limit   RateLimit
+}
+
+// RateLimiter is negroni middleware that gives every signed in user, or
+// every client IP when no one is signed in, a token bucket per route.
+// Requests that find their bucket empty get 429 Too Many Requests.
+type RateLimiter struct {
+	store    model.RateLimitStore
+	fallback RateLimit
+	routes   []routeLimit
+	// userID finds the signed in user of a request, if any. Without it
+	// every request is limited by its IP.
+	userID func(r *http.Request) int
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+// NewRateLimiter limits requests that match no route limit by fallback.
+func NewRateLimiter(store model.RateLimitStore, fallback RateLimit) *RateLimiter {
+	return &RateLimiter{store: store, fallback: fallback, lastSweep: time.Now()}
+}
+
+// Limit gives requests with method, or any method when it is empty, and a
+// path matching pattern their own bucket named name. As with
+// http.ServeMux, a pattern ending in a slash matches every path under it
+// and any other only itself. The first matching route applies.
+func (l *RateLimiter) Limit(name, method, pattern string, limit RateLimit) {
+	l.routes = append(l.routes, routeLimit{name: name, method: method, pattern: pattern, limit: limit})
+}
+
+func (r routeLimit) matches(path string) bool {
+	if strings.HasSuffix(r.pattern, "/") {
+		return strings.HasPrefix(path, r.pattern)
+	}
+	return path == r.pattern
+}
+
+func (l *RateLimiter) route(r *http.Request) (string, RateLimit) {
+	for _, route := range l.routes {
+		if (route.method == "" || route.method == r.Method) && route.matches(r.URL.Path) {
+			return route.name, route.limit
+		}
+	}
+	return "default", l.fallback
+}
+
+func (l *RateLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	name, limit := l.route(r)
+	key := name + ":ip:" + clientIP(r)
+	if l.userID != nil {
+		if userID := l.userID(r); userID != 0 {
+			key = name + ":user:" + strconv.Itoa(userID)
+		}
+	}
+
+	now := time.Now()
+	l.sweep(r.Context(), now)
+	interval := limit.interval()
+	bucket, ok := l.store.TakeToken(r.Context(), key, limit.Requests, interval, now)
+
+	// The bucket is full again once the missing tokens have trickled in
+	reset := time.Duration((float64(limit.Requests) - bucket.Tokens) * float64(interval))
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.Requests))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(int(bucket.Tokens)))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(reset)))
+	if !ok {
+		retryAfter := time.Duration((1 - bucket.Tokens) * float64(interval))
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(retryAfter)))
+		httpError(w, r, "too many requests, try again later", http.StatusTooManyRequests)
+		return
+	}
+	next(w, r)
+}
+
+// sweep drops buckets idle for longer than the slowest limit takes to
+// refill, which would be full again and so are the same as new ones.
+func (l *RateLimiter) sweep(ctx context.Context, now time.Time) {
+	l.mu.Lock()
+	if now.Sub(l.lastSweep) < bucketSweepInterval {
+		l.mu.Unlock()
+		return
+	}
+	l.lastSweep = now
+	l.mu.Unlock()
+
+	longest := l.fallback.Per
+	for _, route := range l.routes {
+		if route.limit.Per > longest {
+			longest = route.limit.Per
+		}
+	}
+	l.store.DeleteIdleBuckets(ctx, now.Add(-longest))
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// newRateLimiter sets up the app's limits, keyed by the user userID finds.
+// The "database" store shares them between instances through db instead
+// of keeping them in process.
+func newRateLimiter(db model.DBHandler, storeName string, userID func(r *http.Request) int) *RateLimiter {
+	var store model.RateLimitStore = model.NewMemoryRateLimits()
+	if storeName == "database" {
+		store = db
+	}
+	l := NewRateLimiter(store, RateLimit{Requests: 300, Per: time.Minute})
+	l.userID = userID
+	l.Limit("add-todo", "POST", "/todos", RateLimit{Requests: 30, Per: time.Minute})
+	l.Limit("add-todo", "POST", apiPrefix+"/todos", RateLimit{Requests: 30, Per: time.Minute})
+	l.Limit("auth", "", "/auth/", RateLimit{Requests: 30, Per: time.Minute})
+	l.Limit("auth", "", "/cli/", RateLimit{Requests: 30, Per: time.Minute})
+	l.Limit("dev-idp", "", devIdPPath+"/", RateLimit{Requests: 30, Per: time.Minute})
+	return l
+}
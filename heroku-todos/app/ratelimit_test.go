@@ -0,0 +1,92 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimit(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	ah := MakeHandler(testConfig())
+	defer ah.Close()
+
+	ts := httptest.NewServer(ah)
+	defer ts.Close()
+
+	alice := newTestClient()
+	devSignIn(t, alice, ts.URL, url.Values{"sub": {"alice"}})
+	for i := 0; i < 30; i++ {
+		resp, err := alice.PostForm(ts.URL+"/todos", url.Values{"name": {"todo " + strconv.Itoa(i)}})
+		assert.NoError(err)
+		assert.Equal(http.StatusCreated, resp.StatusCode)
+		assert.Equal("30", resp.Header.Get("RateLimit-Limit"))
+		assert.Equal(strconv.Itoa(29-i), resp.Header.Get("RateLimit-Remaining"))
+	}
+	resp, err := alice.PostForm(ts.URL+"/todos", url.Values{"name": {"one too many"}})
+	assert.NoError(err)
+	assert.Equal(http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal("2", resp.Header.Get("Retry-After"))
+	assert.Equal("60", resp.Header.Get("RateLimit-Reset"))
+
+	// Other routes and other users have their own buckets
+	resp, err = alice.Get(ts.URL + "/todos")
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	resp, err = alice.PostForm(ts.URL+"/todos/1/completion", url.Values{"complete": {"true"}})
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("300", resp.Header.Get("RateLimit-Limit"))
+	bob := newTestClient()
+	devSignIn(t, bob, ts.URL, url.Values{"sub": {"bob"}})
+	resp, err = bob.PostForm(ts.URL+"/todos", url.Values{"name": {"bob's todo"}})
+	assert.NoError(err)
+	assert.Equal(http.StatusCreated, resp.StatusCode)
+
+	// Signed out clients share a bucket per IP
+	for i := 0; ; i++ {
+		resp, err = http.Get(ts.URL + "/auth/providers")
+		assert.NoError(err)
+		if resp.StatusCode != http.StatusOK {
+			break
+		}
+	}
+	assert.Equal(http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal("0", resp.Header.Get("RateLimit-Remaining"))
+}
+
+func TestRateLimitDatabaseStore(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	ah := MakeHandler(testConfig())
+	defer ah.Close()
+
+	// Two instances sharing a database share the bucket
+	limit := RateLimit{Requests: 2, Per: time.Minute}
+	first := NewRateLimiter(ah.db, limit)
+	second := NewRateLimiter(ah.db, limit)
+	serve := func(l *RateLimiter) int {
+		req := httptest.NewRequest("GET", "/todos", nil)
+		rec := httptest.NewRecorder()
+		l.ServeHTTP(rec, req, func(w http.ResponseWriter, r *http.Request) {})
+		return rec.Code
+	}
+	assert.Equal(http.StatusOK, serve(first))
+	assert.Equal(http.StatusOK, serve(second))
+	assert.Equal(http.StatusTooManyRequests, serve(first))
+	assert.Equal(http.StatusTooManyRequests, serve(second))
+
+	// Buckets refill over time and idle ones are swept
+	bucket, ok := ah.db.TakeToken(context.Background(), "default:ip:192.0.2.1", 2, 30*time.Second, time.Now().Add(30*time.Second))
+	assert.True(ok)
+	assert.InDelta(0, bucket.Tokens, 0.01)
+	assert.Equal(1, ah.db.DeleteIdleBuckets(context.Background(), time.Now().Add(time.Minute)))
+}
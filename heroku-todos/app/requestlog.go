@@ -0,0 +1,100 @@
+package app
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"time"
+
+	"tuckersWeb/todos/config"
+	"tuckersWeb/todos/logging"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/negroni"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// requestIDPattern is what an X-Request-ID from a proxy must look like to
+// be used instead of a new ID.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+func newLogger(cfg *config.Config) *logrus.Logger {
+	logger, err := logging.New(os.Stdout, cfg.LogLevel, cfg.LogFormat)
+	if err != nil {
+		logger, _ = logging.New(os.Stdout, "", "")
+		logger.WithError(err).Warn("invalid logging configuration, using defaults")
+	}
+	return logger
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// LogRequests gives every request an ID and a logger carrying it, and logs
+// one line for the request and records its metrics once it is served.
+// Panics are logged and answered with 500.
+func (a *AppHandler) LogRequests(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	start := time.Now()
+	id := r.Header.Get(requestIDHeader)
+	if !requestIDPattern.MatchString(id) {
+		id = newRequestID()
+	}
+	w.Header().Set(requestIDHeader, id)
+
+	ctx := logging.NewContext(r.Context(), a.logger.WithFields(logrus.Fields{
+		"request_id": id,
+		"method":     r.Method,
+		"path":       r.URL.Path,
+		"remote_ip":  clientIP(r),
+	}))
+	res := w.(negroni.ResponseWriter)
+	defer func() {
+		if err := recover(); err != nil {
+			logging.FromContext(ctx).WithFields(logrus.Fields{
+				"panic": fmt.Sprint(err),
+				"stack": string(debug.Stack()),
+			}).Error("panic serving request")
+			if !res.Written() {
+				http.Error(res, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+		}
+
+		latency := time.Since(start)
+		route, _ := logging.FromContext(ctx).Data["route"].(string)
+		a.metrics.observeRequest(r.Method, route, res.Status(), latency)
+
+		entry := logging.FromContext(ctx).WithFields(logrus.Fields{
+			"status":     res.Status(),
+			"bytes":      res.Size(),
+			"latency_ms": float64(latency) / float64(time.Millisecond),
+		})
+		if res.Status() >= http.StatusInternalServerError {
+			entry.Error("request served")
+		} else {
+			entry.Info("request served")
+		}
+	}()
+	next(w, r.WithContext(ctx))
+}
+
+// logRoute adds the route template that mux matched to the request's
+// logger, so that requests for different todos log the same route.
+func logRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			if tmpl, err := route.GetPathTemplate(); err == nil {
+				logging.AddFields(r.Context(), logrus.Fields{"route": tmpl})
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
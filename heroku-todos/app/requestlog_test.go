@@ -0,0 +1,87 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// logLines decodes the JSON lines logged to buf.
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	lines := []map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var fields map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &fields), line)
+		lines = append(lines, fields)
+	}
+	buf.Reset()
+	return lines
+}
+
+func TestRequestLog(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	ah := MakeHandler(testConfig())
+	defer ah.Close()
+	var buf bytes.Buffer
+	ah.logger.Out = &buf
+
+	ts := httptest.NewServer(ah)
+	defer ts.Close()
+
+	client := newTestClient()
+	devSignIn(t, client, ts.URL, url.Values{"sub": {"alice"}})
+	user := ah.db.GetUser(context.Background(), 1)
+	buf.Reset()
+
+	req, _ := http.NewRequest("DELETE", ts.URL+"/todos/42", nil)
+	req.Header.Set(requestIDHeader, "edge-1234")
+	resp, err := client.Do(req)
+	assert.NoError(err)
+	assert.Equal("edge-1234", resp.Header.Get(requestIDHeader))
+	lines := logLines(t, &buf)
+	last := lines[len(lines)-1]
+	assert.Equal("request served", last["msg"])
+	assert.Equal("edge-1234", last["request_id"])
+	assert.Equal("DELETE", last["method"])
+	assert.Equal("/todos/{id:[0-9]+}", last["route"])
+	assert.Equal(float64(http.StatusOK), last["status"])
+	assert.Equal(float64(user.ID), last["user_id"])
+	assert.Contains(last, "latency_ms")
+	assert.Contains(last, "bytes")
+
+	// IDs that could break log lines are replaced
+	req, _ = http.NewRequest("GET", ts.URL+"/todos", nil)
+	req.Header.Set(requestIDHeader, `bad id "quoted" <script>`)
+	resp, err = client.Do(req)
+	assert.NoError(err)
+	id := resp.Header.Get(requestIDHeader)
+	assert.Len(id, 32)
+	lines = logLines(t, &buf)
+	assert.Equal(id, lines[len(lines)-1]["request_id"])
+
+	// Panics are logged with the request's fields and answered with 500
+	ah.db.Close()
+	resp, err = client.Get(ts.URL + "/todos")
+	assert.NoError(err)
+	assert.Equal(http.StatusInternalServerError, resp.StatusCode)
+	lines = logLines(t, &buf)
+	var panicked bool
+	for _, line := range lines {
+		if line["msg"] == "panic serving request" {
+			panicked = true
+			assert.Equal(resp.Header.Get(requestIDHeader), line["request_id"])
+			assert.Equal("error", line["level"])
+		}
+	}
+	assert.True(panicked)
+	assert.Equal(float64(http.StatusInternalServerError), lines[len(lines)-1]["status"])
+}
@@ -0,0 +1,74 @@
+package app
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"tuckersWeb/todos/config"
+	"tuckersWeb/todos/logging"
+)
+
+// NewServer returns a server for handler on cfg.Port with cfg's timeouts,
+// so that slow or idle clients can't hold connections forever.
+func NewServer(cfg *config.Config, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              ":" + cfg.Port,
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       cfg.HTTPReadTimeout,
+		WriteTimeout:      cfg.HTTPWriteTimeout,
+		IdleTimeout:       cfg.HTTPIdleTimeout,
+	}
+}
+
+// Serve serves srv on ln until ctx is done. It then stops accepting
+// connections, ends streams, waits up to drainTimeout for requests in
+// flight, on srv and on the gRPC server if there is one, and closes the
+// database.
+func (a *AppHandler) Serve(ctx context.Context, srv *http.Server, ln net.Listener, drainTimeout time.Duration) error {
+	logger := logging.FromContext(ctx)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-errs:
+		a.Close()
+		return err
+	case <-ctx.Done():
+	}
+
+	logger.WithField("timeout", drainTimeout.String()).Info("shutting down")
+	a.BeginShutdown()
+	drainCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	// Without GRPC_PORT there is no gRPC server to drain
+	var grpcDone chan struct{}
+	if a.grpcServer != nil {
+		grpcDone = make(chan struct{})
+		go func() {
+			a.grpcServer.GracefulStop()
+			close(grpcDone)
+		}()
+	}
+	err := srv.Shutdown(drainCtx)
+	if err != nil {
+		logger.WithError(err).Warn("requests still in flight at the shutdown deadline")
+		srv.Close()
+	}
+	if grpcDone != nil {
+		select {
+		case <-grpcDone:
+		case <-drainCtx.Done():
+			logger.Warn("rpcs still in flight at the shutdown deadline")
+			a.grpcServer.Stop()
+			<-grpcDone
+		}
+	}
+	a.Close()
+	logger.Info("stopped")
+	return err
+}
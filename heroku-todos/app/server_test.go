@@ -0,0 +1,109 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestServeDrains(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	ah := MakeHandler(testConfig())
+
+	// A slow request and a stream that only ends with the server
+	started := make(chan struct{}, 2)
+	handler := http.NewServeMux()
+	handler.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+	handler.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		started <- struct{}{}
+		<-ah.shutdown
+	})
+	srv := NewServer(testConfig(), handler)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	url := "http://" + ln.Addr().String()
+	grpcLn := bufconn.Listen(1 << 20)
+	ah.ServeGRPC(ah.NewGRPCServer(), grpcLn)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- ah.Serve(ctx, srv, ln, 5*time.Second)
+	}()
+
+	slow := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url + "/slow")
+		assert.NoError(err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		slow <- string(body)
+	}()
+	stream, err := http.Get(url + "/stream")
+	assert.NoError(err)
+	defer stream.Body.Close()
+	<-started
+	<-started
+
+	cancel()
+	assert.Equal("done", <-slow)
+	select {
+	case err := <-served:
+		assert.NoError(err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve didn't return once the stream ended")
+	}
+
+	// New connections are refused and the database is closed
+	_, err = http.Get(url + "/slow")
+	assert.Error(err)
+	_, err = grpcLn.Dial()
+	assert.Error(err)
+	assert.Error(ah.db.Ping(context.Background()))
+}
+
+func TestServeDeadlineWithoutGRPC(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	ah := MakeHandler(testConfig())
+
+	started := make(chan struct{})
+	handler := http.NewServeMux()
+	handler.HandleFunc("/stuck", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(time.Second)
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- ah.Serve(ctx, NewServer(testConfig(), handler), ln, 50*time.Millisecond)
+	}()
+	go http.Get("http://" + ln.Addr().String() + "/stuck")
+	<-started
+
+	// Draining runs out of time with no gRPC server to stop
+	cancel()
+	select {
+	case err := <-served:
+		assert.Error(err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve didn't return at the shutdown deadline")
+	}
+}
@@ -0,0 +1,48 @@
+package app
+
+import (
+	"net/http"
+	"strconv"
+
+	"tuckersWeb/todos/model"
+
+	"github.com/gorilla/mux"
+)
+
+type SessionInfo struct {
+	*model.Session
+	Current bool `json:"current"`
+}
+
+func (a *AppHandler) getSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	current := ""
+	if session, err := a.store.Get(r, "session"); err == nil && session.ID != "" {
+		current = hashToken(session.ID)
+	}
+	list := []*SessionInfo{}
+	for _, s := range a.db.GetUserSessions(r.Context(), a.getUserID(r)) {
+		list = append(list, &SessionInfo{s, s.TokenHash == current})
+	}
+	a.rd.JSON(w, http.StatusOK, list)
+}
+
+func (a *AppHandler) removeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+	ok := a.db.DeleteUserSession(r.Context(), a.getUserID(r), id)
+	if ok {
+		a.rd.JSON(w, http.StatusOK, Success{true})
+	} else {
+		a.rd.JSON(w, http.StatusOK, Success{false})
+	}
+}
+
+// removeSessionsHandler signs the user out everywhere, including here.
+func (a *AppHandler) removeSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	a.db.DeleteUserSessions(r.Context(), a.getUserID(r))
+	if session, err := a.store.Get(r, "session"); err == nil {
+		session.Options.MaxAge = -1
+		session.Save(r, w)
+	}
+	a.rd.JSON(w, http.StatusOK, Success{true})
+}
@@ -0,0 +1,206 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"tuckersWeb/todos/model"
+
+	"github.com/gorilla/securecookie"
+	"github.com/stretchr/testify/assert"
+)
+
+func getSessions(t *testing.T, client *http.Client, serverURL string) []*SessionInfo {
+	resp, err := client.Get(serverURL + "/sessions")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	list := []*SessionInfo{}
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	assert.NoError(t, err)
+	return list
+}
+
+func TestSessions(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	ah := MakeHandler(testConfig())
+	defer ah.Close()
+	ah.providers.Register(&stubProvider{"alpha"})
+
+	ts := httptest.NewServer(ah)
+	defer ts.Close()
+
+	laptop := newTestClient()
+	signIn(t, laptop, ts.URL, "alpha", "alice")
+	phone := newTestClient()
+	signIn(t, phone, ts.URL, "alpha", "alice")
+	tablet := newTestClient()
+	signIn(t, tablet, ts.URL, "alpha", "alice")
+
+	list := getSessions(t, laptop, ts.URL)
+	assert.Equal(3, len(list))
+	current := 0
+	for _, s := range list {
+		if s.Current {
+			current++
+		}
+	}
+	assert.Equal(1, current)
+
+	// Revoke the phone from the laptop
+	phoneSessions := getSessions(t, phone, ts.URL)
+	phoneID := 0
+	for _, s := range phoneSessions {
+		if s.Current {
+			phoneID = s.ID
+		}
+	}
+	req, _ := http.NewRequest("DELETE", ts.URL+"/sessions/"+strconv.Itoa(phoneID), nil)
+	resp, err := laptop.Do(req)
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	resp, err = phone.Get(ts.URL + "/todos")
+	assert.NoError(err)
+	assert.Equal(http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.Equal("/signin.html", resp.Header.Get("Location"))
+
+	resp, err = tablet.PostForm(ts.URL+"/auth/logout", nil)
+	assert.NoError(err)
+	assert.Equal(http.StatusSeeOther, resp.StatusCode)
+	resp, err = tablet.Get(ts.URL + "/todos")
+	assert.NoError(err)
+	assert.Equal(http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.Equal(1, len(getSessions(t, laptop, ts.URL)))
+
+	// Sign out everywhere
+	signIn(t, phone, ts.URL, "alpha", "alice")
+	req, _ = http.NewRequest("DELETE", ts.URL+"/sessions", nil)
+	resp, err = laptop.Do(req)
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	for _, client := range []*http.Client{laptop, phone} {
+		resp, err = client.Get(ts.URL + "/todos")
+		assert.NoError(err)
+		assert.Equal(http.StatusTemporaryRedirect, resp.StatusCode)
+	}
+}
+
+func TestSessionTimeouts(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	ah := MakeHandler(testConfig())
+	defer ah.Close()
+
+	ts := httptest.NewServer(ah)
+	defer ts.Close()
+
+	user := ah.db.SignInUser(context.Background(), &model.Identity{Provider: "alpha", Subject: "alice"})
+	now := time.Now()
+	for token, times := range map[string][2]time.Time{
+		"idle":    {now.Add(-8 * 24 * time.Hour), now.Add(time.Hour)},
+		"expired": {now, now.Add(-time.Hour)},
+		"active":  {now, now.Add(time.Hour)},
+	} {
+		data, _ := securecookie.GobEncoder{}.Serialize(map[interface{}]interface{}{"user_id": user.ID})
+		ah.db.CreateSession(context.Background(), &model.Session{
+			TokenHash:  hashToken(token),
+			UserID:     user.ID,
+			Data:       data,
+			CreatedAt:  now.Add(-24 * time.Hour),
+			LastSeenAt: times[0],
+			ExpiresAt:  times[1],
+		})
+	}
+
+	for token, signedIn := range map[string]bool{"idle": false, "expired": false, "active": true} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		encoded, err := ah.store.Codecs[0].Encode("session", token)
+		assert.NoError(err)
+		req.AddCookie(&http.Cookie{Name: "session", Value: encoded})
+		session, err := ah.store.New(req, "session")
+		assert.NoError(err)
+		assert.Equal(signedIn, !session.IsNew, token)
+		if signedIn {
+			assert.Equal(user.ID, session.Values["user_id"])
+		}
+	}
+}
+
+func TestSaveRevokedSession(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	ah := MakeHandler(testConfig())
+	defer ah.Close()
+
+	user := ah.db.SignInUser(context.Background(), &model.Identity{Provider: "alpha", Subject: "alice"})
+	data, _ := securecookie.GobEncoder{}.Serialize(map[interface{}]interface{}{"user_id": user.ID})
+	now := time.Now()
+	ah.db.CreateSession(context.Background(), &model.Session{
+		TokenHash:  hashToken("racing"),
+		UserID:     user.ID,
+		Data:       data,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(time.Hour),
+	})
+	req := httptest.NewRequest("GET", "/", nil)
+	encoded, err := ah.store.Codecs[0].Encode("session", "racing")
+	assert.NoError(err)
+	req.AddCookie(&http.Cookie{Name: "session", Value: encoded})
+	session, err := ah.store.Get(req, "session")
+	assert.NoError(err)
+	assert.False(session.IsNew)
+
+	// Signed out everywhere while the request runs
+	ah.db.DeleteUserSessions(context.Background(), user.ID)
+	session.Values["csrf_token"] = "new"
+	res := httptest.NewRecorder()
+	assert.NoError(session.Save(req, res))
+	assert.Empty(ah.db.GetUserSessions(context.Background(), user.ID))
+	cookies := res.Result().Cookies()
+	if assert.Len(cookies, 1) {
+		assert.Equal("session", cookies[0].Name)
+		assert.Empty(cookies[0].Value)
+		assert.True(cookies[0].MaxAge < 0)
+	}
+}
+
+// sweepCountingStore counts the sweeps of expired sessions.
+type sweepCountingStore struct {
+	model.SessionStore
+	sweeps int
+}
+
+func (s *sweepCountingStore) DeleteExpiredSessions(ctx context.Context, now time.Time, idleSince time.Time) int {
+	s.sweeps++
+	return s.SessionStore.DeleteExpiredSessions(ctx, now, idleSince)
+}
+
+func TestSessionSweepInterval(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	ah := MakeHandler(testConfig())
+	defer ah.Close()
+
+	counter := &sweepCountingStore{SessionStore: ah.db}
+	store := NewDBStore(counter, time.Hour, 24*time.Hour, []byte("test-session-key-0123456789abcdef"))
+	for i := 0; i < 5; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		session, err := store.New(req, "session")
+		assert.NoError(err)
+		assert.NoError(session.Save(req, httptest.NewRecorder()))
+	}
+	assert.Equal(1, counter.sweeps)
+
+	store.lastSweep = time.Now().Add(-sessionSweepInterval)
+	req := httptest.NewRequest("GET", "/", nil)
+	session, _ := store.New(req, "session")
+	assert.NoError(session.Save(req, httptest.NewRecorder()))
+	assert.Equal(2, counter.sweeps)
+}
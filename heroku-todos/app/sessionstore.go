@@ -0,0 +1,168 @@
+package app
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"tuckersWeb/todos/model"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+const (
+	// touchInterval limits how often a session's last seen time is written.
+	touchInterval = time.Minute
+	// sessionSweepInterval is how often expired sessions are deleted.
+	sessionSweepInterval = 10 * time.Minute
+)
+
+// DBStore is a sessions.Store that keeps session values in the database so
+// that sessions can be listed and revoked. The cookie only carries a signed
+// random token.
+type DBStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+	// IdleTimeout ends sessions that weren't used for that long, and
+	// AbsoluteTimeout ends them that long after they were created.
+	IdleTimeout     time.Duration
+	AbsoluteTimeout time.Duration
+
+	db model.SessionStore
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+func NewDBStore(db model.SessionStore, idleTimeout, absoluteTimeout time.Duration, keyPairs ...[]byte) *DBStore {
+	codecs := securecookie.CodecsFromPairs(keyPairs...)
+	for _, codec := range codecs {
+		if c, ok := codec.(*securecookie.SecureCookie); ok {
+			c.MaxAge(int(absoluteTimeout / time.Second))
+		}
+	}
+	return &DBStore{
+		Codecs: codecs,
+		Options: &sessions.Options{
+			Path:     "/",
+			MaxAge:   int(absoluteTimeout / time.Second),
+			HttpOnly: true,
+			// Strict would drop the cookie on the way back from sign-in
+			// providers, losing the OAuth state.
+			SameSite: http.SameSiteLaxMode,
+		},
+		IdleTimeout:     idleTimeout,
+		AbsoluteTimeout: absoluteTimeout,
+		db:              db,
+	}
+}
+
+func (s *DBStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *DBStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	var token string
+	if err := securecookie.DecodeMulti(name, c.Value, &token, s.Codecs...); err != nil {
+		return session, err
+	}
+	stored := s.db.GetSession(r.Context(), hashToken(token))
+	if stored == nil {
+		return session, nil
+	}
+	now := time.Now()
+	if now.After(stored.ExpiresAt) || now.Sub(stored.LastSeenAt) > s.IdleTimeout {
+		s.db.DeleteSession(r.Context(), stored.TokenHash)
+		return session, nil
+	}
+	if err := (securecookie.GobEncoder{}).Deserialize(stored.Data, &session.Values); err != nil {
+		return session, err
+	}
+	if now.Sub(stored.LastSeenAt) > touchInterval {
+		s.db.TouchSession(r.Context(), stored.TokenHash, now, clientIP(r))
+	}
+	session.ID = token
+	session.IsNew = false
+	return session, nil
+}
+
+func (s *DBStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	// cookies set over https are never sent back over http
+	session.Options.Secure = isHTTPS(r)
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			s.db.DeleteSession(r.Context(), hashToken(session.ID))
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	data, err := (securecookie.GobEncoder{}).Serialize(session.Values)
+	if err != nil {
+		return err
+	}
+	userID, _ := session.Values["user_id"].(int)
+	if session.ID != "" && !s.db.UpdateSession(r.Context(), hashToken(session.ID), userID, data) {
+		// Signed out elsewhere while this request ran. Saving it again
+		// would sign the user back in.
+		session.Values = map[interface{}]interface{}{}
+		session.ID = ""
+		session.Options.MaxAge = -1
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+	if session.ID == "" {
+		now := time.Now()
+		s.sweep(r, now)
+		session.ID = randomToken()
+		s.db.CreateSession(r.Context(), &model.Session{
+			TokenHash:  hashToken(session.ID),
+			UserID:     userID,
+			Data:       data,
+			UserAgent:  r.UserAgent(),
+			IP:         clientIP(r),
+			CreatedAt:  now,
+			LastSeenAt: now,
+			ExpiresAt:  now.Add(s.AbsoluteTimeout),
+		})
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// sweep deletes expired sessions, the first time a session is created and
+// then at most once per sessionSweepInterval.
+func (s *DBStore) sweep(r *http.Request, now time.Time) {
+	s.mu.Lock()
+	if now.Sub(s.lastSweep) < sessionSweepInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.lastSweep = now
+	s.mu.Unlock()
+	s.db.DeleteExpiredSessions(r.Context(), now, now.Add(-s.IdleTimeout))
+}
+
+// Regenerate moves the session values to a new token, so that a token
+// planted before sign in is useless afterwards.
+func (s *DBStore) Regenerate(r *http.Request, session *sessions.Session) {
+	if session.ID != "" {
+		s.db.DeleteSession(r.Context(), hashToken(session.ID))
+		session.ID = ""
+	}
+}
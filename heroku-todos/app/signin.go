@@ -2,107 +2,244 @@ package app
 
 import (
 	"context"
-	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
-	"encoding/json"
+	"encoding/gob"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"net/http"
-	"os"
+	"net/url"
 	"time"
 
+	"tuckersWeb/todos/auth"
+	"tuckersWeb/todos/logging"
+	"tuckersWeb/todos/model"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
 )
 
-type GoogleUserId struct {
-	ID            string `json:"id"`
-	Email         string `json:"email"`
-	VerifiedEmail bool   `json:"verified_email"`
-	Picture       string `json:"picture"`
+const oauthStateTTL = 10 * time.Minute
+
+// devIdPPath is where the development identity provider is served when
+// DEV_IDP is set.
+const devIdPPath = "/dev-idp"
+
+// oauthTimeout bounds the token exchange and profile lookup together.
+var oauthTimeout = 10 * time.Second
+
+// returnToPaths are the pages sign in may return to.
+var returnToPaths = map[string]bool{
+	"/":              true,
+	"/todo.html":     true,
+	"/sessions.html": true,
+	"/tokens.html":   true,
+	cliAuthorizePath: true,
 }
 
-var googleOauthConfig = oauth2.Config{
-	RedirectURL:  os.Getenv("DOMAIN_NAME") + "/auth/google/callback",
-	ClientID:     os.Getenv("GOOGLE_CLIENT_ID"),
-	ClientSecret: os.Getenv("GOOGLE_SECRET_KEY"),
-	Scopes:       []string{"https://www.googleapis.com/auth/userinfo.email"},
-	Endpoint:     google.Endpoint,
+// oauthLogin is kept in the session between the login redirect and the
+// provider's callback.
+type oauthLogin struct {
+	Provider string
+	State    string
+	// Verifier is the PKCE code verifier sent with the token exchange
+	Verifier string
+	// Nonce must come back in the ID token of OpenID Connect providers
+	Nonce    string
+	ReturnTo string
+	Expires  time.Time
 }
 
-func googleLoginHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("RedirectURL:", googleOauthConfig.RedirectURL)
-	state := generateStateOauthCookie(w)
-	url := googleOauthConfig.AuthCodeURL(state)
-	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+func init() {
+	gob.Register(&oauthLogin{})
+}
+
+// newProviderRegistry registers every sign-in provider that has client
+// credentials configured.
+func (a *AppHandler) newProviderRegistry() *auth.Registry {
+	cfg := a.cfg
+	providers := auth.NewRegistry()
+	if cfg.Google.ClientID != "" {
+		providers.Register(auth.NewGoogleProvider(cfg.Google.ClientID, string(cfg.Google.ClientSecret), a.callbackURL("google")))
+	}
+	if cfg.GitHub.ClientID != "" {
+		providers.Register(auth.NewGithubProvider(cfg.GitHub.ClientID, string(cfg.GitHub.ClientSecret), a.callbackURL("github")))
+	}
+	if cfg.OIDCIssuer != "" {
+		name := cfg.OIDCProviderName
+		provider, err := auth.NewOIDCProvider(context.Background(), name, cfg.OIDCIssuer,
+			cfg.OIDC.ClientID, string(cfg.OIDC.ClientSecret), a.callbackURL(name))
+		if err != nil {
+			a.logger.WithError(err).WithField("provider", name).Error("failed to set up OIDC provider")
+		} else {
+			providers.Register(provider)
+		}
+	}
+	return providers
 }
 
-func generateStateOauthCookie(w http.ResponseWriter) string {
-	expiration := time.Now().Add(1 * 24 * time.Hour)
+// mountDevIdP serves a FakeIdP at devIdPPath and registers it as the "dev"
+// provider, for signing in locally without real provider credentials.
+func (a *AppHandler) mountDevIdP(r *mux.Router) {
+	idp := auth.NewFakeIdP(devIdPPath)
+	a.providers.Register(idp.Provider(a.callbackURL("dev")))
+	r.PathPrefix(devIdPPath + "/").Handler(idp)
+	a.logger.Warn("DEV_IDP is set: anyone can sign in as anyone with the dev provider")
+}
 
-	b := make([]byte, 16)
-	rand.Read(b)
-	state := base64.URLEncoding.EncodeToString(b)
-	cookie := &http.Cookie{Name: "oauthstate", Value: state, Expires: expiration}
-	http.SetCookie(w, cookie)
-	return state
+func (a *AppHandler) callbackURL(provider string) string {
+	return a.cfg.DomainName + "/auth/" + provider + "/callback"
 }
 
-func googleAuthCallback(w http.ResponseWriter, r *http.Request) {
-	oauthstate, _ := r.Cookie("oauthstate")
+func (a *AppHandler) providersHandler(w http.ResponseWriter, r *http.Request) {
+	a.rd.JSON(w, http.StatusOK, a.providers.Names())
+}
 
-	if r.FormValue("state") != oauthstate.Value {
-		errMsg := fmt.Sprintf("invalid google oauth state cookie:%s state:%s\n", oauthstate.Value, r.FormValue("state"))
-		log.Printf(errMsg)
-		http.Error(w, errMsg, http.StatusInternalServerError)
+func (a *AppHandler) loginHandler(w http.ResponseWriter, r *http.Request) {
+	provider, ok := a.providers.Get(mux.Vars(r)["provider"])
+	if !ok {
+		http.NotFound(w, r)
 		return
 	}
+	session, _ := a.store.Get(r, "session")
+	login := &oauthLogin{
+		Provider: provider.Name(),
+		State:    randomToken(),
+		Verifier: randomToken(),
+		Nonce:    randomToken(),
+		ReturnTo: safeReturnTo(r.FormValue("return_to")),
+		Expires:  time.Now().Add(oauthStateTTL),
+	}
+	session.Values["oauth_login"] = login
+	if err := session.Save(r, w); err != nil {
+		serverError(w, r, "failed to save session", err)
+		return
+	}
+	opts := []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("code_challenge", codeChallenge(login.Verifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	}
+	if _, ok := provider.(auth.IDTokenProvider); ok {
+		opts = append(opts, oauth2.SetAuthURLParam("nonce", login.Nonce))
+	}
+	url := provider.AuthCodeURL(login.State, opts...)
+	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+}
 
-	data, err := getGoogleUserInfo(r.FormValue("code"))
-	if err != nil {
-		log.Println(err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+// codeChallenge derives the S256 PKCE challenge of verifier.
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// safeReturnTo only lets sign in send the browser back to pages of this
+// app, so that the login link can't redirect elsewhere.
+func safeReturnTo(returnTo string) string {
+	u, err := url.Parse(returnTo)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil || !returnToPaths[u.Path] {
+		return "/"
+	}
+	return u.RequestURI()
+}
+
+func (a *AppHandler) authCallback(w http.ResponseWriter, r *http.Request) {
+	provider, ok := a.providers.Get(mux.Vars(r)["provider"])
+	if !ok {
+		http.NotFound(w, r)
 		return
 	}
 
-	// Store Id info into Session cookie
-	var userInfo GoogleUserId
-	err = json.Unmarshal(data, &userInfo)
-	if err != nil {
-		log.Println(err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// The state is good for a single callback, whatever its outcome
+	session, _ := a.store.Get(r, "session")
+	login, _ := session.Values["oauth_login"].(*oauthLogin)
+	delete(session.Values, "oauth_login")
+	if err := session.Save(r, w); err != nil {
+		serverError(w, r, "failed to save session", err)
 		return
 	}
-	session, err := store.Get(r, "session")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	state := r.FormValue("state")
+	if login == nil || login.Provider != provider.Name() || time.Now().After(login.Expires) ||
+		subtle.ConstantTimeCompare([]byte(state), []byte(login.State)) != 1 {
+		logging.FromContext(r.Context()).WithField("provider", provider.Name()).Warn("invalid oauth state")
+		a.metrics.oauthLogin(provider.Name(), false)
+		redirectSignin(w, r, "error", "invalid-state")
+		return
+	}
+	if errCode := r.FormValue("error"); errCode != "" {
+		logging.FromContext(r.Context()).WithFields(logrus.Fields{
+			"provider":          provider.Name(),
+			"error":             errCode,
+			"error_description": r.FormValue("error_description"),
+		}).Warn("provider refused sign in")
+		a.metrics.oauthLogin(provider.Name(), false)
+		redirectSignin(w, r, "error", "provider-error")
 		return
 	}
 
-	// Set some session values.
-	session.Values["id"] = userInfo.ID
-	// Save it before we write to the response/return from the handler.
-	err = session.Save(r, w)
+	ctx, cancel := context.WithTimeout(r.Context(), oauthTimeout)
+	defer cancel()
+	token, err := provider.Exchange(ctx, r.FormValue("code"), oauth2.SetAuthURLParam("code_verifier", login.Verifier))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logging.FromContext(r.Context()).WithError(err).WithField("provider", provider.Name()).Error("token exchange failed")
+		a.metrics.oauthLogin(provider.Name(), false)
+		redirectSignin(w, r, "error", "provider-error")
+		return
+	}
+	var identity *model.Identity
+	if p, ok := provider.(auth.IDTokenProvider); ok {
+		identity, err = p.VerifyIdentity(ctx, token, login.Nonce)
+	} else {
+		identity, err = provider.FetchIdentity(ctx, token)
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).WithError(err).WithField("provider", provider.Name()).Error("identity lookup failed")
+		a.metrics.oauthLogin(provider.Name(), false)
+		redirectSignin(w, r, "error", "provider-error")
 		return
 	}
-	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
-}
 
-const oauthGoogleUrlAPI = "https://www.googleapis.com/oauth2/v2/userinfo?access_token="
+	// A signed in user is linking another account
+	if userID := a.getUserID(r); userID != 0 {
+		if !a.db.LinkIdentity(r.Context(), userID, identity) {
+			a.metrics.oauthLogin(provider.Name(), false)
+			http.Error(w, fmt.Sprintf("this %s account is linked to another user", provider.Name()), http.StatusConflict)
+			return
+		}
+	}
+	user := a.db.SignInUser(r.Context(), identity)
 
-func getGoogleUserInfo(code string) ([]byte, error) {
-	token, err := googleOauthConfig.Exchange(context.Background(), code)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to Exchange %s\n", err.Error())
+	if err := a.saveUserSession(w, r, user, provider.Name()); err != nil {
+		serverError(w, r, "failed to save session", err)
+		return
 	}
+	a.metrics.oauthLogin(provider.Name(), true)
+	http.Redirect(w, r, login.ReturnTo, http.StatusTemporaryRedirect)
+}
 
-	resp, err := http.Get(oauthGoogleUrlAPI + token.AccessToken)
+// saveUserSession stores the user id and how the user signed in into the
+// session cookie.
+func (a *AppHandler) saveUserSession(w http.ResponseWriter, r *http.Request, user *model.User, provider string) error {
+	session, err := a.store.Get(r, "session")
 	if err != nil {
-		return nil, fmt.Errorf("Failed to Get UserInfo %s\n", err.Error())
+		return err
 	}
 
-	return ioutil.ReadAll(resp.Body)
+	a.store.Regenerate(r, session)
+	newCSRFToken(w, r, session)
+	// Set some session values.
+	session.Values["user_id"] = user.ID
+	session.Values["provider"] = provider
+	// Save it before we write to the response/return from the handler.
+	return session.Save(r, w)
+}
+
+func (a *AppHandler) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := a.store.Get(r, "session")
+	session.Options.MaxAge = -1
+	if err := session.Save(r, w); err != nil {
+		serverError(w, r, "failed to save session", err)
+		return
+	}
+	http.Redirect(w, r, "/signin.html", http.StatusSeeOther)
 }
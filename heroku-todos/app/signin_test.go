@@ -0,0 +1,395 @@
+package app
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"tuckersWeb/todos/auth"
+	"tuckersWeb/todos/model"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+// stubProvider signs in whoever the authorization code names.
+type stubProvider struct {
+	name string
+}
+
+func (p *stubProvider) Name() string {
+	return p.name
+}
+
+func (p *stubProvider) AuthCodeURL(state string, opts ...oauth2.AuthCodeOption) string {
+	return "https://" + p.name + ".example.com/authorize?state=" + url.QueryEscape(state)
+}
+
+func (p *stubProvider) Exchange(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	return &oauth2.Token{AccessToken: code}, nil
+}
+
+func (p *stubProvider) FetchIdentity(ctx context.Context, token *oauth2.Token) (*model.Identity, error) {
+	return &model.Identity{
+		Provider: p.name,
+		Subject:  token.AccessToken,
+		Email:    token.AccessToken + "@" + p.name + ".example.com",
+	}, nil
+}
+
+// csrfTransport sends the CSRF token like todo.js does, fetching a page
+// first when the jar doesn't hold one yet.
+type csrfTransport struct {
+	jar http.CookieJar
+}
+
+func (t *csrfTransport) csrfToken(u *url.URL) string {
+	for _, c := range t.jar.Cookies(u) {
+		if c.Name == csrfCookieName {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+func (t *csrfTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !changesState(req) {
+		return http.DefaultTransport.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	if t.csrfToken(req.URL) == "" {
+		page, _ := http.NewRequest("GET", req.URL.Scheme+"://"+req.URL.Host+"/signin.html", nil)
+		for _, c := range t.jar.Cookies(req.URL) {
+			page.AddCookie(c)
+		}
+		resp, err := http.DefaultTransport.RoundTrip(page)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		t.jar.SetCookies(req.URL, resp.Cookies())
+		// The jar added the cookies to req before the new ones existed
+		req.Header.Del("Cookie")
+		for _, c := range t.jar.Cookies(req.URL) {
+			req.AddCookie(c)
+		}
+	}
+	req.Header.Set(csrfHeaderName, t.csrfToken(req.URL))
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func newTestClient() *http.Client {
+	jar, _ := cookiejar.New(nil)
+	return &http.Client{
+		Jar:       jar,
+		Transport: &csrfTransport{jar},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// signIn runs the login and callback of provider as the account named code.
+func signIn(t *testing.T, client *http.Client, serverURL, provider, code string) *http.Response {
+	resp, err := client.Get(serverURL + "/auth/" + provider + "/login")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	location, err := url.Parse(resp.Header.Get("Location"))
+	assert.NoError(t, err)
+
+	resp, err = client.Get(serverURL + "/auth/" + provider + "/callback?" + url.Values{
+		"state": {location.Query().Get("state")},
+		"code":  {code},
+	}.Encode())
+	assert.NoError(t, err)
+	return resp
+}
+
+// devSignIn signs in through the development identity provider with the
+// identity fields in form, the way its authorize page submits them.
+func devSignIn(t *testing.T, client *http.Client, serverURL string, form url.Values) {
+	resp, err := client.Get(serverURL + "/auth/dev/login")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	authorize, err := url.Parse(serverURL + resp.Header.Get("Location"))
+	assert.NoError(t, err)
+
+	resp, err = client.Get(authorize.String())
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	query := authorize.Query()
+	for name, values := range form {
+		query[name] = values
+	}
+	authorize.RawQuery = query.Encode()
+	resp, err = client.Get(authorize.String())
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+
+	resp, err = client.Get(serverURL + resp.Header.Get("Location"))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.Equal(t, "/", resp.Header.Get("Location"))
+}
+
+func TestSigninLinksProviders(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	ah := MakeHandler(testConfig())
+	defer ah.Close()
+	ah.providers.Register(&stubProvider{"alpha"})
+	ah.providers.Register(&stubProvider{"beta"})
+
+	ts := httptest.NewServer(ah)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/auth/providers")
+	assert.NoError(err)
+	names := []string{}
+	err = json.NewDecoder(resp.Body).Decode(&names)
+	assert.NoError(err)
+	assert.Contains(names, "alpha")
+	assert.Contains(names, "beta")
+
+	client := newTestClient()
+	resp = signIn(t, client, ts.URL, "alpha", "alice")
+	assert.Equal(http.StatusTemporaryRedirect, resp.StatusCode)
+	resp = signIn(t, client, ts.URL, "beta", "alice2")
+	assert.Equal(http.StatusTemporaryRedirect, resp.StatusCode)
+
+	resp, err = client.Get(ts.URL + "/me")
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	var me Me
+	err = json.NewDecoder(resp.Body).Decode(&me)
+	assert.NoError(err)
+	assert.Equal(2, len(me.Identities))
+
+	// The linked account signs in as the same user
+	client = newTestClient()
+	resp = signIn(t, client, ts.URL, "beta", "alice2")
+	assert.Equal(http.StatusTemporaryRedirect, resp.StatusCode)
+	resp, err = client.Get(ts.URL + "/me")
+	assert.NoError(err)
+	var again Me
+	err = json.NewDecoder(resp.Body).Decode(&again)
+	assert.NoError(err)
+	assert.Equal(me.ID, again.ID)
+
+	// Another user can't take over a linked account
+	client = newTestClient()
+	signIn(t, client, ts.URL, "alpha", "bob")
+	resp = signIn(t, client, ts.URL, "beta", "alice2")
+	assert.Equal(http.StatusConflict, resp.StatusCode)
+
+	resp, err = newTestClient().Get(ts.URL + "/auth/unknown/login")
+	assert.NoError(err)
+	assert.Equal(http.StatusNotFound, resp.StatusCode)
+}
+
+// fakeIdP is an OpenID provider that signs everyone in as alice and checks
+// PKCE on the token exchange.
+type fakeIdP struct {
+	*httptest.Server
+	delay time.Duration
+	key   *rsa.PrivateKey
+
+	mu         sync.Mutex
+	challenges map[string]string
+	nonces     map[string]string
+}
+
+// idToken signs claims for the fake provider's client.
+func (idp *fakeIdP) idToken(nonce string) string {
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test"})
+	claims, _ := json.Marshal(auth.IDTokenClaims{
+		Issuer:   idp.URL,
+		Subject:  "alice",
+		Audience: auth.Audience{"client"},
+		Expiry:   now.Add(time.Hour).Unix(),
+		IssuedAt: now.Unix(),
+		Nonce:    nonce,
+		Email:    "alice@idp.example.com",
+	})
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func newFakeIdP() *fakeIdP {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	idp := &fakeIdP{key: key, challenges: map[string]string{}, nonces: map[string]string{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(auth.OIDCDiscovery{
+			Issuer:                idp.URL,
+			AuthorizationEndpoint: idp.URL + "/authorize",
+			TokenEndpoint:         idp.URL + "/token",
+			UserinfoEndpoint:      idp.URL + "/userinfo",
+			JwksURI:               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(auth.JSONWebKeySet{Keys: []auth.JSONWebKey{{
+			Kty: "RSA",
+			Kid: "test",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code_challenge_method") != "S256" {
+			http.Error(w, "PKCE required", http.StatusBadRequest)
+			return
+		}
+		code := randomToken()
+		idp.mu.Lock()
+		idp.challenges[code] = r.FormValue("code_challenge")
+		idp.nonces[code] = r.FormValue("nonce")
+		idp.mu.Unlock()
+		http.Redirect(w, r, r.FormValue("redirect_uri")+"?"+url.Values{
+			"code":  {code},
+			"state": {r.FormValue("state")},
+		}.Encode(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(idp.delay)
+		code := r.PostFormValue("code")
+		idp.mu.Lock()
+		challenge, ok := idp.challenges[code]
+		nonce := idp.nonces[code]
+		delete(idp.challenges, code)
+		delete(idp.nonces, code)
+		idp.mu.Unlock()
+		if !ok || codeChallenge(r.PostFormValue("code_verifier")) != challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": code,
+			"token_type":   "Bearer",
+			"id_token":     idp.idToken(nonce),
+		})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(auth.OIDCUserInfo{Subject: "alice", Email: "alice@idp.example.com"})
+	})
+	idp.Server = httptest.NewServer(mux)
+	return idp
+}
+
+// authorize follows the login redirect to the fake provider and returns the
+// callback URL it sends the browser back to.
+func authorize(t *testing.T, client *http.Client, serverURL, query string) string {
+	resp, err := client.Get(serverURL + "/auth/fake/login" + query)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	resp, err = client.Get(resp.Header.Get("Location"))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	return serverURL + resp.Header.Get("Location")
+}
+
+func TestOAuthCallback(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	ah := MakeHandler(testConfig())
+	defer ah.Close()
+	idp := newFakeIdP()
+	defer idp.Close()
+	provider, err := auth.NewOIDCProvider(context.Background(), "fake", idp.URL, "client", "secret", ah.callbackURL("fake"))
+	assert.NoError(err)
+	ah.providers.Register(provider)
+
+	ts := httptest.NewServer(ah)
+	defer ts.Close()
+
+	client := newTestClient()
+	callback := authorize(t, client, ts.URL, "?return_to="+url.QueryEscape("/tokens.html"))
+	resp, err := client.Get(callback)
+	assert.NoError(err)
+	assert.Equal(http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.Equal("/tokens.html", resp.Header.Get("Location"))
+	resp, err = client.Get(ts.URL + "/me")
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	// The state can't be used twice
+	resp, err = client.Get(callback)
+	assert.NoError(err)
+	assert.Equal(http.StatusSeeOther, resp.StatusCode)
+	assert.Equal("/signin.html?error=invalid-state", resp.Header.Get("Location"))
+
+	// A callback without a session is turned away, not a panic
+	resp, err = newTestClient().Get(callback)
+	assert.NoError(err)
+	assert.Equal(http.StatusSeeOther, resp.StatusCode)
+	assert.Equal("/signin.html?error=invalid-state", resp.Header.Get("Location"))
+
+	// A code issued for another login fails PKCE even with a valid state
+	client = newTestClient()
+	first, _ := url.Parse(authorize(t, client, ts.URL, ""))
+	second, _ := url.Parse(authorize(t, client, ts.URL, ""))
+	query := second.Query()
+	query.Set("code", first.Query().Get("code"))
+	resp, err = client.Get(ts.URL + second.Path + "?" + query.Encode())
+	assert.NoError(err)
+	assert.Equal(http.StatusSeeOther, resp.StatusCode)
+	// The provider's answer is logged, not shown
+	assert.Equal("/signin.html?error=provider-error", resp.Header.Get("Location"))
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.NotContains(string(body), "invalid_grant")
+
+	// Sign in can only return to the app's own pages
+	callback = authorize(t, client, ts.URL, "?return_to="+url.QueryEscape("https://evil.example.com/"))
+	resp, err = client.Get(callback)
+	assert.NoError(err)
+	assert.Equal("/", resp.Header.Get("Location"))
+
+	// A provider that hangs doesn't hold the request forever
+	idp.delay = 200 * time.Millisecond
+	oauthTimeout = 50 * time.Millisecond
+	defer func() { oauthTimeout = 10 * time.Second }()
+	callback = authorize(t, client, ts.URL, "")
+	start := time.Now()
+	resp, err = client.Get(callback)
+	assert.NoError(err)
+	assert.Equal("/signin.html?error=provider-error", resp.Header.Get("Location"))
+	assert.True(time.Since(start) < idp.delay)
+}
+
+func TestSafeReturnTo(t *testing.T) {
+	assert := assert.New(t)
+	for returnTo, want := range map[string]string{
+		"":                          "/",
+		"/":                         "/",
+		"/tokens.html":              "/tokens.html",
+		"/sessions.html?tab=1":      "/sessions.html?tab=1",
+		"/todos":                    "/",
+		"https://evil.example.com/": "/",
+		"//evil.example.com/":       "/",
+		"/\\evil.example.com":       "/",
+		"javascript:alert(1)":       "/",
+	} {
+		assert.Equal(want, safeReturnTo(returnTo), returnTo)
+	}
+}
@@ -0,0 +1,115 @@
+package app
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// throttle refuses a key once it was hit max times within window. Keys
+// are whatever clients send, so those whose hits all fell out of the
+// window are swept once per window.
+type throttle struct {
+	mu        sync.Mutex
+	max       int
+	window    time.Duration
+	hits      map[string][]time.Time
+	lastSweep time.Time
+}
+
+func newThrottle(max int, window time.Duration) *throttle {
+	return &throttle{
+		max:       max,
+		window:    window,
+		hits:      make(map[string][]time.Time),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow reports whether key may try again, and if not, how long until it
+// may.
+func (t *throttle) Allow(key string) (bool, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	hits := t.recent(key, time.Now())
+	if len(hits) < t.max {
+		return true, 0
+	}
+	return false, time.Until(hits[0].Add(t.window))
+}
+
+func (t *throttle) Hit(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	t.sweep(now)
+	t.hits[key] = append(t.recent(key, now), now)
+}
+
+// sweep drops the keys whose last hit fell out of the window.
+func (t *throttle) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < t.window {
+		return
+	}
+	t.lastSweep = now
+	for key, hits := range t.hits {
+		if now.Sub(hits[len(hits)-1]) >= t.window {
+			delete(t.hits, key)
+		}
+	}
+}
+
+func (t *throttle) Reset(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.hits, key)
+}
+
+// recent drops the hits of key that fell out of the window.
+func (t *throttle) recent(key string, now time.Time) []time.Time {
+	hits := t.hits[key]
+	i := 0
+	for i < len(hits) && now.Sub(hits[i]) >= t.window {
+		i++
+	}
+	if i == len(hits) {
+		delete(t.hits, key)
+		return nil
+	}
+	hits = hits[i:]
+	t.hits[key] = hits
+	return hits
+}
+
+// SetClientIP records the address of the client for clientIP. With
+// TRUST_PROXY that is the last address in X-Forwarded-For, which Heroku's
+// router appends the address it received the request from to. Without it
+// the header is ignored, since clients can send any.
+func (a *AppHandler) SetClientIP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	ip := remoteIP(r)
+	if forwarded := r.Header.Get("X-Forwarded-For"); a.cfg.TrustProxy && forwarded != "" {
+		addrs := strings.Split(forwarded, ",")
+		ip = strings.TrimSpace(addrs[len(addrs)-1])
+	}
+	next(w, r.WithContext(context.WithValue(r.Context(), clientIPContextKey, ip)))
+}
+
+// clientIP returns the address SetClientIP recorded, or the address the
+// request came from.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPContextKey).(string); ok {
+		return ip
+	}
+	return remoteIP(r)
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
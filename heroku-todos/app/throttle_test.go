@@ -0,0 +1,56 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThrottleSweep(t *testing.T) {
+	assert := assert.New(t)
+	th := newThrottle(2, 20*time.Millisecond)
+	for i := 0; i < 100; i++ {
+		th.Hit("stuffed" + strconv.Itoa(i) + "@example.com")
+	}
+	th.Hit("bob@example.com")
+	th.Hit("bob@example.com")
+	ok, _ := th.Allow("bob@example.com")
+	assert.False(ok)
+	assert.Len(th.hits, 101)
+
+	// Keys no one tried again within the window are forgotten
+	time.Sleep(30 * time.Millisecond)
+	th.Hit("carol@example.com")
+	assert.Len(th.hits, 1)
+	ok, _ = th.Allow("bob@example.com")
+	assert.True(ok)
+}
+
+func TestClientIP(t *testing.T) {
+	assert := assert.New(t)
+	ah := &AppHandler{cfg: testConfig()}
+	ipOf := func(forwarded string) string {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "10.0.0.1:4321"
+		if forwarded != "" {
+			req.Header.Set("X-Forwarded-For", forwarded)
+		}
+		var ip string
+		ah.SetClientIP(httptest.NewRecorder(), req, func(w http.ResponseWriter, r *http.Request) {
+			ip = clientIP(r)
+		})
+		return ip
+	}
+
+	// Anyone can send X-Forwarded-For
+	assert.Equal("10.0.0.1", ipOf("203.0.113.9"))
+
+	// Heroku's router appends the address it saw
+	ah.cfg.TrustProxy = true
+	assert.Equal("198.51.100.7", ipOf("203.0.113.9, 198.51.100.7"))
+	assert.Equal("10.0.0.1", ipOf(""))
+}
@@ -0,0 +1,157 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"tuckersWeb/todos/logging"
+	"tuckersWeb/todos/model"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// accessTokenPrefix makes leaked tokens easy to spot
+	accessTokenPrefix      = "tdp_"
+	defaultAccessTokenDays = 30
+	maxAccessTokenDays     = 365
+)
+
+var accessTokenScopes = map[string]bool{"read": true, "write": true}
+
+type NewAccessToken struct {
+	*model.AccessToken
+	// Token is only ever shown when the token is created
+	Token string `json:"token"`
+}
+
+func (a *AppHandler) getTokensHandler(w http.ResponseWriter, r *http.Request) {
+	list := a.db.GetAccessTokens(r.Context(), a.getUserID(r))
+	a.rd.JSON(w, http.StatusOK, list)
+}
+
+func (a *AppHandler) addTokenHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		a.rd.Text(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	scopes := r.Form["scope"]
+	if len(scopes) == 0 {
+		a.rd.Text(w, http.StatusBadRequest, "at least one scope is required")
+		return
+	}
+	for _, scope := range scopes {
+		if !accessTokenScopes[scope] {
+			a.rd.Text(w, http.StatusBadRequest, "unknown scope "+scope)
+			return
+		}
+	}
+	days := defaultAccessTokenDays
+	if v := r.FormValue("expires_in_days"); v != "" {
+		var err error
+		days, err = strconv.Atoi(v)
+		if err != nil || days < 1 || days > maxAccessTokenDays {
+			a.rd.Text(w, http.StatusBadRequest, "expires_in_days must be between 1 and "+strconv.Itoa(maxAccessTokenDays))
+			return
+		}
+	}
+
+	secret := accessTokenPrefix + randomToken()
+	now := time.Now()
+	token := &model.AccessToken{
+		UserID:    a.getUserID(r),
+		Name:      name,
+		TokenHash: hashToken(secret),
+		Scopes:    scopes,
+		CreatedAt: now,
+		ExpiresAt: now.AddDate(0, 0, days),
+	}
+	token.ID = a.db.CreateAccessToken(r.Context(), token)
+	a.rd.JSON(w, http.StatusCreated, NewAccessToken{token, secret})
+}
+
+func (a *AppHandler) removeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+	ok := a.db.RevokeAccessToken(r.Context(), a.getUserID(r), id)
+	if ok {
+		a.rd.JSON(w, http.StatusOK, Success{true})
+	} else {
+		a.rd.JSON(w, http.StatusOK, Success{false})
+	}
+}
+
+// bearerToken returns the credentials of an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+	return parseBearer(r.Header.Get("Authorization"))
+}
+
+// parseBearer returns the credentials of an authorization header value in
+// the Bearer scheme.
+func parseBearer(header string) (string, bool) {
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(header[7:]), true
+}
+
+// sessionOnly reports whether path manages credentials, which access tokens
+// may not do.
+func sessionOnly(path string) bool {
+	return strings.HasPrefix(path, "/tokens") || strings.HasPrefix(path, "/sessions")
+}
+
+// checkAccessToken signs the request in as the owner of the bearer token if
+// the token is valid and has the scope the method needs.
+func (a *AppHandler) checkAccessToken(w http.ResponseWriter, r *http.Request, next http.HandlerFunc, secret string) {
+	token := a.validAccessToken(r.Context(), secret)
+	if token == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		httpError(w, r, "invalid or expired access token", http.StatusUnauthorized)
+		return
+	}
+
+	// GraphQL queries are sent with POST too, so its mutations check the
+	// write scope themselves.
+	scope := "read"
+	if changesState(r) && r.URL.Path != graphqlPath {
+		scope = "write"
+	}
+	if sessionOnly(r.URL.Path) || !token.HasScope(scope) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+		httpError(w, r, "access token lacks the "+scope+" scope for this request", http.StatusForbidden)
+		return
+	}
+
+	a.touchAccessToken(r.Context(), token, clientIP(r))
+	logging.AddFields(r.Context(), logrus.Fields{"user_id": token.UserID, "access_token_id": token.ID})
+	ctx := context.WithValue(r.Context(), userIDContextKey, token.UserID)
+	if !token.HasScope("write") {
+		ctx = context.WithValue(ctx, graphqlReadOnlyKey, errNoWriteScope)
+	}
+	next(w, r.WithContext(ctx))
+}
+
+// validAccessToken returns the unexpired token with secret, or nil.
+func (a *AppHandler) validAccessToken(ctx context.Context, secret string) *model.AccessToken {
+	token := a.db.GetAccessToken(ctx, hashToken(secret))
+	if token == nil || time.Now().After(token.ExpiresAt) {
+		return nil
+	}
+	return token
+}
+
+// touchAccessToken records that token was used from ip, at most once per
+// touchInterval from the same address.
+func (a *AppHandler) touchAccessToken(ctx context.Context, token *model.AccessToken, ip string) {
+	now := time.Now()
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) > touchInterval || token.LastUsedIP != ip {
+		a.db.TouchAccessToken(ctx, token.ID, now, ip)
+	}
+}
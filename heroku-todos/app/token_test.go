@@ -0,0 +1,103 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+
+	"tuckersWeb/todos/model"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func bearerRequest(method, url, token string) *http.Request {
+	req, _ := http.NewRequest(method, url, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+func createToken(t *testing.T, client *http.Client, serverURL string, form url.Values) NewAccessToken {
+	resp, err := client.PostForm(serverURL+"/tokens", form)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	var token NewAccessToken
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	assert.NoError(t, err)
+	return token
+}
+
+func TestAccessTokens(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	ah := MakeHandler(testConfig())
+	defer ah.Close()
+	ah.providers.Register(&stubProvider{"alpha"})
+
+	ts := httptest.NewServer(ah)
+	defer ts.Close()
+	browser := newTestClient()
+	signIn(t, browser, ts.URL, "alpha", "alice")
+
+	resp, err := browser.PostForm(ts.URL+"/tokens", url.Values{"name": {"ci"}, "scope": {"admin"}})
+	assert.NoError(err)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+
+	readWrite := createToken(t, browser, ts.URL, url.Values{"name": {"ci"}, "scope": {"read", "write"}})
+	assert.Contains(readWrite.Token, accessTokenPrefix)
+	readOnly := createToken(t, browser, ts.URL, url.Values{"name": {"dashboard"}, "scope": {"read"}, "expires_in_days": {"7"}})
+
+	client := &http.Client{}
+	req := bearerRequest("POST", ts.URL+"/todos?name=from+ci", readWrite.Token)
+	resp, err = client.Do(req)
+	assert.NoError(err)
+	assert.Equal(http.StatusCreated, resp.StatusCode)
+
+	resp, err = client.Do(bearerRequest("GET", ts.URL+"/todos", readOnly.Token))
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	todos := []*model.Todo{}
+	err = json.NewDecoder(resp.Body).Decode(&todos)
+	assert.NoError(err)
+	assert.Equal(1, len(todos))
+	assert.Equal("from ci", todos[0].Name)
+
+	resp, err = client.Do(bearerRequest("POST", ts.URL+"/todos?name=nope", readOnly.Token))
+	assert.NoError(err)
+	assert.Equal(http.StatusForbidden, resp.StatusCode)
+	assert.Contains(resp.Header.Get("WWW-Authenticate"), "insufficient_scope")
+
+	// Tokens can't manage credentials
+	resp, err = client.Do(bearerRequest("GET", ts.URL+"/tokens", readWrite.Token))
+	assert.NoError(err)
+	assert.Equal(http.StatusForbidden, resp.StatusCode)
+
+	resp, err = client.Do(bearerRequest("GET", ts.URL+"/todos", "tdp_unknown"))
+	assert.NoError(err)
+	assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+	assert.Contains(resp.Header.Get("WWW-Authenticate"), "invalid_token")
+
+	resp, err = browser.Get(ts.URL + "/tokens")
+	assert.NoError(err)
+	tokens := []*model.AccessToken{}
+	err = json.NewDecoder(resp.Body).Decode(&tokens)
+	assert.NoError(err)
+	assert.Equal(2, len(tokens))
+	for _, token := range tokens {
+		if token.ID == readWrite.ID {
+			assert.NotNil(token.LastUsedAt)
+			assert.Equal("127.0.0.1", token.LastUsedIP)
+		}
+	}
+
+	req, _ = http.NewRequest("DELETE", ts.URL+"/tokens/"+strconv.Itoa(readWrite.ID), nil)
+	resp, err = browser.Do(req)
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	resp, err = client.Do(bearerRequest("GET", ts.URL+"/todos", readWrite.Token))
+	assert.NoError(err)
+	assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+}
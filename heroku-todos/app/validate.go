@@ -0,0 +1,162 @@
+package app
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	// maxBodyBytes bounds every request body. Todos and forms are far
+	// smaller.
+	maxBodyBytes = 64 << 10
+	// maxTodoNameLength is in characters, counted after normalization.
+	maxTodoNameLength = 200
+	maxTagLength      = 50
+	maxTags           = 20
+)
+
+// FieldError says what is wrong with one field of the input, Code being
+// stable for scripts and Message for people.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type ValidationErrors []FieldError
+
+func (errs ValidationErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Field + ": " + e.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (errs *ValidationErrors) add(field, code, message string) {
+	*errs = append(*errs, FieldError{Field: field, Code: code, Message: message})
+}
+
+// text cleans up a single line of user text: it must be valid UTF-8 and
+// free of control characters, including those reordering text, and is
+// trimmed and put into NFC so that equal looking names are equal.
+func (errs *ValidationErrors) text(field, s string, required bool, maxLength int) string {
+	if !utf8.ValidString(s) {
+		errs.add(field, "invalid_encoding", "must be valid UTF-8")
+		return ""
+	}
+	s = strings.TrimSpace(norm.NFC.String(s))
+	for _, r := range s {
+		if unicode.IsControl(r) || unicode.Is(unicode.Bidi_Control, r) {
+			errs.add(field, "control_character", "must not contain control characters")
+			return ""
+		}
+	}
+	if s == "" {
+		if required {
+			errs.add(field, "required", "is required")
+		}
+		return ""
+	}
+	if utf8.RuneCountInString(s) > maxLength {
+		errs.add(field, "too_long", "must be at most "+strconv.Itoa(maxLength)+" characters")
+		return ""
+	}
+	return s
+}
+
+// Validate returns the input cleaned up, or what is wrong with it.
+func (in TodoInput) Validate() (TodoInput, error) {
+	var errs ValidationErrors
+	in.Name = errs.text("name", in.Name, true, maxTodoNameLength)
+	if len(errs) > 0 {
+		return in, errs
+	}
+	return in, nil
+}
+
+// validateTags returns the tags cleaned up and without duplicates, or
+// what is wrong with them.
+func validateTags(tags []string) ([]string, error) {
+	var errs ValidationErrors
+	if len(tags) > maxTags {
+		errs.add("tags", "too_many", "must be at most "+strconv.Itoa(maxTags)+" tags")
+		return nil, errs
+	}
+	cleaned := []string{}
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag = errs.text("tags", tag, true, maxTagLength)
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			cleaned = append(cleaned, tag)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return cleaned, nil
+}
+
+// writeValidationProblem answers with the field errors of err.
+func writeValidationProblem(w http.ResponseWriter, r *http.Request, err error) {
+	errs, _ := err.(ValidationErrors)
+	writeProblemDetails(w, r, Problem{
+		Status: http.StatusUnprocessableEntity,
+		Detail: err.Error(),
+		Errors: errs,
+	})
+}
+
+// limitBody refuses request bodies larger than maxBodyBytes, before they
+// are read when the client says how large they are.
+func limitBody(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if r.ContentLength > maxBodyBytes {
+		httpError(w, r, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = &limitedBody{ReadCloser: r.Body, w: w, n: maxBodyBytes}
+	next(w, r)
+}
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// limitedBody is like http.MaxBytesReader, but fails with errBodyTooLarge.
+type limitedBody struct {
+	io.ReadCloser
+	w http.ResponseWriter
+	n int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.n < 0 {
+		return 0, errBodyTooLarge
+	}
+	// Read one byte more than is left to find out whether the body ends
+	// within the limit.
+	if int64(len(p)) > b.n+1 {
+		p = p[:b.n+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) <= b.n {
+		b.n -= int64(n)
+		return n, err
+	}
+	n = int(b.n)
+	b.n = -1
+	// The rest of the body is not worth reading to reuse the connection.
+	b.w.Header().Set("Connection", "close")
+	return n, errBodyTooLarge
+}
+
+// isBodyTooLarge reports whether err came from reading past limitBody.
+func isBodyTooLarge(err error) bool {
+	return errors.Is(err, errBodyTooLarge)
+}
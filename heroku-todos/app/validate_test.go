@@ -0,0 +1,97 @@
+package app
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTodoInputValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+		code  string
+	}{
+		{"trimmed", "  Buy milk \t", "Buy milk", ""},
+		{"required", "", "", "required"},
+		{"blank", "   ", "", "required"},
+		{"normalized", "café", "café", ""},
+		{"max length", strings.Repeat("가", maxTodoNameLength), strings.Repeat("가", maxTodoNameLength), ""},
+		{"too long", strings.Repeat("a", maxTodoNameLength+1), "", "too_long"},
+		{"length after normalization", strings.Repeat("é", maxTodoNameLength), strings.Repeat("é", maxTodoNameLength), ""},
+		{"newline", "Buy\nmilk", "", "control_character"},
+		{"nul", "Buy\x00milk", "", "control_character"},
+		{"bidi override", "Buy ‮milk", "", "control_character"},
+		{"invalid utf-8", "Buy \xff milk", "", "invalid_encoding"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			input, err := TodoInput{Name: test.input}.Validate()
+			if test.code == "" {
+				assert.NoError(err)
+				assert.Equal(test.want, input.Name)
+				return
+			}
+			errs, ok := err.(ValidationErrors)
+			assert.True(ok)
+			assert.Equal([]FieldError{{Field: "name", Code: test.code, Message: errs[0].Message}}, []FieldError(errs))
+		})
+	}
+}
+
+func TestValidationOverHTTP(t *testing.T) {
+	os.Remove("./test.db")
+	assert := assert.New(t)
+	ah := MakeHandler(testConfig())
+	defer ah.Close()
+
+	ts := httptest.NewServer(ah)
+	defer ts.Close()
+	client := newTestClient()
+	devSignIn(t, client, ts.URL, url.Values{"sub": {"alice"}})
+
+	// Form and JSON input get the same rules and field errors
+	resp, err := client.PostForm(ts.URL+"/todos", url.Values{"name": {" "}})
+	assert.NoError(err)
+	problem := decodeProblem(t, resp, http.StatusUnprocessableEntity)
+	assert.Equal([]FieldError{{Field: "name", Code: "required", Message: "is required"}}, problem.Errors)
+	resp, err = client.Post(ts.URL+"/api/v1/todos", "application/json", strings.NewReader(`{"name": "a\u0007"}`))
+	assert.NoError(err)
+	problem = decodeProblem(t, resp, http.StatusUnprocessableEntity)
+	assert.Equal("control_character", problem.Errors[0].Code)
+
+	resp, err = client.PostForm(ts.URL+"/todos", url.Values{"name": {"  café "}})
+	assert.NoError(err)
+	assert.Equal(http.StatusCreated, resp.StatusCode)
+	var todo struct{ Name string }
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&todo))
+	assert.Equal("café", todo.Name)
+
+	// Bodies over the limit are refused, whether or not their size is known
+	huge := `{"name": "` + strings.Repeat("a", maxBodyBytes) + `"}`
+	resp, err = client.Post(ts.URL+"/api/v1/todos", "application/json", strings.NewReader(huge))
+	assert.NoError(err)
+	decodeProblem(t, resp, http.StatusRequestEntityTooLarge)
+	resp, err = client.Post(ts.URL+"/api/v1/todos", "application/json", struct{ io.Reader }{strings.NewReader(huge)})
+	assert.NoError(err)
+	decodeProblem(t, resp, http.StatusRequestEntityTooLarge)
+	resp, err = client.PostForm(ts.URL+"/todos", url.Values{"name": {strings.Repeat("a", maxBodyBytes)}})
+	assert.NoError(err)
+	assert.Equal(http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	// Forms are measured before they are searched for a CSRF token
+	form := url.Values{"name": {strings.Repeat("a", maxBodyBytes)}}.Encode()
+	noCSRF := &http.Client{Jar: client.Jar}
+	resp, err = noCSRF.Post(ts.URL+"/todos", "application/x-www-form-urlencoded", struct{ io.Reader }{strings.NewReader(form)})
+	assert.NoError(err)
+	assert.Equal(http.StatusRequestEntityTooLarge, resp.StatusCode)
+}
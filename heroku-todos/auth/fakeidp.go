@@ -0,0 +1,336 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeIdPHost is where the app reaches a FakeIdP for tokens, userinfo and
+// keys. Those requests never leave the process.
+const fakeIdPHost = "http://fake-idp.invalid"
+
+// Like a real provider's, codes are good for a minute and tokens for a few.
+// The app only uses a token to fetch userinfo right after the exchange.
+const (
+	fakeIdPClientID = "dev"
+	fakeIdPCodeTTL  = time.Minute
+	fakeIdPTokenTTL = 5 * time.Minute
+)
+
+// FakeIdP is an OpenID provider for local development and tests. Its
+// authorize page lets whoever opens it sign in as any identity they type
+// in, so it must never be enabled in production.
+type FakeIdP struct {
+	path   string
+	issuer string
+	key    *rsa.PrivateKey
+	now    func() time.Time
+
+	mu     sync.Mutex
+	codes  map[string]*fakeGrant
+	tokens map[string]*fakeToken
+}
+
+type fakeGrant struct {
+	redirectURI string
+	challenge   string
+	claims      IDTokenClaims
+	expires     time.Time
+}
+
+type fakeToken struct {
+	claims  *IDTokenClaims
+	expires time.Time
+}
+
+// NewFakeIdP returns a fake provider to be mounted at path, which browsers
+// are sent to for the authorize page.
+func NewFakeIdP(path string) *FakeIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return &FakeIdP{
+		path:   strings.TrimSuffix(path, "/"),
+		issuer: fakeIdPHost + strings.TrimSuffix(path, "/"),
+		key:    key,
+		now:    time.Now,
+		codes:  map[string]*fakeGrant{},
+		tokens: map[string]*fakeToken{},
+	}
+}
+
+// expire forgets the codes and tokens past their expiry, which would
+// otherwise pile up when they aren't used. f.mu must be held.
+func (f *FakeIdP) expire(now time.Time) {
+	for code, grant := range f.codes {
+		if now.After(grant.expires) {
+			delete(f.codes, code)
+		}
+	}
+	for token, issued := range f.tokens {
+		if now.After(issued.expires) {
+			delete(f.tokens, token)
+		}
+	}
+}
+
+// Provider returns the provider named "dev" that signs in through f.
+func (f *FakeIdP) Provider(redirectURL string) IDTokenProvider {
+	client := &http.Client{Transport: handlerTransport{f}}
+	p := newOIDCProvider("dev", f.discovery(), []string{f.issuer}, fakeIdPClientID, "", redirectURL)
+	p.client = client
+	p.verifier.Keys.client = client
+	return p
+}
+
+func (f *FakeIdP) discovery() *OIDCDiscovery {
+	return &OIDCDiscovery{
+		Issuer:                f.issuer,
+		AuthorizationEndpoint: f.path + "/authorize",
+		TokenEndpoint:         f.issuer + "/token",
+		UserinfoEndpoint:      f.issuer + "/userinfo",
+		JwksURI:               f.issuer + "/jwks",
+	}
+}
+
+func (f *FakeIdP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimPrefix(r.URL.Path, f.path) {
+	case "/.well-known/openid-configuration":
+		writeJSON(w, http.StatusOK, f.discovery())
+	case "/authorize":
+		f.authorize(w, r)
+	case "/token":
+		f.token(w, r)
+	case "/userinfo":
+		f.userinfo(w, r)
+	case "/jwks":
+		writeJSON(w, http.StatusOK, JSONWebKeySet{Keys: []JSONWebKey{{
+			Kty: "RSA",
+			Kid: "dev",
+			Use: "sig",
+			Alg: "RS256",
+			N:   base64.RawURLEncoding.EncodeToString(f.key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(f.key.E)).Bytes()),
+		}}})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+var fakeAuthorizeTemplate = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Development sign in</title></head>
+<body>
+<h1>Development sign in</h1>
+<p>Sign in to the app as any identity. This provider is for local development only.</p>
+<form method="get">
+{{range $name, $values := .Params}}{{range $values}}<input type="hidden" name="{{$name}}" value="{{.}}">
+{{end}}{{end}}<p><label>Subject <input name="sub" value="dev-user" required></label></p>
+<p><label>Email <input name="email" type="email" value="dev@example.com"></label></p>
+<p><label>Name <input name="name" value="Dev User"></label></p>
+<p><label>Picture URL <input name="picture" type="url"></label></p>
+<button type="submit">Sign in</button>
+</form>
+</body>
+</html>
+`))
+
+// authorize shows a form to pick an identity, and issues a code for it once
+// the form comes back with a subject.
+func (f *FakeIdP) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("response_type") != "code" || query.Get("client_id") != fakeIdPClientID || query.Get("redirect_uri") == "" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+	if query.Get("code_challenge") == "" || query.Get("code_challenge_method") != "S256" {
+		http.Error(w, "PKCE with S256 is required", http.StatusBadRequest)
+		return
+	}
+	if query.Get("sub") == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fakeAuthorizeTemplate.Execute(w, map[string]url.Values{"Params": query})
+		return
+	}
+
+	now := f.now()
+	code := randomString()
+	f.mu.Lock()
+	f.expire(now)
+	f.codes[code] = &fakeGrant{
+		redirectURI: query.Get("redirect_uri"),
+		challenge:   query.Get("code_challenge"),
+		claims: IDTokenClaims{
+			Issuer:        f.issuer,
+			Subject:       query.Get("sub"),
+			Audience:      Audience{fakeIdPClientID},
+			IssuedAt:      now.Unix(),
+			Expiry:        now.Add(fakeIdPTokenTTL).Unix(),
+			Nonce:         query.Get("nonce"),
+			Email:         query.Get("email"),
+			EmailVerified: query.Get("email") != "",
+			Name:          query.Get("name"),
+			Picture:       query.Get("picture"),
+		},
+		expires: now.Add(fakeIdPCodeTTL),
+	}
+	f.mu.Unlock()
+
+	redirect, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	params := redirect.Query()
+	params.Set("code", code)
+	params.Set("state", query.Get("state"))
+	redirect.RawQuery = params.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (f *FakeIdP) token(w http.ResponseWriter, r *http.Request) {
+	code := r.PostFormValue("code")
+	now := f.now()
+	f.mu.Lock()
+	f.expire(now)
+	grant := f.codes[code]
+	delete(f.codes, code)
+	f.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+	if r.PostFormValue("grant_type") != "authorization_code" || grant == nil ||
+		r.PostFormValue("redirect_uri") != grant.redirectURI ||
+		subtle.ConstantTimeCompare([]byte(challenge), []byte(grant.challenge)) != 1 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	idToken, err := f.sign(&grant.claims)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	accessToken := randomString()
+	f.mu.Lock()
+	f.tokens[accessToken] = &fakeToken{claims: &grant.claims, expires: now.Add(fakeIdPTokenTTL)}
+	f.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(fakeIdPTokenTTL / time.Second),
+		"id_token":     idToken,
+	})
+}
+
+func (f *FakeIdP) userinfo(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.expire(f.now())
+	issued := f.tokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+	f.mu.Unlock()
+	if issued == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	claims := issued.claims
+	writeJSON(w, http.StatusOK, OIDCUserInfo{
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified,
+		Name:          claims.Name,
+		Picture:       claims.Picture,
+	})
+}
+
+func (f *FakeIdP) sign(claims *IDTokenClaims) (string, error) {
+	header, err := json.Marshal(jwtHeader{Alg: "RS256", Kid: "dev"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, f.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// handlerTransport serves requests with a handler in the same process.
+type handlerTransport struct {
+	handler http.Handler
+}
+
+func (t handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	w := &bufferedResponse{header: http.Header{}}
+	t.handler.ServeHTTP(w, req)
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(w.status) + " " + http.StatusText(w.status),
+		StatusCode:    w.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.header,
+		Body:          ioutil.NopCloser(&w.body),
+		ContentLength: int64(w.body.Len()),
+		Request:       req,
+	}, nil
+}
+
+// bufferedResponse keeps what a handler writes for handlerTransport.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponse) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponse) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *bufferedResponse) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomString() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
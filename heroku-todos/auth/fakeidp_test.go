@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFakeIdPExpiry(t *testing.T) {
+	assert := assert.New(t)
+	f := NewFakeIdP("/dev-idp")
+	clock := time.Now()
+	f.now = func() time.Time { return clock }
+
+	verifier := randomString()
+	sum := sha256.Sum256([]byte(verifier))
+	authorize := func() string {
+		req := httptest.NewRequest("GET", "/dev-idp/authorize?"+url.Values{
+			"response_type":         {"code"},
+			"client_id":             {fakeIdPClientID},
+			"redirect_uri":          {"http://app.example/callback"},
+			"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+			"code_challenge_method": {"S256"},
+			"sub":                   {"alice"},
+		}.Encode(), nil)
+		res := httptest.NewRecorder()
+		f.ServeHTTP(res, req)
+		assert.Equal(http.StatusFound, res.Code)
+		location, _ := url.Parse(res.Header().Get("Location"))
+		return location.Query().Get("code")
+	}
+	exchange := func(code string) (int, string) {
+		req := httptest.NewRequest("POST", "/dev-idp/token", strings.NewReader(url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {code},
+			"redirect_uri":  {"http://app.example/callback"},
+			"code_verifier": {verifier},
+		}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		res := httptest.NewRecorder()
+		f.ServeHTTP(res, req)
+		var body struct {
+			AccessToken string `json:"access_token"`
+		}
+		json.NewDecoder(res.Body).Decode(&body)
+		return res.Code, body.AccessToken
+	}
+	userinfo := func(token string) int {
+		req := httptest.NewRequest("GET", "/dev-idp/userinfo", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		res := httptest.NewRecorder()
+		f.ServeHTTP(res, req)
+		return res.Code
+	}
+
+	// Codes left unused expire and are forgotten
+	code := authorize()
+	clock = clock.Add(fakeIdPCodeTTL + time.Second)
+	status, _ := exchange(code)
+	assert.Equal(http.StatusBadRequest, status)
+	assert.Empty(f.codes)
+
+	status, token := exchange(authorize())
+	assert.Equal(http.StatusOK, status)
+	assert.Equal(http.StatusOK, userinfo(token))
+	clock = clock.Add(fakeIdPTokenTTL + time.Second)
+	assert.Equal(http.StatusUnauthorized, userinfo(token))
+	assert.Empty(f.tokens)
+}
+
+func TestFakeIdPTransport(t *testing.T) {
+	assert := assert.New(t)
+	f := NewFakeIdP("/dev-idp")
+	client := &http.Client{Transport: handlerTransport{f}}
+
+	resp, err := client.Get(fakeIdPHost + "/dev-idp/jwks")
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("application/json", resp.Header.Get("Content-Type"))
+	var keys JSONWebKeySet
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&keys))
+	assert.Len(keys.Keys, 1)
+
+	resp, err = client.Get(fakeIdPHost + "/dev-idp/nothing")
+	assert.NoError(err)
+	assert.Equal(http.StatusNotFound, resp.StatusCode)
+}
@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"context"
+	"strconv"
+
+	"tuckersWeb/todos/model"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/github"
+)
+
+type GithubUser struct {
+	ID        int64  `json:"id"`
+	Login     string `json:"login"`
+	Name      string `json:"name"`
+	Email     string `json:"email"`
+	AvatarURL string `json:"avatar_url"`
+}
+
+type GithubEmail struct {
+	Email    string `json:"email"`
+	Primary  bool   `json:"primary"`
+	Verified bool   `json:"verified"`
+}
+
+const (
+	oauthGithubUserAPI   = "https://api.github.com/user"
+	oauthGithubEmailsAPI = "https://api.github.com/user/emails"
+)
+
+type githubProvider struct {
+	oauth2Provider
+}
+
+func NewGithubProvider(clientID, clientSecret, redirectURL string) Provider {
+	return &githubProvider{oauth2Provider{
+		name: "github",
+		config: &oauth2.Config{
+			RedirectURL:  redirectURL,
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Scopes:       []string{"read:user", "user:email"},
+			Endpoint:     github.Endpoint,
+		},
+	}}
+}
+
+func (p *githubProvider) FetchIdentity(ctx context.Context, token *oauth2.Token) (*model.Identity, error) {
+	var user GithubUser
+	if err := p.getJSON(ctx, token, oauthGithubUserAPI, &user); err != nil {
+		return nil, err
+	}
+
+	// The public profile email is optional, so fall back to the primary
+	// verified address.
+	email := user.Email
+	if email == "" {
+		var emails []GithubEmail
+		if err := p.getJSON(ctx, token, oauthGithubEmailsAPI, &emails); err != nil {
+			return nil, err
+		}
+		for _, e := range emails {
+			if e.Primary && e.Verified {
+				email = e.Email
+			}
+		}
+	}
+
+	name := user.Name
+	if name == "" {
+		name = user.Login
+	}
+	return &model.Identity{
+		Provider: p.name,
+		Subject:  strconv.FormatInt(user.ID, 10),
+		Email:    email,
+		Name:     name,
+		Picture:  user.AvatarURL,
+	}, nil
+}
@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testIssuer publishes its current keys and signs ID tokens with them.
+type testIssuer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	keys    map[string]crypto.Signer
+	fetches int
+}
+
+func newTestIssuer() *testIssuer {
+	iss := &testIssuer{keys: map[string]crypto.Signer{}}
+	iss.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		iss.mu.Lock()
+		defer iss.mu.Unlock()
+		iss.fetches++
+		set := JSONWebKeySet{Keys: []JSONWebKey{}}
+		for kid, key := range iss.keys {
+			switch pub := key.Public().(type) {
+			case *rsa.PublicKey:
+				set.Keys = append(set.Keys, JSONWebKey{Kty: "RSA", Kid: kid, Use: "sig",
+					N: encodeBigInt(pub.N), E: encodeBigInt(big.NewInt(int64(pub.E)))})
+			case *ecdsa.PublicKey:
+				set.Keys = append(set.Keys, JSONWebKey{Kty: "EC", Kid: kid, Use: "sig", Crv: "P-256",
+					X: encodeBigInt(pub.X), Y: encodeBigInt(pub.Y)})
+			}
+		}
+		json.NewEncoder(w).Encode(set)
+	}))
+	return iss
+}
+
+func (iss *testIssuer) setKey(kid string, key crypto.Signer) {
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	iss.keys = map[string]crypto.Signer{kid: key}
+}
+
+func (iss *testIssuer) sign(t *testing.T, alg, kid string, key crypto.Signer, claims *IDTokenClaims) string {
+	header, _ := json.Marshal(jwtHeader{Alg: alg, Kid: kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		assert.NoError(t, err)
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (iss *testIssuer) claims(nonce string) *IDTokenClaims {
+	now := time.Now()
+	return &IDTokenClaims{
+		Issuer:   iss.URL,
+		Subject:  "alice",
+		Audience: Audience{"client"},
+		Expiry:   now.Add(time.Hour).Unix(),
+		IssuedAt: now.Unix(),
+		Nonce:    nonce,
+		Email:    "alice@example.com",
+	}
+}
+
+func encodeBigInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+func TestIDTokenVerifier(t *testing.T) {
+	assert := assert.New(t)
+	iss := newTestIssuer()
+	defer iss.Close()
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	iss.setKey("rsa", rsaKey)
+
+	verifier := &IDTokenVerifier{Issuers: []string{iss.URL}, ClientID: "client", Keys: NewKeySet(iss.URL)}
+	ctx := context.Background()
+
+	claims, err := verifier.Verify(ctx, iss.sign(t, "RS256", "rsa", rsaKey, iss.claims("n1")), "n1")
+	assert.NoError(err)
+	assert.Equal("alice", claims.Subject)
+	assert.Equal("alice@example.com", claims.Email)
+
+	for name, edit := range map[string]func(c *IDTokenClaims){
+		"issuer":   func(c *IDTokenClaims) { c.Issuer = "https://evil.example.com" },
+		"audience": func(c *IDTokenClaims) { c.Audience = Audience{"other"} },
+		"azp":      func(c *IDTokenClaims) { c.Audience = Audience{"client", "other"}; c.AuthorizedParty = "other" },
+		"expired":  func(c *IDTokenClaims) { c.Expiry = time.Now().Add(-time.Hour).Unix() },
+		"future":   func(c *IDTokenClaims) { c.IssuedAt = time.Now().Add(time.Hour).Unix() },
+		"nonce":    func(c *IDTokenClaims) { c.Nonce = "n2" },
+		"subject":  func(c *IDTokenClaims) { c.Subject = "" },
+	} {
+		c := iss.claims("n1")
+		edit(c)
+		_, err := verifier.Verify(ctx, iss.sign(t, "RS256", "rsa", rsaKey, c), "n1")
+		assert.Error(err, name)
+	}
+
+	// Several audiences are fine when the token was authorized for us
+	c := iss.claims("n1")
+	c.Audience = Audience{"client", "other"}
+	c.AuthorizedParty = "client"
+	_, err = verifier.Verify(ctx, iss.sign(t, "RS256", "rsa", rsaKey, c), "n1")
+	assert.NoError(err)
+
+	// Signatures by other keys, or tokens claiming another algorithm, fail
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, err = verifier.Verify(ctx, iss.sign(t, "RS256", "rsa", otherKey, iss.claims("n1")), "n1")
+	assert.Error(err)
+	_, err = verifier.Verify(ctx, iss.sign(t, "ES256", "rsa", rsaKey, iss.claims("n1")), "n1")
+	assert.Error(err)
+	unsigned := iss.sign(t, "none", "rsa", rsaKey, iss.claims("n1"))
+	_, err = verifier.Verify(ctx, unsigned[:len(unsigned)-1], "n1")
+	assert.Error(err)
+	_, err = verifier.Verify(ctx, "not a token", "n1")
+	assert.Error(err)
+	assert.Equal(1, iss.fetches)
+
+	// The issuer rolls over to an EC key, which is fetched once
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	iss.setKey("ec", ecKey)
+	verifier.Keys.fetched = time.Now().Add(-keySetMinRefresh)
+	_, err = verifier.Verify(ctx, iss.sign(t, "ES256", "ec", ecKey, iss.claims("n1")), "n1")
+	assert.NoError(err)
+	_, err = verifier.Verify(ctx, iss.sign(t, "ES256", "ec", ecKey, iss.claims("n1")), "n1")
+	assert.NoError(err)
+	assert.Equal(2, iss.fetches)
+
+	// Unknown key ids don't refetch more than once a minute
+	_, err = verifier.Verify(ctx, iss.sign(t, "RS256", "rsa", rsaKey, iss.claims("n1")), "n1")
+	assert.Error(err)
+	_, err = verifier.Verify(ctx, iss.sign(t, "RS256", "made-up", rsaKey, iss.claims("n1")), "n1")
+	assert.Error(err)
+	assert.Equal(2, iss.fetches)
+}
@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"tuckersWeb/todos/model"
+
+	"golang.org/x/oauth2"
+)
+
+// OIDCDiscovery is the subset of an OpenID Provider's
+// /.well-known/openid-configuration document that sign-in needs.
+type OIDCDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+type OIDCUserInfo struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+	Picture       string `json:"picture"`
+}
+
+type oidcProvider struct {
+	oauth2Provider
+	discovery OIDCDiscovery
+	verifier  *IDTokenVerifier
+}
+
+// NewOIDCProvider discovers the issuer's endpoints and returns a provider
+// registered under name.
+func NewOIDCProvider(ctx context.Context, name, issuer, clientID, clientSecret, redirectURL string) (IDTokenProvider, error) {
+	discovery, err := discover(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+	if discovery.JwksURI == "" {
+		return nil, fmt.Errorf("issuer %s publishes no jwks_uri", issuer)
+	}
+	return newOIDCProvider(name, discovery, []string{discovery.Issuer}, clientID, clientSecret, redirectURL), nil
+}
+
+func newOIDCProvider(name string, discovery *OIDCDiscovery, issuers []string, clientID, clientSecret, redirectURL string) *oidcProvider {
+	return &oidcProvider{
+		oauth2Provider: oauth2Provider{
+			name: name,
+			config: &oauth2.Config{
+				RedirectURL:  redirectURL,
+				ClientID:     clientID,
+				ClientSecret: clientSecret,
+				Scopes:       []string{"openid", "email", "profile"},
+				Endpoint: oauth2.Endpoint{
+					AuthURL:  discovery.AuthorizationEndpoint,
+					TokenURL: discovery.TokenEndpoint,
+				},
+			},
+		},
+		discovery: *discovery,
+		verifier: &IDTokenVerifier{
+			Issuers:  issuers,
+			ClientID: clientID,
+			Keys:     NewKeySet(discovery.JwksURI),
+		},
+	}
+}
+
+func discover(ctx context.Context, issuer string) (*OIDCDiscovery, error) {
+	url := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to discover %s %s", issuer, err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to discover %s status:%d", issuer, resp.StatusCode)
+	}
+
+	var discovery OIDCDiscovery
+	if err := json.NewDecoder(resp.Body).Decode(&discovery); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != strings.TrimSuffix(issuer, "/") {
+		return nil, fmt.Errorf("issuer mismatch: configured %s, discovered %s", issuer, discovery.Issuer)
+	}
+	return &discovery, nil
+}
+
+func (p *oidcProvider) FetchIdentity(ctx context.Context, token *oauth2.Token) (*model.Identity, error) {
+	var userInfo OIDCUserInfo
+	if err := p.getJSON(ctx, token, p.discovery.UserinfoEndpoint, &userInfo); err != nil {
+		return nil, err
+	}
+	if userInfo.Subject == "" {
+		return nil, fmt.Errorf("userinfo response from %s has no subject", p.name)
+	}
+	return &model.Identity{
+		Provider: p.name,
+		Subject:  userInfo.Subject,
+		Email:    userInfo.Email,
+		Name:     userInfo.Name,
+		Picture:  userInfo.Picture,
+	}, nil
+}
+
+// VerifyIdentity signs the user in with the ID token that came with token.
+// The userinfo endpoint is only asked when the ID token carries no email.
+func (p *oidcProvider) VerifyIdentity(ctx context.Context, token *oauth2.Token, nonce string) (*model.Identity, error) {
+	raw, _ := token.Extra("id_token").(string)
+	if raw == "" {
+		return nil, fmt.Errorf("token response from %s has no ID token", p.name)
+	}
+	claims, err := p.verifier.Verify(ctx, raw, nonce)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s ID token: %s", p.name, err.Error())
+	}
+	identity := &model.Identity{
+		Provider: p.name,
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+		Name:     claims.Name,
+		Picture:  claims.Picture,
+	}
+	if identity.Email == "" && p.discovery.UserinfoEndpoint != "" {
+		userInfo, err := p.FetchIdentity(ctx, token)
+		if err != nil {
+			return nil, err
+		}
+		if userInfo.Subject != identity.Subject {
+			return nil, fmt.Errorf("userinfo subject from %s doesn't match the ID token", p.name)
+		}
+		userInfo.Name = firstNonEmpty(identity.Name, userInfo.Name)
+		userInfo.Picture = firstNonEmpty(identity.Picture, userInfo.Picture)
+		identity = userInfo
+	}
+	return identity, nil
+}
+
+func firstNonEmpty(a, b string) string {
+	if a != "" {
+		return a
+	}
+	return b
+}
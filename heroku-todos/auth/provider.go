@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"tuckersWeb/todos/model"
+
+	"golang.org/x/oauth2"
+)
+
+// Provider is an OAuth2 identity provider that users can sign in with.
+type Provider interface {
+	Name() string
+	AuthCodeURL(state string, opts ...oauth2.AuthCodeOption) string
+	Exchange(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error)
+	// FetchIdentity maps the provider's profile of the token owner to an
+	// identity that can be linked to a user.
+	FetchIdentity(ctx context.Context, token *oauth2.Token) (*model.Identity, error)
+}
+
+// IDTokenProvider is an OpenID Connect provider, which vouches for the user
+// with a signed ID token carrying the nonce sent with AuthCodeURL.
+type IDTokenProvider interface {
+	Provider
+	VerifyIdentity(ctx context.Context, token *oauth2.Token, nonce string) (*model.Identity, error)
+}
+
+type Registry struct {
+	providers map[string]Provider
+}
+
+func NewRegistry() *Registry {
+	return &Registry{providers: make(map[string]Provider)}
+}
+
+func (r *Registry) Register(p Provider) {
+	r.providers[p.Name()] = p
+}
+
+func (r *Registry) Get(name string) (Provider, bool) {
+	p, ok := r.providers[name]
+	return p, ok
+}
+
+func (r *Registry) Names() []string {
+	names := []string{}
+	for name := range r.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// oauth2Provider implements the token half of Provider on top of an
+// oauth2.Config, leaving the profile lookup to each provider.
+type oauth2Provider struct {
+	name   string
+	config *oauth2.Config
+	// client talks to the provider, http.DefaultClient when nil
+	client *http.Client
+}
+
+func (p *oauth2Provider) httpClient() *http.Client {
+	if p.client != nil {
+		return p.client
+	}
+	return http.DefaultClient
+}
+
+func (p *oauth2Provider) Name() string {
+	return p.name
+}
+
+func (p *oauth2Provider) AuthCodeURL(state string, opts ...oauth2.AuthCodeOption) string {
+	return p.config.AuthCodeURL(state, opts...)
+}
+
+func (p *oauth2Provider) Exchange(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	if p.client != nil {
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, p.client)
+	}
+	token, err := p.config.Exchange(ctx, code, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to Exchange %s", err.Error())
+	}
+	return token, nil
+}
+
+// getJSON fetches url with the token as bearer credentials and decodes the
+// JSON response into v.
+func (p *oauth2Provider) getJSON(ctx context.Context, token *oauth2.Token, url string, v interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	token.SetAuthHeader(req)
+
+	resp, err := p.httpClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("Failed to Get %s %s", url, err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed to Get %s status:%d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
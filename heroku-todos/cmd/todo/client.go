@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const apiPrefix = "/api/v1"
+
+// todo, user and problem mirror the JSON of the API.
+type todo struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Completed bool      `json:"completed"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type user struct {
+	ID    int    `json:"id"`
+	Email string `json:"email"`
+	Name  string `json:"name"`
+}
+
+type problem struct {
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail"`
+	Errors []struct {
+		Field   string `json:"field"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+func (p *problem) Error() string {
+	msg := p.Detail
+	if msg == "" {
+		msg = p.Title
+	}
+	for _, e := range p.Errors {
+		msg += fmt.Sprintf("\n  %s: %s", e.Field, e.Message)
+	}
+	if p.Status == http.StatusUnauthorized {
+		msg += " (run todo login)"
+	}
+	return msg
+}
+
+// client calls the API of server with an access token.
+type client struct {
+	server string
+	token  string
+	http   *http.Client
+}
+
+var errSignedOut = errors.New("not signed in, run todo login first")
+
+// client signs in with the stored credentials.
+func (c *cli) client() (*client, error) {
+	creds, err := c.loadCredentials()
+	if err != nil {
+		return nil, err
+	}
+	if creds.Token == "" {
+		return nil, errSignedOut
+	}
+	return &client{server: creds.Server, token: creds.Token, http: c.http}, nil
+}
+
+// do sends body as JSON to the API path and decodes the response into out.
+// Problems come back as a *problem error.
+func (cl *client) do(method, path string, body, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(cl.server, "/")+apiPrefix+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer "+cl.token)
+
+	resp, err := cl.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		p := &problem{Status: resp.StatusCode, Title: resp.Status}
+		if mediaType == "application/problem+json" {
+			json.NewDecoder(resp.Body).Decode(p)
+		}
+		return p
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (cl *client) todos() ([]*todo, error) {
+	var todos []*todo
+	err := cl.do("GET", "/todos", nil, &todos)
+	sort.Slice(todos, func(i, j int) bool { return todos[i].ID < todos[j].ID })
+	return todos, err
+}
+
+func (cl *client) me() (*user, error) {
+	var me user
+	err := cl.do("GET", "/me", nil, &me)
+	return &me, err
+}
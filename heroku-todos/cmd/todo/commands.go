@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+func (c *cli) add(args []string) error {
+	name := strings.Join(args, " ")
+	if name == "" {
+		return errUsage
+	}
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	var added todo
+	if err := cl.do("POST", "/todos", map[string]string{"name": name}, &added); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stdout, "Added %d: %s\n", added.ID, added.Name)
+	return nil
+}
+
+func (c *cli) list(args []string) error {
+	fs := flag.NewFlagSet("ls", flag.ContinueOnError)
+	done := fs.Bool("done", false, "only list completed todos")
+	open := fs.Bool("open", false, "only list todos that aren't completed")
+	search := fs.String("search", "", "only list todos whose name contains this text")
+	output := fs.String("output", "table", "output format, table or json")
+	args, err := c.flags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 0 || (*done && *open) || (*output != "table" && *output != "json") {
+		return errUsage
+	}
+
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	todos, err := cl.todos()
+	if err != nil {
+		return err
+	}
+	needle := strings.ToLower(*search)
+	shown := []*todo{}
+	for _, t := range todos {
+		if (*done && !t.Completed) || (*open && t.Completed) {
+			continue
+		}
+		if !strings.Contains(strings.ToLower(t.Name), needle) {
+			continue
+		}
+		shown = append(shown, t)
+	}
+
+	if *output == "json" {
+		return c.printJSON(shown)
+	}
+	w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tDONE\tNAME")
+	for _, t := range shown {
+		mark := " "
+		if t.Completed {
+			mark = "x"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", t.ID, mark, t.Name)
+	}
+	return w.Flush()
+}
+
+// eachID calls f with each of the todo IDs in args.
+func (c *cli) eachID(args []string, f func(*client, int) error) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	var ids []int
+	for _, arg := range args {
+		id, err := strconv.Atoi(arg)
+		if err != nil {
+			return fmt.Errorf("%q is not a todo ID", arg)
+		}
+		ids = append(ids, id)
+	}
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := f(cl, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cli) done(args []string) error {
+	return c.eachID(args, func(cl *client, id int) error {
+		return cl.do("PUT", "/todos/"+strconv.Itoa(id)+"/completion", nil, nil)
+	})
+}
+
+func (c *cli) undo(args []string) error {
+	return c.eachID(args, func(cl *client, id int) error {
+		return cl.do("DELETE", "/todos/"+strconv.Itoa(id)+"/completion", nil, nil)
+	})
+}
+
+func (c *cli) remove(args []string) error {
+	return c.eachID(args, func(cl *client, id int) error {
+		return cl.do("DELETE", "/todos/"+strconv.Itoa(id), nil, nil)
+	})
+}
+
+func (c *cli) edit(args []string) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+	return c.eachID(args[:1], func(cl *client, id int) error {
+		var edited todo
+		err := cl.do("PATCH", "/todos/"+strconv.Itoa(id), map[string]string{"name": strings.Join(args[1:], " ")}, &edited)
+		if err == nil {
+			fmt.Fprintf(c.stdout, "Renamed %d: %s\n", edited.ID, edited.Name)
+		}
+		return err
+	})
+}
+
+// export prints every todo as JSON, which import reads back.
+func (c *cli) export(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	todos, err := cl.todos()
+	if err != nil {
+		return err
+	}
+	return c.printJSON(todos)
+}
+
+// importTodos adds the todos of a JSON array, such as one printed by
+// export, in order. Only their names and completion are kept.
+func (c *cli) importTodos(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	var b []byte
+	var err error
+	if args[0] == "-" {
+		b, err = ioutil.ReadAll(c.stdin)
+	} else {
+		b, err = ioutil.ReadFile(args[0])
+	}
+	if err != nil {
+		return err
+	}
+	var todos []*todo
+	if err := json.Unmarshal(b, &todos); err != nil {
+		return fmt.Errorf("reading %s: %v", args[0], err)
+	}
+	for _, t := range todos {
+		if strings.TrimSpace(t.Name) == "" {
+			return errors.New("every todo to import needs a name")
+		}
+	}
+
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	for i, t := range todos {
+		var added todo
+		if err := cl.do("POST", "/todos", map[string]string{"name": t.Name}, &added); err != nil {
+			return fmt.Errorf("imported %d of %d todos: %v", i, len(todos), err)
+		}
+		if t.Completed {
+			if err := cl.do("PUT", "/todos/"+strconv.Itoa(added.ID)+"/completion", nil, nil); err != nil {
+				return fmt.Errorf("imported %d of %d todos: %v", i, len(todos), err)
+			}
+		}
+	}
+	fmt.Fprintf(c.stdout, "Imported %d todos\n", len(todos))
+	return nil
+}
+
+func (c *cli) printJSON(v interface{}) error {
+	enc := json.NewEncoder(c.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	defaultServer = "http://localhost:5000"
+	// loginTimeout is how long login waits for the browser to come back.
+	loginTimeout = 5 * time.Minute
+)
+
+// credentials are stored as JSON in the config dir, readable only by the
+// user.
+type credentials struct {
+	Server string `json:"server"`
+	Token  string `json:"token"`
+}
+
+func (c *cli) credentialsPath() string {
+	return filepath.Join(c.configDir, "credentials.json")
+}
+
+// loadCredentials reads the stored credentials, which TODO_SERVER and
+// TODO_TOKEN override.
+func (c *cli) loadCredentials() (*credentials, error) {
+	creds := &credentials{}
+	b, err := ioutil.ReadFile(c.credentialsPath())
+	if err == nil {
+		if err := json.Unmarshal(b, creds); err != nil {
+			return nil, fmt.Errorf("reading %s: %v", c.credentialsPath(), err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if server := c.getenv("TODO_SERVER"); server != "" {
+		creds.Server = server
+	}
+	if token := c.getenv("TODO_TOKEN"); token != "" {
+		creds.Token = token
+	}
+	if creds.Server == "" {
+		creds.Server = defaultServer
+	}
+	return creds, nil
+}
+
+func (c *cli) saveCredentials(creds *credentials) error {
+	if err := os.MkdirAll(c.configDir, 0700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(creds, "", "  ")
+	if err != nil {
+		return err
+	}
+	// The new file replaces the old one, which may have been readable by
+	// others, rather than being written into it.
+	f, err := ioutil.TempFile(c.configDir, "credentials-*.json")
+	if err != nil {
+		return err
+	}
+	// TempFile creates the file readable only by the user
+	defer os.Remove(f.Name())
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.credentialsPath())
+}
+
+func (c *cli) login(args []string) error {
+	creds, err := c.loadCredentials()
+	if err != nil {
+		return err
+	}
+	fs := flag.NewFlagSet("login", flag.ContinueOnError)
+	server := fs.String("server", creds.Server, "URL of the heroku-todos server")
+	token := fs.String("token", "", "access token to sign in with instead of the browser")
+	hostname, _ := os.Hostname()
+	name := fs.String("name", "todo CLI on "+hostname, "name of the access token created by signing in in the browser")
+	if args, err = c.flags(fs, args); err != nil {
+		return err
+	}
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	creds = &credentials{Server: strings.TrimSuffix(*server, "/"), Token: *token}
+	if creds.Token == "" {
+		if creds.Token, err = c.browserLogin(creds.Server, *name); err != nil {
+			return err
+		}
+	}
+	me, err := (&client{server: creds.Server, token: creds.Token, http: c.http}).me()
+	if err != nil {
+		return err
+	}
+	if err := c.saveCredentials(creds); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stdout, "Signed in to %s as %s\n", creds.Server, me.Email)
+	return nil
+}
+
+// logout forgets the token. It stays valid until it is revoked on the
+// server's tokens page.
+func (c *cli) logout(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	err := os.Remove(c.credentialsPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// browserLogin has the user allow the client in the browser, which sends
+// a code back to a server listening on the loopback interface, and
+// exchanges the code for an access token. A PKCE verifier keeps the code
+// useless to other programs that might see it.
+func (c *cli) browserLogin(server, name string) (string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	state := randomString()
+	verifier := randomString()
+	type callback struct{ code, err string }
+	callbacks := make(chan callback, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.URL.Path != "/callback" || q.Get("state") != state {
+			http.NotFound(w, r)
+			return
+		}
+		select {
+		case callbacks <- callback{q.Get("code"), q.Get("error")}:
+		default:
+		}
+		fmt.Fprintln(w, "You can close this window and go back to the terminal.")
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	authorize := server + "/cli/authorize?" + url.Values{
+		"redirect_uri":          {"http://" + ln.Addr().String() + "/callback"},
+		"state":                 {state},
+		"code_challenge":        {codeChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+		"name":                  {name},
+	}.Encode()
+	fmt.Fprintf(c.stderr, "Opening your browser to sign in. If it doesn't open, visit\n\n  %s\n\n", authorize)
+	if err := c.openBrowser(authorize); err != nil {
+		fmt.Fprintln(c.stderr, "todo: couldn't open the browser:", err)
+	}
+
+	var cb callback
+	select {
+	case cb = <-callbacks:
+	case <-time.After(loginTimeout):
+		return "", errors.New("timed out waiting for the browser")
+	}
+	if cb.err != "" {
+		return "", fmt.Errorf("signing in failed: %s", cb.err)
+	}
+
+	resp, err := c.http.PostForm(server+"/cli/token", url.Values{
+		"code":          {cb.code},
+		"code_verifier": {verifier},
+		"name":          {name},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Token string `json:"token"`
+		Error string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("exchanging the code failed: %s %s", resp.Status, body.Error)
+	}
+	return body.Token, nil
+}
+
+func randomString() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
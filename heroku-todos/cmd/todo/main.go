@@ -0,0 +1,147 @@
+// Command todo reads and changes your todos on a heroku-todos server.
+//
+//	todo login [--server URL] [--token TOKEN]
+//	todo add Buy milk
+//	todo ls --open
+//	todo done 3
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+)
+
+const usage = `usage: todo <command> [arguments]
+
+commands:
+  login [--server URL] [--token TOKEN]   sign in, in the browser unless a token is given
+  logout                                 forget the stored credentials
+  add NAME...                            add a todo
+  ls [--done|--open] [--search TEXT] [--output table|json]
+                                         list todos
+  done ID...                             mark todos completed
+  undo ID...                             mark todos not completed
+  rm ID...                               remove todos
+  edit ID NAME...                        rename a todo
+  import FILE|-                          add the todos of a JSON export
+  export                                 print all todos as JSON
+
+The TODO_SERVER and TODO_TOKEN environment variables override the stored
+credentials.
+`
+
+// errUsage makes run print the usage and exit with 2.
+var errUsage = errors.New("invalid usage")
+
+// cli holds everything commands read and write, so that tests can replace
+// the terminal, the config dir and the browser.
+type cli struct {
+	stdin       io.Reader
+	stdout      io.Writer
+	stderr      io.Writer
+	configDir   string
+	getenv      func(string) string
+	openBrowser func(url string) error
+	http        *http.Client
+}
+
+var commands = map[string]func(*cli, []string) error{
+	"login":  (*cli).login,
+	"logout": (*cli).logout,
+	"add":    (*cli).add,
+	"ls":     (*cli).list,
+	"done":   (*cli).done,
+	"undo":   (*cli).undo,
+	"rm":     (*cli).remove,
+	"edit":   (*cli).edit,
+	"import": (*cli).importTodos,
+	"export": (*cli).export,
+}
+
+func main() {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "todo:", err)
+		os.Exit(1)
+	}
+	c := &cli{
+		stdin:       os.Stdin,
+		stdout:      os.Stdout,
+		stderr:      os.Stderr,
+		configDir:   filepath.Join(dir, "todo"),
+		getenv:      os.Getenv,
+		openBrowser: openBrowser,
+		http:        http.DefaultClient,
+	}
+	os.Exit(c.run(os.Args[1:]))
+}
+
+// run runs the command named by args[0] and returns the exit status.
+func (c *cli) run(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(c.stderr, usage)
+		return 2
+	}
+	command, ok := commands[args[0]]
+	if !ok {
+		if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+			fmt.Fprint(c.stdout, usage)
+			return 0
+		}
+		fmt.Fprintf(c.stderr, "todo: unknown command %q\n\n%s", args[0], usage)
+		return 2
+	}
+	switch err := command(c, args[1:]); err {
+	case nil:
+		return 0
+	case flag.ErrHelp:
+		return 0
+	case errUsage:
+		fmt.Fprint(c.stderr, usage)
+		return 2
+	default:
+		fmt.Fprintln(c.stderr, "todo:", err)
+		return 1
+	}
+}
+
+// flags parses the flags of a command. Flags may come after the positional
+// arguments, as in "todo ls --open".
+func (c *cli) flags(fs *flag.FlagSet, args []string) ([]string, error) {
+	fs.SetOutput(c.stderr)
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			if err == flag.ErrHelp {
+				return nil, err
+			}
+			return nil, errUsage
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	return cmd.Start()
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"tuckersWeb/todos/app"
+	"tuckersWeb/todos/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testServer(t *testing.T) (*httptest.Server, func()) {
+	os.Remove("./test.db")
+	cfg := config.Default()
+	cfg.DatabaseURL = "./test.db"
+	if dbConn := os.Getenv("DATABASE_URL"); dbConn != "" {
+		cfg.DatabaseURL = config.Secret(dbConn)
+	}
+	cfg.SessionKey = "test-session-key-0123456789abcdef"
+	cfg.DevIdP = true
+	ah := app.MakeHandler(cfg)
+	ts := httptest.NewServer(ah)
+	return ts, func() {
+		ts.Close()
+		ah.Close()
+		os.Remove("./test.db")
+	}
+}
+
+// browser signs in to the server through the development identity
+// provider and allows the client on the consent page when login opens it.
+func browser(t *testing.T, serverURL string) func(string) error {
+	assert := assert.New(t)
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	follow := func(resp *http.Response, err error) *http.Response {
+		assert.NoError(err)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := follow(client.Get(serverURL + "/auth/dev/login"))
+	authorize, _ := url.Parse(serverURL + resp.Header.Get("Location"))
+	query := authorize.Query()
+	query.Set("sub", "alice")
+	query.Set("email", "alice@example.com")
+	authorize.RawQuery = query.Encode()
+	resp = follow(client.Get(authorize.String()))
+	follow(client.Get(serverURL + resp.Header.Get("Location")))
+
+	return func(consentURL string) error {
+		resp := follow(client.Get(consentURL))
+		assert.Equal(http.StatusOK, resp.StatusCode)
+		u, _ := url.Parse(consentURL)
+		form := u.Query()
+		form.Set("approve", "true")
+		for _, c := range jar.Cookies(u) {
+			if c.Name == "XSRF-TOKEN" {
+				form.Set("csrf_token", c.Value)
+			}
+		}
+		resp = follow(client.PostForm(serverURL+u.Path, form))
+		assert.Equal(http.StatusFound, resp.StatusCode)
+		follow(http.Get(resp.Header.Get("Location")))
+		return nil
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "todo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+type testCLI struct {
+	*cli
+	env map[string]string
+}
+
+func newTestCLI(t *testing.T, openBrowser func(string) error) *testCLI {
+	c := &testCLI{env: map[string]string{}}
+	c.cli = &cli{
+		configDir:   filepath.Join(tempDir(t), "todo"),
+		getenv:      func(key string) string { return c.env[key] },
+		openBrowser: openBrowser,
+		http:        http.DefaultClient,
+	}
+	return c
+}
+
+// exec runs the command line with stdin and returns its exit status and
+// output.
+func (c *testCLI) exec(stdin string, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	c.stdin = strings.NewReader(stdin)
+	c.stdout = &stdout
+	c.stderr = &stderr
+	status := c.run(args)
+	return status, stdout.String(), stderr.String()
+}
+
+func TestCLI(t *testing.T) {
+	assert := assert.New(t)
+	ts, closeServer := testServer(t)
+	defer closeServer()
+
+	c := newTestCLI(t, browser(t, ts.URL))
+	status, _, stderr := c.exec("", "ls")
+	assert.Equal(1, status)
+	assert.Contains(stderr, "not signed in")
+
+	status, stdout, stderr := c.exec("", "login", "--server", ts.URL, "--name", "test laptop")
+	assert.Equal(0, status, stderr)
+	assert.Equal("Signed in to "+ts.URL+" as alice@example.com\n", stdout)
+	info, err := os.Stat(c.credentialsPath())
+	if assert.NoError(err) {
+		assert.Equal(os.FileMode(0600), info.Mode().Perm())
+	}
+
+	status, stdout, _ = c.exec("", "add", "Write", "the", "CLI")
+	assert.Equal(0, status)
+	assert.Equal("Added 1: Write the CLI\n", stdout)
+	c.exec("", "add", "Test the CLI")
+	c.exec("", "add", "Ship it")
+	status, _, stderr = c.exec("", "add", strings.Repeat("x", 1000))
+	assert.Equal(1, status)
+	assert.Contains(stderr, "name:")
+
+	assert.Equal(0, first(c.exec("", "done", "1", "2")))
+	assert.Equal(0, first(c.exec("", "undo", "2")))
+	status, stdout, _ = c.exec("", "edit", "3", "Ship", "the", "CLI")
+	assert.Equal(0, status)
+	assert.Equal("Renamed 3: Ship the CLI\n", stdout)
+
+	_, stdout, _ = c.exec("", "ls")
+	assert.Equal("ID  DONE  NAME\n1   x     Write the CLI\n2         Test the CLI\n3         Ship the CLI\n", stdout)
+	_, stdout, _ = c.exec("", "ls", "--open", "--search", "SHIP")
+	assert.Equal("ID  DONE  NAME\n3         Ship the CLI\n", stdout)
+	_, stdout, _ = c.exec("", "ls", "--done", "--output", "json")
+	var todos []*todo
+	assert.NoError(json.Unmarshal([]byte(stdout), &todos))
+	if assert.Len(todos, 1) {
+		assert.Equal("Write the CLI", todos[0].Name)
+		assert.True(todos[0].Completed)
+	}
+	assert.Equal(2, first(c.exec("", "ls", "--done", "--open")))
+
+	assert.Equal(0, first(c.exec("", "rm", "3")))
+	status, _, stderr = c.exec("", "rm", "3")
+	assert.Equal(1, status)
+	assert.Equal("todo: no todo with id 3\n", stderr)
+	assert.Equal(1, first(c.exec("", "done", "three")))
+
+	// An export imports as a copy of the todos
+	_, export, _ := c.exec("", "export")
+	status, stdout, _ = c.exec(export, "import", "-")
+	assert.Equal(0, status)
+	assert.Equal("Imported 2 todos\n", stdout)
+	_, stdout, _ = c.exec("", "ls", "--done")
+	assert.Equal(2, strings.Count(stdout, "Write the CLI"))
+	file := filepath.Join(tempDir(t), "todos.json")
+	ioutil.WriteFile(file, []byte(`[{"name": ""}]`), 0600)
+	assert.Equal(1, first(c.exec("", "import", file)))
+
+	assert.Equal(0, first(c.exec("", "logout")))
+	assert.Equal(1, first(c.exec("", "ls")))
+}
+
+func TestCLIToken(t *testing.T) {
+	assert := assert.New(t)
+	ts, closeServer := testServer(t)
+	defer closeServer()
+
+	// Sign in once to get a token to use elsewhere
+	browserLogin := newTestCLI(t, browser(t, ts.URL))
+	assert.Equal(0, first(browserLogin.exec("", "login", "--server", ts.URL)))
+	creds, _ := browserLogin.loadCredentials()
+
+	c := newTestCLI(t, func(string) error {
+		t.Fatal("login with a token opened the browser")
+		return nil
+	})
+	status, _, stderr := c.exec("", "login", "--server", ts.URL, "--token", "tdp_not-a-token")
+	assert.Equal(1, status)
+	assert.Contains(stderr, "todo login")
+	status, _, stderr = c.exec("", "login", "--server", ts.URL, "--token", creds.Token)
+	assert.Equal(0, status, stderr)
+	assert.Equal(0, first(c.exec("", "add", "Signed in with a token")))
+
+	// The environment overrides the stored credentials
+	env := newTestCLI(t, nil)
+	env.env["TODO_SERVER"] = ts.URL
+	env.env["TODO_TOKEN"] = creds.Token
+	_, stdout, _ := env.exec("", "ls")
+	assert.Contains(stdout, "Signed in with a token")
+
+	// The browser can refuse
+	denied := newTestCLI(t, func(consentURL string) error {
+		u, _ := url.Parse(consentURL)
+		redirect, _ := url.Parse(u.Query().Get("redirect_uri"))
+		redirect.RawQuery = url.Values{"state": {u.Query().Get("state")}, "error": {"access_denied"}}.Encode()
+		resp, err := http.Get(redirect.String())
+		assert.NoError(err)
+		resp.Body.Close()
+		return nil
+	})
+	status, _, stderr = denied.exec("", "login", "--server", ts.URL)
+	assert.Equal(1, status)
+	assert.Contains(stderr, "access_denied")
+}
+
+func first(status int, stdout, stderr string) int {
+	return status
+}
+
+func TestSaveCredentialsTightensPermissions(t *testing.T) {
+	assert := assert.New(t)
+	c := newTestCLI(t, nil)
+	assert.NoError(os.MkdirAll(c.configDir, 0700))
+	assert.NoError(ioutil.WriteFile(c.credentialsPath(), []byte("{}"), 0644))
+	assert.NoError(os.Chmod(c.credentialsPath(), 0644))
+
+	assert.NoError(c.saveCredentials(&credentials{Server: "https://todos.example.com", Token: "secret"}))
+	info, err := os.Stat(c.credentialsPath())
+	if assert.NoError(err) {
+		assert.Equal(os.FileMode(0600), info.Mode().Perm())
+	}
+	creds, err := c.loadCredentials()
+	assert.NoError(err)
+	assert.Equal("secret", creds.Token)
+	files, _ := ioutil.ReadDir(c.configDir)
+	assert.Len(files, 1)
+}
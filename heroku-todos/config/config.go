@@ -0,0 +1,420 @@
+// Package config loads the server's settings from an optional JSON file,
+// the environment and command line flags, in increasing precedence, and
+// checks them before anything starts.
+//
+// Every setting has one name used in all three places: SESSION_KEY in the
+// environment is -session-key on the command line and "session_key" in the
+// file.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	netmail "net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"tuckersWeb/todos/logging"
+)
+
+// MinSessionKeyLength is the shortest SESSION_KEY accepted, the size of
+// the HMAC-SHA256 key securecookie signs with.
+const MinSessionKeyLength = 32
+
+// Secret is a setting that must not show up in logs. It prints redacted.
+type Secret string
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return "[REDACTED]"
+}
+
+func (s Secret) GoString() string {
+	return strconv.Quote(s.String())
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// OAuthClient is the app's registration at a sign-in provider.
+type OAuthClient struct {
+	ClientID     string
+	ClientSecret Secret
+}
+
+type Config struct {
+	Port string
+	// GRPCPort serves the gRPC TodoService when set.
+	GRPCPort string
+	// DatabaseURL is a postgres:// URL or the path of a SQLite file. It is
+	// secret because postgres URLs carry the password.
+	DatabaseURL Secret
+	// DomainName is the public URL of the app, such as
+	// https://todos.example.com, which OAuth callbacks and mailed links
+	// point to. It is required because local accounts are always on, and
+	// links built from the Host header could point anywhere.
+	DomainName string
+	SessionKey Secret
+
+	SessionIdleTimeout     time.Duration
+	SessionAbsoluteTimeout time.Duration
+
+	Google           OAuthClient
+	GitHub           OAuthClient
+	OIDC             OAuthClient
+	OIDCIssuer       string
+	OIDCProviderName string
+
+	SMTPAddr     string
+	SMTPUsername string
+	SMTPPassword Secret
+	MailFrom     string
+
+	// AssetsDir serves public/ and templates/ from a directory, such as
+	// web, instead of the copies embedded in the binary, so that edits show
+	// without rebuilding.
+	AssetsDir string
+	// DevIdP serves a development identity provider anyone can sign in
+	// with as anyone. Never set it in production.
+	DevIdP bool
+	// RateLimitStore is "memory" or "database", which shares limits
+	// between instances.
+	RateLimitStore string
+	LogLevel       string
+	LogFormat      string
+	// TrustProxy takes client addresses from X-Forwarded-For and the
+	// scheme from X-Forwarded-Proto, which only a proxy in front of the
+	// app, such as Heroku's router, can be trusted to set.
+	TrustProxy bool
+	// MetricsToken lets scrapers read /metrics. Without it there are no
+	// metrics served.
+	MetricsToken Secret
+
+	HTTPReadTimeout  time.Duration
+	HTTPWriteTimeout time.Duration
+	HTTPIdleTimeout  time.Duration
+	// ShutdownTimeout is how long in-flight requests get to finish on
+	// SIGTERM. Heroku kills the dyno 30 seconds after sending it.
+	ShutdownTimeout time.Duration
+
+	// HTTPSRedirect sends requests the router received over plain http to
+	// https at DomainName. It needs TrustProxy to tell.
+	HTTPSRedirect bool
+	// HSTSMaxAge is how long browsers only use https once they have seen
+	// the app over it. Zero sends no Strict-Transport-Security.
+	HSTSMaxAge        time.Duration
+	ReferrerPolicy    string
+	PermissionsPolicy string
+}
+
+// Default returns the settings used when nothing else is configured.
+func Default() *Config {
+	return &Config{
+		Port:                   "5000",
+		SessionIdleTimeout:     7 * 24 * time.Hour,
+		SessionAbsoluteTimeout: 30 * 24 * time.Hour,
+		OIDCProviderName:       "oidc",
+		RateLimitStore:         "memory",
+		LogLevel:               "info",
+		LogFormat:              "json",
+		HTTPReadTimeout:        15 * time.Second,
+		HTTPWriteTimeout:       30 * time.Second,
+		HTTPIdleTimeout:        2 * time.Minute,
+		ShutdownTimeout:        25 * time.Second,
+		HTTPSRedirect:          true,
+		HSTSMaxAge:             365 * 24 * time.Hour,
+		ReferrerPolicy:         "strict-origin-when-cross-origin",
+		PermissionsPolicy:      "camera=(), geolocation=(), microphone=(), payment=(), usb=()",
+	}
+}
+
+// setting binds one name to a field of Config.
+type setting struct {
+	name  string
+	usage string
+	set   func(string) error
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		stringSetting("PORT", "port to listen on", &c.Port),
+		stringSetting("GRPC_PORT", "port to serve gRPC on, if any", &c.GRPCPort),
+		secretSetting("DATABASE_URL", "postgres:// URL or SQLite file path", &c.DatabaseURL),
+		stringSetting("DOMAIN_NAME", "public URL of the app", &c.DomainName),
+		secretSetting("SESSION_KEY", "key signing session cookies, at least 32 bytes", &c.SessionKey),
+		durationSetting("SESSION_IDLE_TIMEOUT", "end sessions unused for this long", &c.SessionIdleTimeout),
+		durationSetting("SESSION_ABSOLUTE_TIMEOUT", "end sessions this long after sign in", &c.SessionAbsoluteTimeout),
+		stringSetting("GOOGLE_CLIENT_ID", "Google OAuth client ID", &c.Google.ClientID),
+		secretSetting("GOOGLE_SECRET_KEY", "Google OAuth client secret", &c.Google.ClientSecret),
+		stringSetting("GITHUB_CLIENT_ID", "GitHub OAuth client ID", &c.GitHub.ClientID),
+		secretSetting("GITHUB_SECRET_KEY", "GitHub OAuth client secret", &c.GitHub.ClientSecret),
+		stringSetting("OIDC_ISSUER", "issuer URL of an OpenID Connect provider", &c.OIDCIssuer),
+		stringSetting("OIDC_PROVIDER_NAME", "name of the OpenID Connect provider", &c.OIDCProviderName),
+		stringSetting("OIDC_CLIENT_ID", "OpenID Connect client ID", &c.OIDC.ClientID),
+		secretSetting("OIDC_SECRET_KEY", "OpenID Connect client secret", &c.OIDC.ClientSecret),
+		stringSetting("SMTP_ADDR", "host:port of the SMTP server, or empty to log mail", &c.SMTPAddr),
+		stringSetting("SMTP_USERNAME", "SMTP user name", &c.SMTPUsername),
+		secretSetting("SMTP_PASSWORD", "SMTP password", &c.SMTPPassword),
+		stringSetting("MAIL_FROM", "sender address of mail", &c.MailFrom),
+		stringSetting("ASSETS_DIR", "directory of public/ and templates/ to serve instead of the embedded ones", &c.AssetsDir),
+		boolSetting("DEV_IDP", "serve the development identity provider", &c.DevIdP),
+		stringSetting("RATE_LIMIT_STORE", "memory or database", &c.RateLimitStore),
+		boolSetting("TRUST_PROXY", "take client addresses and scheme from X-Forwarded-For and X-Forwarded-Proto, as on Heroku", &c.TrustProxy),
+		stringSetting("LOG_LEVEL", "debug, info, warn or error", &c.LogLevel),
+		stringSetting("LOG_FORMAT", "json or text", &c.LogFormat),
+		secretSetting("METRICS_TOKEN", "bearer token for /metrics", &c.MetricsToken),
+		durationSetting("HTTP_READ_TIMEOUT", "time to read a request", &c.HTTPReadTimeout),
+		durationSetting("HTTP_WRITE_TIMEOUT", "time to write a response", &c.HTTPWriteTimeout),
+		durationSetting("HTTP_IDLE_TIMEOUT", "time to keep idle connections open", &c.HTTPIdleTimeout),
+		durationSetting("SHUTDOWN_TIMEOUT", "time to drain requests on shutdown", &c.ShutdownTimeout),
+		boolSetting("HTTPS_REDIRECT", "redirect requests forwarded over http to https", &c.HTTPSRedirect),
+		durationSetting("HSTS_MAX_AGE", "time browsers keep to https, or 0 to not ask them", &c.HSTSMaxAge),
+		stringSetting("REFERRER_POLICY", "Referrer-Policy of responses", &c.ReferrerPolicy),
+		stringSetting("PERMISSIONS_POLICY", "Permissions-Policy of responses, or empty for none", &c.PermissionsPolicy),
+	}
+}
+
+func stringSetting(name, usage string, p *string) setting {
+	return setting{name, usage, func(v string) error {
+		*p = v
+		return nil
+	}}
+}
+
+func secretSetting(name, usage string, p *Secret) setting {
+	return setting{name, usage, func(v string) error {
+		*p = Secret(v)
+		return nil
+	}}
+}
+
+func boolSetting(name, usage string, p *bool) setting {
+	return setting{name, usage, func(v string) error {
+		if v == "" {
+			*p = false
+			return nil
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("want true or false, got %q", v)
+		}
+		*p = b
+		return nil
+	}}
+}
+
+func durationSetting(name, usage string, p *time.Duration) setting {
+	return setting{name, usage, func(v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("want a duration such as 30s or 2h, got %q", v)
+		}
+		*p = d
+		return nil
+	}}
+}
+
+func flagName(name string) string {
+	return strings.ToLower(strings.Replace(name, "_", "-", -1))
+}
+
+func fileKey(name string) string {
+	return strings.ToLower(name)
+}
+
+// Load reads the file named by -config or CONFIG_FILE, if any, then the
+// environment, then args, and validates the result.
+func Load(args []string) (*Config, error) {
+	return load(args, os.LookupEnv)
+}
+
+func load(args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	c := Default()
+	settings := c.settings()
+
+	fs := flag.NewFlagSet("todos", flag.ContinueOnError)
+	file := fs.String("config", "", "JSON file of settings")
+	flags := map[string]*string{}
+	for _, s := range settings {
+		flags[s.name] = fs.String(flagName(s.name), "", s.usage+" ("+s.name+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *file == "" {
+		*file, _ = lookupEnv("CONFIG_FILE")
+	}
+	if *file != "" {
+		if err := c.loadFile(*file, settings); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range settings {
+		if v, ok := lookupEnv(s.name); ok && v != "" {
+			if err := s.set(v); err != nil {
+				return nil, fmt.Errorf("%s: %v", s.name, err)
+			}
+		}
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, s := range settings {
+		if set[flagName(s.name)] {
+			if err := s.set(*flags[s.name]); err != nil {
+				return nil, fmt.Errorf("-%s: %v", flagName(s.name), err)
+			}
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Config) loadFile(path string, settings []setting) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	values := map[string]interface{}{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	known := map[string]setting{}
+	for _, s := range settings {
+		known[fileKey(s.name)] = s
+	}
+	for key, value := range values {
+		s, ok := known[key]
+		if !ok {
+			return fmt.Errorf("%s: unknown setting %q", path, key)
+		}
+		v := ""
+		switch value := value.(type) {
+		case string:
+			v = value
+		case bool, float64:
+			v = fmt.Sprint(value)
+		case nil:
+		default:
+			return fmt.Errorf("%s: %s: want a string, number or boolean", path, key)
+		}
+		if err := s.set(v); err != nil {
+			return fmt.Errorf("%s: %s: %v", path, key, err)
+		}
+	}
+	return nil
+}
+
+// Validate reports every problem with the settings at once.
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	port, err := strconv.Atoi(c.Port)
+	check(err == nil && port > 0 && port < 65536, "PORT must be a port number, got %q", c.Port)
+	if c.GRPCPort != "" {
+		grpcPort, err := strconv.Atoi(c.GRPCPort)
+		check(err == nil && grpcPort > 0 && grpcPort < 65536 && grpcPort != port,
+			"GRPC_PORT must be a port number other than PORT, got %q", c.GRPCPort)
+	}
+	check(len(c.SessionKey) >= MinSessionKeyLength,
+		"SESSION_KEY must be at least %d bytes, otherwise session cookies can be forged", MinSessionKeyLength)
+	if db := string(c.DatabaseURL); strings.HasPrefix(db, "postgres://") || strings.HasPrefix(db, "postgresql://") {
+		u, err := url.Parse(db)
+		check(err == nil && u.Host != "", "DATABASE_URL is not a valid postgres URL")
+	}
+	check(isBaseURL(c.DomainName), "DOMAIN_NAME must be an http or https URL without a path, got %q", c.DomainName)
+	check(c.SessionIdleTimeout > 0, "SESSION_IDLE_TIMEOUT must be positive")
+	check(c.SessionAbsoluteTimeout >= c.SessionIdleTimeout,
+		"SESSION_ABSOLUTE_TIMEOUT must not be shorter than SESSION_IDLE_TIMEOUT")
+
+	for _, client := range []struct {
+		prefix string
+		OAuthClient
+	}{{"GOOGLE", c.Google}, {"GITHUB", c.GitHub}} {
+		check((client.ClientID == "") == (client.ClientSecret == ""),
+			"%s_CLIENT_ID and %s_SECRET_KEY must be set together", client.prefix, client.prefix)
+	}
+	if c.OIDCIssuer != "" {
+		check(isURL(c.OIDCIssuer), "OIDC_ISSUER must be an http or https URL, got %q", c.OIDCIssuer)
+		check(c.OIDC.ClientID != "", "OIDC_CLIENT_ID is required with OIDC_ISSUER")
+		check(c.OIDCProviderName != "", "OIDC_PROVIDER_NAME must not be empty")
+	}
+
+	if c.SMTPAddr != "" {
+		_, _, err := net.SplitHostPort(c.SMTPAddr)
+		check(err == nil, "SMTP_ADDR must be host:port, got %q", c.SMTPAddr)
+		_, err = netmail.ParseAddress(c.MailFrom)
+		check(err == nil, "MAIL_FROM must be an email address when SMTP_ADDR is set, got %q", c.MailFrom)
+	}
+
+	if c.AssetsDir != "" {
+		check(isDir(filepath.Join(c.AssetsDir, "public")) && isDir(filepath.Join(c.AssetsDir, "templates")),
+			"ASSETS_DIR must contain public/ and templates/, got %q", c.AssetsDir)
+	}
+
+	check(c.RateLimitStore == "memory" || c.RateLimitStore == "database",
+		"RATE_LIMIT_STORE must be memory or database, got %q", c.RateLimitStore)
+	_, err = logging.New(ioutil.Discard, c.LogLevel, c.LogFormat)
+	check(err == nil, "LOG_LEVEL or LOG_FORMAT: %v", err)
+	if c.MetricsToken != "" {
+		check(len(c.MetricsToken) >= 16, "METRICS_TOKEN must be at least 16 bytes")
+	}
+
+	check(c.HTTPReadTimeout > 0, "HTTP_READ_TIMEOUT must be positive")
+	check(c.HTTPWriteTimeout > 0, "HTTP_WRITE_TIMEOUT must be positive")
+	check(c.HTTPIdleTimeout > 0, "HTTP_IDLE_TIMEOUT must be positive")
+	check(c.ShutdownTimeout > 0, "SHUTDOWN_TIMEOUT must be positive")
+	check(c.HSTSMaxAge >= 0, "HSTS_MAX_AGE must not be negative")
+	check(referrerPolicies[c.ReferrerPolicy], "REFERRER_POLICY is not a referrer policy, got %q", c.ReferrerPolicy)
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+var referrerPolicies = map[string]bool{
+	"no-referrer":                     true,
+	"no-referrer-when-downgrade":      true,
+	"origin":                          true,
+	"origin-when-cross-origin":        true,
+	"same-origin":                     true,
+	"strict-origin":                   true,
+	"strict-origin-when-cross-origin": true,
+	"unsafe-url":                      true,
+}
+
+func isURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// isBaseURL is true for URLs that paths can be appended to.
+func isBaseURL(s string) bool {
+	u, err := url.Parse(s)
+	return isURL(s) && err == nil && u.Path == "" && u.RawQuery == "" && u.Fragment == ""
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
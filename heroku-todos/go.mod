@@ -1,15 +1,28 @@
 module tuckersWeb/todos
 
-go 1.14
+go 1.16
 
 require (
+	github.com/golang/protobuf v1.4.1
 	github.com/gorilla/mux v1.7.4
+	github.com/gorilla/securecookie v1.1.1
 	github.com/gorilla/sessions v1.2.0
+	github.com/gorilla/websocket v1.4.0
+	github.com/graph-gophers/dataloader v5.0.0+incompatible
+	github.com/graph-gophers/graphql-go v0.0.0-20200622220639-c1d9693c95a6
+	github.com/graph-gophers/graphql-transport-ws v0.0.1
 	github.com/lib/pq v1.5.2
 	github.com/mattn/go-sqlite3 v2.0.3+incompatible
+	github.com/prometheus/client_golang v1.6.0
+	github.com/sirupsen/logrus v1.6.0
 	github.com/stretchr/testify v1.5.1
 	github.com/tuckersGo/goWeb v0.0.0-20200502170833-fe3301a6176f
 	github.com/unrolled/render v1.0.3
 	github.com/urfave/negroni v1.0.0
+	golang.org/x/crypto v0.0.0-20200510223506-06a226fb4e37
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
+	golang.org/x/text v0.3.3
+	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013
+	google.golang.org/grpc v1.33.2
+	google.golang.org/protobuf v1.25.0
 )
@@ -0,0 +1,75 @@
+// Package logging carries a structured logger with each request, so that
+// everything logged while serving it shares the request's fields.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// New returns a logger writing to out at level, one of debug, info, warn
+// or error, in format, either json or text.
+func New(out io.Writer, level, format string) (*logrus.Logger, error) {
+	logger := logrus.New()
+	logger.Out = out
+	if level == "" {
+		level = "info"
+	}
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	logger.Level = lvl
+	switch strings.ToLower(format) {
+	case "", "json":
+		logger.Formatter = &logrus.JSONFormatter{}
+	case "text":
+		logger.Formatter = &logrus.TextFormatter{FullTimestamp: true}
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+	return logger, nil
+}
+
+type contextKey int
+
+const entryContextKey contextKey = 0
+
+// holder lets later middleware add fields, such as the signed in user, to
+// the logger that earlier middleware put into the context. Handlers can
+// log from several goroutines, so entry is only used under mu.
+type holder struct {
+	mu    sync.Mutex
+	entry *logrus.Entry
+}
+
+// NewContext returns a context carrying entry.
+func NewContext(ctx context.Context, entry *logrus.Entry) context.Context {
+	return context.WithValue(ctx, entryContextKey, &holder{entry: entry})
+}
+
+// FromContext returns the logger of ctx, or logrus' standard logger when
+// ctx carries none.
+func FromContext(ctx context.Context) *logrus.Entry {
+	if h, ok := ctx.Value(entryContextKey).(*holder); ok {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return h.entry
+	}
+	return logrus.NewEntry(logrus.StandardLogger())
+}
+
+// AddFields adds fields to the logger of ctx for everything logged from
+// then on, including by callers further up the middleware chain.
+func AddFields(ctx context.Context, fields logrus.Fields) {
+	if h, ok := ctx.Value(entryContextKey).(*holder); ok {
+		h.mu.Lock()
+		h.entry = h.entry.WithFields(fields)
+		h.mu.Unlock()
+	}
+}
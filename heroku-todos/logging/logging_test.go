@@ -0,0 +1,30 @@
+package logging
+
+import (
+	"context"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddFieldsConcurrently(t *testing.T) {
+	assert := assert.New(t)
+	logger, err := New(ioutil.Discard, "", "")
+	assert.NoError(err)
+	ctx := NewContext(context.Background(), logrus.NewEntry(logger))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			AddFields(ctx, logrus.Fields{string(rune('a' + i)): i})
+			FromContext(ctx).Info("logged")
+		}(i)
+	}
+	wg.Wait()
+	assert.Len(FromContext(ctx).Data, 10)
+}
@@ -1,22 +1,58 @@
 package main
 
 import (
-	"log"
-	"net/http"
+	"context"
+	"fmt"
+	"net"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"tuckersWeb/todos/app"
+	"tuckersWeb/todos/config"
+	"tuckersWeb/todos/logging"
+
+	"github.com/sirupsen/logrus"
 )
 
 func main() {
-	port := os.Getenv("PORT")
-
-	m := app.MakeHandler(os.Getenv("DATABASE_URL"))
-	defer m.Close()
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
-	log.Println("Started App")
-	err := http.ListenAndServe(":"+port, m)
+	m := app.MakeHandler(cfg)
+	// Heroku sends SIGTERM on every deploy and restart
+	ctx, cancel := context.WithCancel(logging.NewContext(context.Background(), logrus.NewEntry(m.Logger())))
+	logging.FromContext(ctx).WithField("config", cfg).Info("loaded configuration")
+	srv := app.NewServer(cfg, m)
+	ln, err := net.Listen("tcp", srv.Addr)
 	if err != nil {
+		m.Close()
 		panic(err)
 	}
+
+	if cfg.GRPCPort != "" {
+		grpcLn, err := net.Listen("tcp", ":"+cfg.GRPCPort)
+		if err != nil {
+			m.Close()
+			panic(err)
+		}
+		m.ServeGRPC(m.NewGRPCServer(), grpcLn)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		logging.FromContext(ctx).WithField("signal", sig.String()).Info("received signal")
+		cancel()
+	}()
+
+	logging.FromContext(ctx).Info("Started App")
+	if err := m.Serve(ctx, srv, ln, cfg.ShutdownTimeout); err != nil {
+		logging.FromContext(ctx).WithError(err).Error("server stopped")
+		os.Exit(1)
+	}
 }
@@ -1,48 +1,492 @@
 package model
 
-import "time"
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
 
 type memoryHandler struct {
-	todoMap map[int]*Todo
+	*MemoryRateLimits
+	todoMap     map[int]*Todo
+	todoOwner   map[int]int
+	todoTags    map[int][]string
+	todoHistory map[int][]*TodoChange
+	userMap     map[int]*User
+	identityMap map[string]*Identity
+	identityOf  map[string]int
+	accountMap  map[string]*LocalAccount
+	tokenMap    map[string]*memoryToken
+	sessionMap  map[string]*Session
+	lastSession int
+	tokens      []*AccessToken
 }
 
-func (m *memoryHandler) GetTodos(sessionId string) []*Todo {
+type memoryToken struct {
+	userID    int
+	purpose   string
+	expiresAt time.Time
+	used      bool
+}
+
+func (m *memoryHandler) GetTodos(ctx context.Context, userID int) []*Todo {
 	list := []*Todo{}
-	for _, v := range m.todoMap {
-		list = append(list, v)
+	for k, v := range m.todoMap {
+		if m.todoOwner[k] == userID {
+			list = append(list, v)
+		}
 	}
 	return list
 }
 
-func (m *memoryHandler) AddTodo(sessionId string, name string) *Todo {
+func (m *memoryHandler) FindTodos(ctx context.Context, userID int, filter TodoFilter) ([]*Todo, int) {
+	var matched []*Todo
+	for _, todo := range m.GetTodos(ctx, userID) {
+		if filter.Completed != nil && todo.Completed != *filter.Completed {
+			continue
+		}
+		if filter.Search != "" && !strings.Contains(strings.ToLower(todo.Name), strings.ToLower(filter.Search)) {
+			continue
+		}
+		if filter.Tag != "" && !hasTag(m.todoTags[todo.ID], filter.Tag) {
+			continue
+		}
+		matched = append(matched, todo)
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].ID < matched[j].ID })
+	todos := []*Todo{}
+	for _, todo := range matched {
+		if todo.ID > filter.AfterID && len(todos) < filter.Limit {
+			todos = append(todos, todo)
+		}
+	}
+	return todos, len(matched)
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *memoryHandler) GetTodo(ctx context.Context, userID int, id int) *Todo {
+	if todo, ok := m.todoMap[id]; ok && m.todoOwner[id] == userID {
+		return todo
+	}
+	return nil
+}
+
+func (m *memoryHandler) AddTodo(ctx context.Context, userID int, name string) *Todo {
 	id := len(m.todoMap) + 1
 	todo := &Todo{id, name, false, time.Now()}
 	m.todoMap[id] = todo
+	m.todoOwner[id] = userID
+	m.recordTodoChange(todo, TodoAdded)
 	return todo
 }
 
-func (m *memoryHandler) RemoveTodo(id int) bool {
-	if _, ok := m.todoMap[id]; ok {
+func (m *memoryHandler) RemoveTodo(ctx context.Context, userID int, id int) bool {
+	if _, ok := m.todoMap[id]; ok && m.todoOwner[id] == userID {
 		delete(m.todoMap, id)
+		delete(m.todoOwner, id)
+		delete(m.todoTags, id)
+		delete(m.todoHistory, id)
 		return true
 	}
 	return false
 }
 
-func (m *memoryHandler) CompleteTodo(id int, complete bool) bool {
-	if todo, ok := m.todoMap[id]; ok {
+func (m *memoryHandler) CompleteTodo(ctx context.Context, userID int, id int, complete bool) bool {
+	if todo, ok := m.todoMap[id]; ok && m.todoOwner[id] == userID {
 		todo.Completed = complete
+		m.recordTodoChange(todo, completedChange(complete))
+		return true
+	}
+	return false
+}
+
+func (m *memoryHandler) RenameTodo(ctx context.Context, userID int, id int, name string) bool {
+	if todo, ok := m.todoMap[id]; ok && m.todoOwner[id] == userID {
+		todo.Name = name
+		m.recordTodoChange(todo, TodoRenamed)
 		return true
 	}
 	return false
 }
 
+func (m *memoryHandler) SetTodoTags(ctx context.Context, userID int, id int, tags []string) bool {
+	if todo, ok := m.todoMap[id]; ok && m.todoOwner[id] == userID {
+		sorted := []string{}
+		for _, tag := range tags {
+			if !hasTag(sorted, tag) {
+				sorted = append(sorted, tag)
+			}
+		}
+		sort.Strings(sorted)
+		m.todoTags[id] = sorted
+		m.recordTodoChange(todo, TodoTagged)
+		return true
+	}
+	return false
+}
+
+func (m *memoryHandler) recordTodoChange(todo *Todo, change string) {
+	m.todoHistory[todo.ID] = append(m.todoHistory[todo.ID], &TodoChange{change, todo.Name, todo.Completed, time.Now()})
+}
+
+func (m *memoryHandler) GetTagsByTodos(ctx context.Context, ids []int) map[int][]string {
+	byTodo := map[int][]string{}
+	for _, id := range ids {
+		if tags := m.todoTags[id]; len(tags) > 0 {
+			byTodo[id] = tags
+		}
+	}
+	return byTodo
+}
+
+func (m *memoryHandler) GetHistoryByTodos(ctx context.Context, ids []int) map[int][]*TodoChange {
+	byTodo := map[int][]*TodoChange{}
+	for _, id := range ids {
+		if history := m.todoHistory[id]; len(history) > 0 {
+			byTodo[id] = history
+		}
+	}
+	return byTodo
+}
+
+func identityKey(identity *Identity) string {
+	return identity.Provider + ":" + identity.Subject
+}
+
+func (m *memoryHandler) SignInUser(ctx context.Context, identity *Identity) *User {
+	now := time.Now()
+	id, ok := m.identityOf[identityKey(identity)]
+	if !ok {
+		user := &User{ID: len(m.userMap) + 1, CreatedAt: now}
+		m.userMap[user.ID] = user
+		m.LinkIdentity(ctx, user.ID, identity)
+		id = user.ID
+	}
+	user := m.userMap[id]
+	if identity.Email != "" {
+		user.Email = identity.Email
+	}
+	if identity.Name != "" {
+		user.Name = identity.Name
+	}
+	if identity.Picture != "" {
+		user.Picture = identity.Picture
+	}
+	user.LastLoginAt = now
+	return user
+}
+
+func (m *memoryHandler) LinkIdentity(ctx context.Context, userID int, identity *Identity) bool {
+	key := identityKey(identity)
+	if owner, ok := m.identityOf[key]; ok {
+		return owner == userID
+	}
+	m.identityMap[key] = &Identity{
+		Provider:  identity.Provider,
+		Subject:   identity.Subject,
+		Email:     identity.Email,
+		CreatedAt: time.Now(),
+	}
+	m.identityOf[key] = userID
+	return true
+}
+
+func (m *memoryHandler) GetUser(ctx context.Context, id int) *User {
+	return m.userMap[id]
+}
+
+func (m *memoryHandler) GetUsers(ctx context.Context, ids []int) []*User {
+	list := []*User{}
+	for _, id := range ids {
+		if user, ok := m.userMap[id]; ok {
+			list = append(list, user)
+		}
+	}
+	return list
+}
+
+func (m *memoryHandler) GetIdentities(ctx context.Context, userID int) []*Identity {
+	list := []*Identity{}
+	for k, v := range m.identityMap {
+		if m.identityOf[k] == userID {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func (m *memoryHandler) GetIdentitiesByUsers(ctx context.Context, ids []int) map[int][]*Identity {
+	byUser := map[int][]*Identity{}
+	for _, id := range ids {
+		if identities := m.GetIdentities(ctx, id); len(identities) > 0 {
+			byUser[id] = identities
+		}
+	}
+	return byUser
+}
+
+func (m *memoryHandler) CreateLocalAccount(ctx context.Context, email string, passwordHash []byte) *User {
+	if _, ok := m.accountMap[email]; ok {
+		return nil
+	}
+	now := time.Now()
+	user := &User{ID: len(m.userMap) + 1, Email: email, CreatedAt: now, LastLoginAt: now}
+	m.userMap[user.ID] = user
+	m.LinkIdentity(ctx, user.ID, &Identity{Provider: "local", Subject: email, Email: email})
+	m.accountMap[email] = &LocalAccount{UserID: user.ID, Email: email, PasswordHash: passwordHash}
+	return user
+}
+
+func (m *memoryHandler) GetLocalAccount(ctx context.Context, email string) *LocalAccount {
+	if account, ok := m.accountMap[email]; ok {
+		copied := *account
+		return &copied
+	}
+	return nil
+}
+
+func (m *memoryHandler) SetPasswordHash(ctx context.Context, userID int, passwordHash []byte) bool {
+	for _, account := range m.accountMap {
+		if account.UserID == userID {
+			account.PasswordHash = passwordHash
+			return true
+		}
+	}
+	return false
+}
+
+func (m *memoryHandler) SetEmailVerified(ctx context.Context, userID int) bool {
+	for _, account := range m.accountMap {
+		if account.UserID == userID {
+			account.Verified = true
+			return true
+		}
+	}
+	return false
+}
+
+func (m *memoryHandler) CreateEmailToken(ctx context.Context, userID int, purpose string, tokenHash string, expiresAt time.Time) {
+	m.tokenMap[tokenHash] = &memoryToken{userID, purpose, expiresAt, false}
+}
+
+func (m *memoryHandler) UseEmailToken(ctx context.Context, purpose string, tokenHash string) int {
+	token, ok := m.tokenMap[tokenHash]
+	if !ok || token.used || token.purpose != purpose || time.Now().After(token.expiresAt) {
+		return 0
+	}
+	token.used = true
+	return token.userID
+}
+
+func (m *memoryHandler) CreateSession(ctx context.Context, session *Session) int {
+	m.lastSession++
+	stored := *session
+	stored.ID = m.lastSession
+	m.sessionMap[session.TokenHash] = &stored
+	return stored.ID
+}
+
+func (m *memoryHandler) GetSession(ctx context.Context, tokenHash string) *Session {
+	if session, ok := m.sessionMap[tokenHash]; ok {
+		copied := *session
+		return &copied
+	}
+	return nil
+}
+
+func (m *memoryHandler) UpdateSession(ctx context.Context, tokenHash string, userID int, data []byte) bool {
+	if session, ok := m.sessionMap[tokenHash]; ok {
+		session.UserID = userID
+		session.Data = data
+		return true
+	}
+	return false
+}
+
+func (m *memoryHandler) TouchSession(ctx context.Context, tokenHash string, lastSeenAt time.Time, ip string) {
+	if session, ok := m.sessionMap[tokenHash]; ok {
+		session.LastSeenAt = lastSeenAt
+		session.IP = ip
+	}
+}
+
+func (m *memoryHandler) DeleteSession(ctx context.Context, tokenHash string) bool {
+	if _, ok := m.sessionMap[tokenHash]; ok {
+		delete(m.sessionMap, tokenHash)
+		return true
+	}
+	return false
+}
+
+func (m *memoryHandler) GetUserSessions(ctx context.Context, userID int) []*Session {
+	list := []*Session{}
+	for _, v := range m.sessionMap {
+		if v.UserID == userID {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func (m *memoryHandler) DeleteUserSession(ctx context.Context, userID int, id int) bool {
+	for k, v := range m.sessionMap {
+		if v.ID == id && v.UserID == userID {
+			delete(m.sessionMap, k)
+			return true
+		}
+	}
+	return false
+}
+
+func (m *memoryHandler) DeleteUserSessions(ctx context.Context, userID int) int {
+	cnt := 0
+	for k, v := range m.sessionMap {
+		if v.UserID == userID {
+			delete(m.sessionMap, k)
+			cnt++
+		}
+	}
+	return cnt
+}
+
+func (m *memoryHandler) DeleteExpiredSessions(ctx context.Context, now time.Time, idleSince time.Time) int {
+	cnt := 0
+	for k, v := range m.sessionMap {
+		if v.ExpiresAt.Before(now) || v.LastSeenAt.Before(idleSince) {
+			delete(m.sessionMap, k)
+			cnt++
+		}
+	}
+	return cnt
+}
+
+func (m *memoryHandler) CountActiveSessions(ctx context.Context, now time.Time, idleSince time.Time) int {
+	cnt := 0
+	for _, v := range m.sessionMap {
+		if v.UserID != 0 && !v.ExpiresAt.Before(now) && !v.LastSeenAt.Before(idleSince) {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+func (m *memoryHandler) CreateAccessToken(ctx context.Context, token *AccessToken) int {
+	stored := *token
+	stored.ID = len(m.tokens) + 1
+	m.tokens = append(m.tokens, &stored)
+	return stored.ID
+}
+
+func (m *memoryHandler) GetAccessToken(ctx context.Context, tokenHash string) *AccessToken {
+	for _, token := range m.tokens {
+		if token != nil && token.TokenHash == tokenHash {
+			copied := *token
+			return &copied
+		}
+	}
+	return nil
+}
+
+func (m *memoryHandler) GetAccessTokens(ctx context.Context, userID int) []*AccessToken {
+	list := []*AccessToken{}
+	for _, token := range m.tokens {
+		if token != nil && token.UserID == userID {
+			list = append(list, token)
+		}
+	}
+	return list
+}
+
+func (m *memoryHandler) RevokeAccessToken(ctx context.Context, userID int, id int) bool {
+	if id < 1 || id > len(m.tokens) || m.tokens[id-1] == nil || m.tokens[id-1].UserID != userID {
+		return false
+	}
+	m.tokens[id-1] = nil
+	return true
+}
+
+func (m *memoryHandler) TouchAccessToken(ctx context.Context, id int, lastUsedAt time.Time, ip string) {
+	if id >= 1 && id <= len(m.tokens) && m.tokens[id-1] != nil {
+		m.tokens[id-1].LastUsedAt = &lastUsedAt
+		m.tokens[id-1].LastUsedIP = ip
+	}
+}
+
+func (m *memoryHandler) Stats() sql.DBStats {
+	return sql.DBStats{}
+}
+
+func (m *memoryHandler) Ping(ctx context.Context) error {
+	return nil
+}
+
+// SchemaVersion has nothing to migrate.
+func (m *memoryHandler) SchemaVersion(ctx context.Context) (int, int, error) {
+	return 0, 0, nil
+}
+
 func (m *memoryHandler) Close() {
 
 }
 
 func newMemoryHandler() DBHandler {
-	m := &memoryHandler{}
+	m := &memoryHandler{MemoryRateLimits: NewMemoryRateLimits()}
 	m.todoMap = make(map[int]*Todo)
+	m.todoOwner = make(map[int]int)
+	m.todoTags = make(map[int][]string)
+	m.todoHistory = make(map[int][]*TodoChange)
+	m.userMap = make(map[int]*User)
+	m.identityMap = make(map[string]*Identity)
+	m.identityOf = make(map[string]int)
+	m.accountMap = make(map[string]*LocalAccount)
+	m.tokenMap = make(map[string]*memoryToken)
+	m.sessionMap = make(map[string]*Session)
 	return m
 }
+
+// MemoryRateLimits keeps rate limit buckets in process, for a single
+// instance that doesn't need to share limits.
+type MemoryRateLimits struct {
+	mu      sync.Mutex
+	buckets map[string]*Bucket
+}
+
+func NewMemoryRateLimits() *MemoryRateLimits {
+	return &MemoryRateLimits{buckets: make(map[string]*Bucket)}
+}
+
+func (m *MemoryRateLimits) TakeToken(ctx context.Context, key string, capacity int, interval time.Duration, now time.Time) (Bucket, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	bucket, ok := m.buckets[key]
+	if !ok {
+		bucket = &Bucket{Tokens: float64(capacity), UpdatedAt: now}
+		m.buckets[key] = bucket
+	}
+	ok = bucket.Take(capacity, interval, now)
+	return *bucket, ok
+}
+
+func (m *MemoryRateLimits) DeleteIdleBuckets(ctx context.Context, idleSince time.Time) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cnt := 0
+	for key, bucket := range m.buckets {
+		if bucket.UpdatedAt.Before(idleSince) {
+			delete(m.buckets, key)
+			cnt++
+		}
+	}
+	return cnt
+}
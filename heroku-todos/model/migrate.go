@@ -0,0 +1,50 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+
+	"tuckersWeb/todos/logging"
+)
+
+// migrate applies every statement in migrations that has not been recorded
+// in schema_migrations yet. The position in the slice is the version, so
+// migrations must only ever be appended. Progress goes to the logger of ctx.
+func migrate(ctx context.Context, db *sql.DB, migrations []string) {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY
+	);`)
+	if err != nil {
+		panic(err)
+	}
+
+	current, err := appliedVersion(ctx, db)
+	if err != nil {
+		panic(err)
+	}
+	for i := current; i < len(migrations); i++ {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			panic(err)
+		}
+		if _, err = tx.ExecContext(ctx, migrations[i]); err != nil {
+			tx.Rollback()
+			panic(err)
+		}
+		if _, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version) VALUES ("+strconv.Itoa(i+1)+")"); err != nil {
+			tx.Rollback()
+			panic(err)
+		}
+		if err = tx.Commit(); err != nil {
+			panic(err)
+		}
+		logging.FromContext(ctx).WithField("version", i+1).Info("applied database migration")
+	}
+}
+
+func appliedVersion(ctx context.Context, db *sql.DB) (int, error) {
+	var version sql.NullInt64
+	err := db.QueryRowContext(ctx, "SELECT MAX(version) FROM schema_migrations").Scan(&version)
+	return int(version.Int64), err
+}
@@ -1,6 +1,11 @@
 package model
 
-import "time"
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
 
 type Todo struct {
 	ID        int       `json:"id"`
@@ -9,16 +14,280 @@ type Todo struct {
 	CreatedAt time.Time `json:"created_at"`
 }
 
+// TodoFilter selects a page of a user's todos, ordered by id.
+type TodoFilter struct {
+	Completed *bool
+	// Search matches todos whose name contains it, ignoring ASCII case.
+	Search string
+	Tag    string
+	// AfterID skips todos up to and including that id.
+	AfterID int
+	Limit   int
+}
+
+// likePattern matches strings containing s in a LIKE ... ESCAPE '\'.
+func likePattern(s string) string {
+	return "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s) + "%"
+}
+
+// The kinds of TodoChange.
+const (
+	TodoAdded     = "added"
+	TodoRenamed   = "renamed"
+	TodoCompleted = "completed"
+	TodoReopened  = "reopened"
+	TodoTagged    = "tagged"
+)
+
+// TodoChange is an entry in the history of a todo, with the name and
+// state the todo was left in.
+type TodoChange struct {
+	Type      string    `json:"type"`
+	Name      string    `json:"name"`
+	Completed bool      `json:"completed"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// mustExec runs query in tx, rolling tx back and panicking if it fails.
+func mustExec(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) sql.Result {
+	rst, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		tx.Rollback()
+		panic(err)
+	}
+	return rst
+}
+
+func completedChange(complete bool) string {
+	if complete {
+		return TodoCompleted
+	}
+	return TodoReopened
+}
+
+type User struct {
+	ID          int       `json:"id"`
+	Email       string    `json:"email"`
+	Name        string    `json:"name"`
+	Picture     string    `json:"picture"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastLoginAt time.Time `json:"last_login_at"`
+}
+
+// Identity is an account at a sign-in provider, identified by the
+// provider's subject. One user can have several identities.
+type Identity struct {
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email"`
+	Name      string    `json:"name,omitempty"`
+	Picture   string    `json:"picture,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type UserStore interface {
+	// SignInUser returns the user linked to identity, creating the user on
+	// first login, and records the login with the identity's profile.
+	// Todos saved under a Google ID before the users table existed are
+	// linked to the user.
+	SignInUser(ctx context.Context, identity *Identity) *User
+	// LinkIdentity links identity to the user. It returns false when the
+	// identity already belongs to another user.
+	LinkIdentity(ctx context.Context, userID int, identity *Identity) bool
+	GetUser(ctx context.Context, id int) *User
+	// GetUsers returns those of the users with ids that exist, in no
+	// particular order.
+	GetUsers(ctx context.Context, ids []int) []*User
+	GetIdentities(ctx context.Context, userID int) []*Identity
+	// GetIdentitiesByUsers returns the identities of each of the users
+	// with ids. Users without any are left out.
+	GetIdentitiesByUsers(ctx context.Context, ids []int) map[int][]*Identity
+}
+
+// LocalAccount is a user signing in with an email and password. It is
+// stored as the "local" identity of the user.
+type LocalAccount struct {
+	UserID       int
+	Email        string
+	PasswordHash []byte
+	Verified     bool
+}
+
+// PasswordStore keeps email/password accounts and the single-use tokens
+// mailed to verify their address or reset their password.
+type PasswordStore interface {
+	// CreateLocalAccount creates a user signing in with email. It returns
+	// nil when the email is already registered.
+	CreateLocalAccount(ctx context.Context, email string, passwordHash []byte) *User
+	GetLocalAccount(ctx context.Context, email string) *LocalAccount
+	SetPasswordHash(ctx context.Context, userID int, passwordHash []byte) bool
+	SetEmailVerified(ctx context.Context, userID int) bool
+	CreateEmailToken(ctx context.Context, userID int, purpose string, tokenHash string, expiresAt time.Time)
+	// UseEmailToken consumes the token and returns its user, or 0 when the
+	// token is unknown, expired or already used.
+	UseEmailToken(ctx context.Context, purpose string, tokenHash string) int
+}
+
+// Session is a server-side session. The cookie carries the token whose
+// hash identifies the session.
+type Session struct {
+	ID         int       `json:"id"`
+	TokenHash  string    `json:"-"`
+	UserID     int       `json:"-"`
+	Data       []byte    `json:"-"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+type SessionStore interface {
+	CreateSession(ctx context.Context, session *Session) int
+	GetSession(ctx context.Context, tokenHash string) *Session
+	UpdateSession(ctx context.Context, tokenHash string, userID int, data []byte) bool
+	TouchSession(ctx context.Context, tokenHash string, lastSeenAt time.Time, ip string)
+	DeleteSession(ctx context.Context, tokenHash string) bool
+	GetUserSessions(ctx context.Context, userID int) []*Session
+	DeleteUserSession(ctx context.Context, userID int, id int) bool
+	// DeleteUserSessions signs the user out everywhere.
+	DeleteUserSessions(ctx context.Context, userID int) int
+	// DeleteExpiredSessions removes sessions past their expiry or not seen
+	// since idleSince.
+	DeleteExpiredSessions(ctx context.Context, now time.Time, idleSince time.Time) int
+	// CountActiveSessions counts sessions of signed in users that are
+	// neither expired nor idle since idleSince.
+	CountActiveSessions(ctx context.Context, now time.Time, idleSince time.Time) int
+}
+
+// AccessToken is a personal access token for scripting the API. Only the
+// hash of the secret is stored.
+type AccessToken struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"-"`
+	Name       string     `json:"name"`
+	TokenHash  string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	LastUsedIP string     `json:"last_used_ip"`
+}
+
+func (t *AccessToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// scanAccessToken scans the access_tokens columns in table order.
+func scanAccessToken(scan func(dest ...interface{}) error) (*AccessToken, error) {
+	var token AccessToken
+	var scopes string
+	var lastUsedAt sql.NullTime
+	err := scan(&token.ID, &token.UserID, &token.Name, &token.TokenHash, &scopes,
+		&token.CreatedAt, &token.ExpiresAt, &lastUsedAt, &token.LastUsedIP)
+	if err != nil {
+		return nil, err
+	}
+	token.Scopes = strings.Fields(scopes)
+	if lastUsedAt.Valid {
+		token.LastUsedAt = &lastUsedAt.Time
+	}
+	return &token, nil
+}
+
+type AccessTokenStore interface {
+	CreateAccessToken(ctx context.Context, token *AccessToken) int
+	GetAccessToken(ctx context.Context, tokenHash string) *AccessToken
+	GetAccessTokens(ctx context.Context, userID int) []*AccessToken
+	RevokeAccessToken(ctx context.Context, userID int, id int) bool
+	TouchAccessToken(ctx context.Context, id int, lastUsedAt time.Time, ip string)
+}
+
+// Bucket is a token bucket for rate limiting. It holds up to a capacity of
+// tokens and gains one every interval.
+type Bucket struct {
+	Tokens    float64
+	UpdatedAt time.Time
+}
+
+// Take refills the bucket up to now and takes one token if there is one.
+func (b *Bucket) Take(capacity int, interval time.Duration, now time.Time) bool {
+	if elapsed := now.Sub(b.UpdatedAt); elapsed > 0 {
+		b.Tokens += float64(elapsed) / float64(interval)
+	}
+	if b.Tokens > float64(capacity) {
+		b.Tokens = float64(capacity)
+	}
+	b.UpdatedAt = now
+	if b.Tokens < 1 {
+		return false
+	}
+	b.Tokens--
+	return true
+}
+
+type RateLimitStore interface {
+	// TakeToken takes a token from the bucket named key, which starts out
+	// full, and returns what is left in it.
+	TakeToken(ctx context.Context, key string, capacity int, interval time.Duration, now time.Time) (Bucket, bool)
+	// DeleteIdleBuckets forgets buckets not used since idleSince.
+	DeleteIdleBuckets(ctx context.Context, idleSince time.Time) int
+}
+
 type DBHandler interface {
-	GetTodos(sessionId string) []*Todo
-	AddTodo(sessionId string, name string) *Todo
-	RemoveTodo(id int) bool
-	CompleteTodo(id int, complete bool) bool
+	UserStore
+	PasswordStore
+	SessionStore
+	AccessTokenStore
+	RateLimitStore
+	GetTodos(ctx context.Context, userID int) []*Todo
+	// FindTodos returns the page of the user's todos that filter selects,
+	// and how many todos it matches ignoring AfterID and Limit.
+	FindTodos(ctx context.Context, userID int, filter TodoFilter) ([]*Todo, int)
+	// GetTodo returns nil when the user has no todo with that id.
+	GetTodo(ctx context.Context, userID int, id int) *Todo
+	AddTodo(ctx context.Context, userID int, name string) *Todo
+	RemoveTodo(ctx context.Context, userID int, id int) bool
+	CompleteTodo(ctx context.Context, userID int, id int, complete bool) bool
+	RenameTodo(ctx context.Context, userID int, id int, name string) bool
+	// SetTodoTags replaces the tags of the todo.
+	SetTodoTags(ctx context.Context, userID int, id int, tags []string) bool
+	// GetTagsByTodos returns the tags of each of the todos with ids, in
+	// alphabetical order. Todos without any are left out.
+	GetTagsByTodos(ctx context.Context, ids []int) map[int][]string
+	// GetHistoryByTodos returns the changes to each of the todos with ids,
+	// oldest first. Todos without any are left out.
+	GetHistoryByTodos(ctx context.Context, ids []int) map[int][]*TodoChange
+	// Stats reports on the connection pool.
+	Stats() sql.DBStats
+	// Ping checks that the database can be reached.
+	Ping(ctx context.Context) error
+	// SchemaVersion reports the latest migration applied to the database
+	// and the latest one this build knows about.
+	SchemaVersion(ctx context.Context) (applied int, latest int, err error)
 	Close()
 }
 
-func NewDBHandler(dbConn string) DBHandler {
+// Backend names the kind of database dbConn points at, "postgres" or
+// "sqlite".
+func Backend(dbConn string) string {
+	if strings.HasPrefix(dbConn, "postgres://") || strings.HasPrefix(dbConn, "postgresql://") {
+		return "postgres"
+	}
+	return "sqlite"
+}
+
+// NewDBHandler connects to dbConn and migrates it, logging to the logger of
+// ctx.
+func NewDBHandler(ctx context.Context, dbConn string) DBHandler {
 	//handler = newMemoryHandler()
-	//return newSqliteHandler(dbConn)
-	return newPQHandler(dbConn)
+	if Backend(dbConn) == "postgres" {
+		return newPQHandler(ctx, dbConn)
+	}
+	return newSqliteHandler(ctx, dbConn)
 }
@@ -1,19 +1,133 @@
 package model
 
 import (
+	"context"
 	"database/sql"
+	"strconv"
+	"strings"
 	"time"
 
-	_ "github.com/lib/pq"
+	"tuckersWeb/todos/logging"
+
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
 )
 
 type pqHandler struct {
 	db *sql.DB
 }
 
-func (s *pqHandler) GetTodos(sessionId string) []*Todo {
+var pqMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS todos (
+		id        SERIAL PRIMARY KEY,
+		sessionId VARCHAR(256),
+		name      TEXT,
+		completed BOOLEAN,
+		createdAt TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS sessionIdIndexOnTodos ON todos (
+		sessionId ASC
+	);`,
+	`CREATE TABLE IF NOT EXISTS users (
+		id          SERIAL PRIMARY KEY,
+		googleId    VARCHAR(256) NOT NULL UNIQUE,
+		email       VARCHAR(256),
+		picture     TEXT,
+		createdAt   TIMESTAMP,
+		lastLoginAt TIMESTAMP
+	);
+	ALTER TABLE todos ADD COLUMN IF NOT EXISTS userId INTEGER REFERENCES users(id);
+	CREATE INDEX IF NOT EXISTS userIdIndexOnTodos ON todos (
+		userId ASC
+	);`,
+	`CREATE TABLE IF NOT EXISTS identities (
+		id        SERIAL PRIMARY KEY,
+		userId    INTEGER NOT NULL REFERENCES users(id),
+		provider  VARCHAR(64) NOT NULL,
+		subject   VARCHAR(256) NOT NULL,
+		email     VARCHAR(256),
+		createdAt TIMESTAMP,
+		UNIQUE (provider, subject)
+	);
+	CREATE INDEX IF NOT EXISTS userIdIndexOnIdentities ON identities (
+		userId ASC
+	);
+	INSERT INTO identities (userId, provider, subject, email, createdAt)
+		SELECT id, 'google', googleId, email, createdAt FROM users;
+	ALTER TABLE users DROP COLUMN googleId;
+	ALTER TABLE users ADD COLUMN name VARCHAR(256) NOT NULL DEFAULT '';`,
+	`CREATE TABLE IF NOT EXISTS passwords (
+		userId       INTEGER PRIMARY KEY REFERENCES users(id),
+		passwordHash VARCHAR(256) NOT NULL,
+		verifiedAt   TIMESTAMP,
+		updatedAt    TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS email_tokens (
+		id        SERIAL PRIMARY KEY,
+		userId    INTEGER NOT NULL REFERENCES users(id),
+		purpose   VARCHAR(32) NOT NULL,
+		tokenHash VARCHAR(64) NOT NULL UNIQUE,
+		expiresAt TIMESTAMP NOT NULL,
+		usedAt    TIMESTAMP,
+		createdAt TIMESTAMP
+	);`,
+	`CREATE TABLE IF NOT EXISTS sessions (
+		id         SERIAL PRIMARY KEY,
+		tokenHash  VARCHAR(64) NOT NULL UNIQUE,
+		userId     INTEGER NOT NULL DEFAULT 0,
+		data       BYTEA,
+		userAgent  TEXT,
+		ip         VARCHAR(64),
+		createdAt  TIMESTAMP,
+		lastSeenAt TIMESTAMP,
+		expiresAt  TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS userIdIndexOnSessions ON sessions (
+		userId ASC
+	);`,
+	`CREATE TABLE IF NOT EXISTS access_tokens (
+		id         SERIAL PRIMARY KEY,
+		userId     INTEGER NOT NULL REFERENCES users(id),
+		name       VARCHAR(256) NOT NULL,
+		tokenHash  VARCHAR(64) NOT NULL UNIQUE,
+		scopes     VARCHAR(256) NOT NULL,
+		createdAt  TIMESTAMP,
+		expiresAt  TIMESTAMP NOT NULL,
+		lastUsedAt TIMESTAMP,
+		lastUsedIP VARCHAR(64)
+	);
+	CREATE INDEX IF NOT EXISTS userIdIndexOnAccessTokens ON access_tokens (
+		userId ASC
+	);`,
+	`CREATE TABLE IF NOT EXISTS rate_limits (
+		bucketKey VARCHAR(256) PRIMARY KEY,
+		tokens    DOUBLE PRECISION NOT NULL,
+		updatedAt TIMESTAMP NOT NULL
+	);`,
+	`CREATE TABLE IF NOT EXISTS todo_tags (
+		todoId INTEGER NOT NULL REFERENCES todos(id),
+		tag    VARCHAR(256) NOT NULL,
+		PRIMARY KEY (todoId, tag)
+	);
+	CREATE INDEX IF NOT EXISTS tagIndexOnTodoTags ON todo_tags (
+		tag ASC
+	);
+	CREATE TABLE IF NOT EXISTS todo_history (
+		id        SERIAL PRIMARY KEY,
+		todoId    INTEGER NOT NULL REFERENCES todos(id),
+		type      VARCHAR(32) NOT NULL,
+		name      TEXT,
+		completed BOOLEAN,
+		createdAt TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS todoIdIndexOnTodoHistory ON todo_history (
+		todoId ASC
+	);`,
+}
+
+func (s *pqHandler) GetTodos(ctx context.Context, userID int) []*Todo {
 	todos := []*Todo{}
-	rows, err := s.db.Query("SELECT id, name, completed, createdAt FROM todos WHERE sessionId=$1", sessionId)
+	rows, err := s.db.QueryContext(ctx, "SELECT id, name, completed, createdAt FROM todos WHERE userId=$1", userID)
 	if err != nil {
 		panic(err)
 	}
@@ -26,14 +140,68 @@ func (s *pqHandler) GetTodos(sessionId string) []*Todo {
 	return todos
 }
 
-func (s *pqHandler) AddTodo(name string, sessionId string) *Todo {
-	stmt, err := s.db.Prepare("INSERT INTO todos (sessionId, name, completed, createdAt) VALUES ($1, $2, $3, NOW()) RETURNING id")
+func (s *pqHandler) FindTodos(ctx context.Context, userID int, filter TodoFilter) ([]*Todo, int) {
+	args := []interface{}{userID}
+	param := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	where := "userId=$1"
+	if filter.Completed != nil {
+		where += " AND completed=" + param(*filter.Completed)
+	}
+	if filter.Search != "" {
+		where += " AND name ILIKE " + param(likePattern(filter.Search)) + ` ESCAPE '\'`
+	}
+	if filter.Tag != "" {
+		where += " AND id IN (SELECT todoId FROM todo_tags WHERE tag=" + param(filter.Tag) + ")"
+	}
+	var total int
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM todos WHERE "+where, args...).Scan(&total); err != nil {
+		panic(err)
+	}
+
+	todos := []*Todo{}
+	query := "SELECT id, name, completed, createdAt FROM todos WHERE " + where + " AND id>" + param(filter.AfterID) + " ORDER BY id LIMIT " + param(filter.Limit)
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var todo Todo
+		rows.Scan(&todo.ID, &todo.Name, &todo.Completed, &todo.CreatedAt)
+		todos = append(todos, &todo)
+	}
+	return todos, total
+}
+
+func (s *pqHandler) GetTodo(ctx context.Context, userID int, id int) *Todo {
+	var todo Todo
+	err := s.db.QueryRowContext(ctx, "SELECT id, name, completed, createdAt FROM todos WHERE id=$1 AND userId=$2", id, userID).
+		Scan(&todo.ID, &todo.Name, &todo.Completed, &todo.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		panic(err)
+	}
+	return &todo
+}
+
+func (s *pqHandler) AddTodo(ctx context.Context, userID int, name string) *Todo {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		panic(err)
 	}
 	var id int
-	err = stmt.QueryRow(sessionId, name, false).Scan(&id)
+	err = tx.QueryRowContext(ctx, "INSERT INTO todos (userId, name, completed, createdAt) VALUES ($1, $2, $3, NOW()) RETURNING id", userID, name, false).Scan(&id)
 	if err != nil {
+		tx.Rollback()
+		panic(err)
+	}
+	s.recordTodoChange(ctx, tx, id, TodoAdded)
+	if err = tx.Commit(); err != nil {
 		panic(err)
 	}
 	var todo Todo
@@ -44,12 +212,304 @@ func (s *pqHandler) AddTodo(name string, sessionId string) *Todo {
 	return &todo
 }
 
-func (s *pqHandler) RemoveTodo(id int) bool {
-	stmt, err := s.db.Prepare("DELETE FROM todos WHERE id=$1")
+func (s *pqHandler) RemoveTodo(ctx context.Context, userID int, id int) bool {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		panic(err)
+	}
+	// The tags and history reference the todo, so they go first
+	mustExec(ctx, tx, "DELETE FROM todo_tags WHERE todoId IN (SELECT id FROM todos WHERE id=$1 AND userId=$2)", id, userID)
+	mustExec(ctx, tx, "DELETE FROM todo_history WHERE todoId IN (SELECT id FROM todos WHERE id=$1 AND userId=$2)", id, userID)
+	rst := mustExec(ctx, tx, "DELETE FROM todos WHERE id=$1 AND userId=$2", id, userID)
+	if err = tx.Commit(); err != nil {
+		panic(err)
+	}
+	cnt, _ := rst.RowsAffected()
+	return cnt > 0
+}
+
+func (s *pqHandler) CompleteTodo(ctx context.Context, userID int, id int, complete bool) bool {
+	return s.updateTodo(ctx, userID, id, completedChange(complete), "UPDATE todos SET completed=$1 WHERE id=$2 AND userId=$3", complete, id, userID)
+}
+
+func (s *pqHandler) RenameTodo(ctx context.Context, userID int, id int, name string) bool {
+	return s.updateTodo(ctx, userID, id, TodoRenamed, "UPDATE todos SET name=$1 WHERE id=$2 AND userId=$3", name, id, userID)
+}
+
+// updateTodo runs query, which updates the todo if the user owns it, and
+// records the change.
+func (s *pqHandler) updateTodo(ctx context.Context, userID int, id int, change string, query string, args ...interface{}) bool {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		panic(err)
+	}
+	rst := mustExec(ctx, tx, query, args...)
+	if cnt, _ := rst.RowsAffected(); cnt == 0 {
+		tx.Rollback()
+		return false
+	}
+	s.recordTodoChange(ctx, tx, id, change)
+	if err = tx.Commit(); err != nil {
+		panic(err)
+	}
+	return true
+}
+
+func (s *pqHandler) SetTodoTags(ctx context.Context, userID int, id int, tags []string) bool {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		panic(err)
+	}
+	var owned int
+	if err = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM todos WHERE id=$1 AND userId=$2", id, userID).Scan(&owned); err != nil {
+		tx.Rollback()
+		panic(err)
+	}
+	if owned == 0 {
+		tx.Rollback()
+		return false
+	}
+	mustExec(ctx, tx, "DELETE FROM todo_tags WHERE todoId=$1", id)
+	for _, tag := range tags {
+		mustExec(ctx, tx, "INSERT INTO todo_tags (todoId, tag) VALUES ($1, $2) ON CONFLICT DO NOTHING", id, tag)
+	}
+	s.recordTodoChange(ctx, tx, id, TodoTagged)
+	if err = tx.Commit(); err != nil {
+		panic(err)
+	}
+	return true
+}
+
+// recordTodoChange adds the todo as it is now to its history.
+func (s *pqHandler) recordTodoChange(ctx context.Context, tx *sql.Tx, id int, change string) {
+	mustExec(ctx, tx, "INSERT INTO todo_history (todoId, type, name, completed, createdAt) SELECT id, $1, name, completed, NOW() FROM todos WHERE id=$2", change, id)
+}
+
+func (s *pqHandler) GetTagsByTodos(ctx context.Context, ids []int) map[int][]string {
+	byTodo := map[int][]string{}
+	rows, err := s.db.QueryContext(ctx, "SELECT todoId, tag FROM todo_tags WHERE todoId = ANY($1) ORDER BY todoId, tag", pq.Array(ids))
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var todoID int
+		var tag string
+		rows.Scan(&todoID, &tag)
+		byTodo[todoID] = append(byTodo[todoID], tag)
+	}
+	return byTodo
+}
+
+func (s *pqHandler) GetHistoryByTodos(ctx context.Context, ids []int) map[int][]*TodoChange {
+	byTodo := map[int][]*TodoChange{}
+	rows, err := s.db.QueryContext(ctx, "SELECT todoId, type, name, completed, createdAt FROM todo_history WHERE todoId = ANY($1) ORDER BY id", pq.Array(ids))
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var todoID int
+		var change TodoChange
+		rows.Scan(&todoID, &change.Type, &change.Name, &change.Completed, &change.CreatedAt)
+		byTodo[todoID] = append(byTodo[todoID], &change)
+	}
+	return byTodo
+}
+
+func (s *pqHandler) SignInUser(ctx context.Context, identity *Identity) *User {
+	var userID int
+	err := s.db.QueryRowContext(ctx, "SELECT userId FROM identities WHERE provider=$1 AND subject=$2", identity.Provider, identity.Subject).Scan(&userID)
+	if err == sql.ErrNoRows {
+		userID = s.createUser(ctx, identity)
+	} else if err != nil {
+		panic(err)
+	}
+
+	_, err = s.db.ExecContext(ctx,
+		`UPDATE users SET email=COALESCE(NULLIF($1, ''), email), name=COALESCE(NULLIF($2, ''), name),
+		picture=COALESCE(NULLIF($3, ''), picture), lastLoginAt=NOW() WHERE id=$4`,
+		identity.Email, identity.Name, identity.Picture, userID)
+	if err != nil {
+		panic(err)
+	}
+	_, err = s.db.ExecContext(ctx, "UPDATE identities SET email=$1 WHERE provider=$2 AND subject=$3", identity.Email, identity.Provider, identity.Subject)
+	if err != nil {
+		panic(err)
+	}
+	// todos.sessionId used to hold the Google ID of the owner
+	if identity.Provider == "google" {
+		rst, err := s.db.ExecContext(ctx, "UPDATE todos SET userId=$1 WHERE sessionId=$2 AND userId IS NULL", userID, identity.Subject)
+		if err != nil {
+			panic(err)
+		}
+		if cnt, _ := rst.RowsAffected(); cnt > 0 {
+			logging.FromContext(ctx).WithFields(logrus.Fields{"user_id": userID, "todos": cnt}).Info("linked legacy todos to user")
+		}
+	}
+	return s.GetUser(ctx, userID)
+}
+
+// createUser creates a user owning identity. If another request linked the
+// identity first, that user is returned instead.
+func (s *pqHandler) createUser(ctx context.Context, identity *Identity) int {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		panic(err)
+	}
+	var userID int
+	err = tx.QueryRowContext(ctx, "INSERT INTO users (email, name, picture, createdAt, lastLoginAt) VALUES ($1, $2, $3, NOW(), NOW()) RETURNING id",
+		identity.Email, identity.Name, identity.Picture).Scan(&userID)
+	if err != nil {
+		tx.Rollback()
+		panic(err)
+	}
+	rst, err := tx.ExecContext(ctx, "INSERT INTO identities (userId, provider, subject, email, createdAt) VALUES ($1, $2, $3, $4, NOW()) ON CONFLICT (provider, subject) DO NOTHING",
+		userID, identity.Provider, identity.Subject, identity.Email)
+	if err != nil {
+		tx.Rollback()
+		panic(err)
+	}
+	if cnt, _ := rst.RowsAffected(); cnt == 0 {
+		tx.Rollback()
+		err = s.db.QueryRowContext(ctx, "SELECT userId FROM identities WHERE provider=$1 AND subject=$2", identity.Provider, identity.Subject).Scan(&userID)
+		if err != nil {
+			panic(err)
+		}
+		return userID
+	}
+	if err = tx.Commit(); err != nil {
+		panic(err)
+	}
+	return userID
+}
+
+func (s *pqHandler) LinkIdentity(ctx context.Context, userID int, identity *Identity) bool {
+	_, err := s.db.ExecContext(ctx, "INSERT INTO identities (userId, provider, subject, email, createdAt) VALUES ($1, $2, $3, $4, NOW()) ON CONFLICT (provider, subject) DO NOTHING",
+		userID, identity.Provider, identity.Subject, identity.Email)
+	if err != nil {
+		panic(err)
+	}
+	var owner int
+	err = s.db.QueryRowContext(ctx, "SELECT userId FROM identities WHERE provider=$1 AND subject=$2", identity.Provider, identity.Subject).Scan(&owner)
+	if err != nil {
+		panic(err)
+	}
+	return owner == userID
+}
+
+func (s *pqHandler) GetUser(ctx context.Context, id int) *User {
+	var user User
+	err := s.db.QueryRowContext(ctx, "SELECT id, email, name, picture, createdAt, lastLoginAt FROM users WHERE id=$1", id).
+		Scan(&user.ID, &user.Email, &user.Name, &user.Picture, &user.CreatedAt, &user.LastLoginAt)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		panic(err)
+	}
+	return &user
+}
+
+func (s *pqHandler) GetUsers(ctx context.Context, ids []int) []*User {
+	users := []*User{}
+	rows, err := s.db.QueryContext(ctx, "SELECT id, email, name, picture, createdAt, lastLoginAt FROM users WHERE id = ANY($1)", pq.Array(ids))
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var user User
+		rows.Scan(&user.ID, &user.Email, &user.Name, &user.Picture, &user.CreatedAt, &user.LastLoginAt)
+		users = append(users, &user)
+	}
+	return users
+}
+
+func (s *pqHandler) GetIdentities(ctx context.Context, userID int) []*Identity {
+	identities := []*Identity{}
+	rows, err := s.db.QueryContext(ctx, "SELECT provider, subject, email, createdAt FROM identities WHERE userId=$1 ORDER BY id", userID)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var identity Identity
+		rows.Scan(&identity.Provider, &identity.Subject, &identity.Email, &identity.CreatedAt)
+		identities = append(identities, &identity)
+	}
+	return identities
+}
+
+func (s *pqHandler) GetIdentitiesByUsers(ctx context.Context, ids []int) map[int][]*Identity {
+	byUser := map[int][]*Identity{}
+	rows, err := s.db.QueryContext(ctx, "SELECT userId, provider, subject, email, createdAt FROM identities WHERE userId = ANY($1) ORDER BY id", pq.Array(ids))
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID int
+		var identity Identity
+		rows.Scan(&userID, &identity.Provider, &identity.Subject, &identity.Email, &identity.CreatedAt)
+		byUser[userID] = append(byUser[userID], &identity)
+	}
+	return byUser
+}
+
+func (s *pqHandler) CreateLocalAccount(ctx context.Context, email string, passwordHash []byte) *User {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		panic(err)
 	}
-	rst, err := stmt.Exec(id)
+	var userID int
+	err = tx.QueryRowContext(ctx, "INSERT INTO users (email, name, picture, createdAt, lastLoginAt) VALUES ($1, '', '', NOW(), NOW()) RETURNING id", email).Scan(&userID)
+	if err != nil {
+		tx.Rollback()
+		panic(err)
+	}
+	rst, err := tx.ExecContext(ctx, "INSERT INTO identities (userId, provider, subject, email, createdAt) VALUES ($1, 'local', $2, $3, NOW()) ON CONFLICT (provider, subject) DO NOTHING",
+		userID, email, email)
+	if err != nil {
+		tx.Rollback()
+		panic(err)
+	}
+	if cnt, _ := rst.RowsAffected(); cnt == 0 {
+		tx.Rollback()
+		return nil
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO passwords (userId, passwordHash, updatedAt) VALUES ($1, $2, NOW())", userID, string(passwordHash))
+	if err != nil {
+		tx.Rollback()
+		panic(err)
+	}
+	if err = tx.Commit(); err != nil {
+		panic(err)
+	}
+	return s.GetUser(ctx, userID)
+}
+
+func (s *pqHandler) GetLocalAccount(ctx context.Context, email string) *LocalAccount {
+	var account LocalAccount
+	var passwordHash string
+	var verifiedAt sql.NullTime
+	err := s.db.QueryRowContext(ctx,
+		`SELECT i.userId, i.email, p.passwordHash, p.verifiedAt FROM identities i
+		JOIN passwords p ON p.userId = i.userId WHERE i.provider='local' AND i.subject=$1`, email).
+		Scan(&account.UserID, &account.Email, &passwordHash, &verifiedAt)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		panic(err)
+	}
+	account.PasswordHash = []byte(passwordHash)
+	account.Verified = verifiedAt.Valid
+	return &account
+}
+
+func (s *pqHandler) SetPasswordHash(ctx context.Context, userID int, passwordHash []byte) bool {
+	rst, err := s.db.ExecContext(ctx, "UPDATE passwords SET passwordHash=$1, updatedAt=NOW() WHERE userId=$2", string(passwordHash), userID)
 	if err != nil {
 		panic(err)
 	}
@@ -57,12 +517,94 @@ func (s *pqHandler) RemoveTodo(id int) bool {
 	return cnt > 0
 }
 
-func (s *pqHandler) CompleteTodo(id int, complete bool) bool {
-	stmt, err := s.db.Prepare("UPDATE todos SET completed=$1 WHERE id=$2")
+func (s *pqHandler) SetEmailVerified(ctx context.Context, userID int) bool {
+	rst, err := s.db.ExecContext(ctx, "UPDATE passwords SET verifiedAt=COALESCE(verifiedAt, NOW()) WHERE userId=$1", userID)
+	if err != nil {
+		panic(err)
+	}
+	cnt, _ := rst.RowsAffected()
+	return cnt > 0
+}
+
+func (s *pqHandler) CreateEmailToken(ctx context.Context, userID int, purpose string, tokenHash string, expiresAt time.Time) {
+	_, err := s.db.ExecContext(ctx, "INSERT INTO email_tokens (userId, purpose, tokenHash, expiresAt, createdAt) VALUES ($1, $2, $3, $4, NOW())",
+		userID, purpose, tokenHash, expiresAt.UTC())
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (s *pqHandler) UseEmailToken(ctx context.Context, purpose string, tokenHash string) int {
+	var id, userID int
+	var expiresAt time.Time
+	err := s.db.QueryRowContext(ctx, "SELECT id, userId, expiresAt FROM email_tokens WHERE purpose=$1 AND tokenHash=$2 AND usedAt IS NULL", purpose, tokenHash).
+		Scan(&id, &userID, &expiresAt)
+	if err == sql.ErrNoRows {
+		return 0
+	}
 	if err != nil {
 		panic(err)
 	}
-	rst, err := stmt.Exec(complete, id)
+	if time.Now().After(expiresAt) {
+		return 0
+	}
+	rst, err := s.db.ExecContext(ctx, "UPDATE email_tokens SET usedAt=NOW() WHERE id=$1 AND usedAt IS NULL", id)
+	if err != nil {
+		panic(err)
+	}
+	if cnt, _ := rst.RowsAffected(); cnt == 0 {
+		return 0
+	}
+	return userID
+}
+
+func (s *pqHandler) CreateSession(ctx context.Context, session *Session) int {
+	var id int
+	err := s.db.QueryRowContext(ctx,
+		`INSERT INTO sessions (tokenHash, userId, data, userAgent, ip, createdAt, lastSeenAt, expiresAt)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`,
+		session.TokenHash, session.UserID, session.Data, session.UserAgent, session.IP,
+		session.CreatedAt.UTC(), session.LastSeenAt.UTC(), session.ExpiresAt.UTC()).Scan(&id)
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
+
+func (s *pqHandler) GetSession(ctx context.Context, tokenHash string) *Session {
+	var session Session
+	err := s.db.QueryRowContext(ctx,
+		`SELECT id, tokenHash, userId, data, userAgent, ip, createdAt, lastSeenAt, expiresAt
+		FROM sessions WHERE tokenHash=$1`, tokenHash).
+		Scan(&session.ID, &session.TokenHash, &session.UserID, &session.Data, &session.UserAgent, &session.IP,
+			&session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		panic(err)
+	}
+	return &session
+}
+
+func (s *pqHandler) UpdateSession(ctx context.Context, tokenHash string, userID int, data []byte) bool {
+	rst, err := s.db.ExecContext(ctx, "UPDATE sessions SET userId=$1, data=$2 WHERE tokenHash=$3", userID, data, tokenHash)
+	if err != nil {
+		panic(err)
+	}
+	cnt, _ := rst.RowsAffected()
+	return cnt > 0
+}
+
+func (s *pqHandler) TouchSession(ctx context.Context, tokenHash string, lastSeenAt time.Time, ip string) {
+	_, err := s.db.ExecContext(ctx, "UPDATE sessions SET lastSeenAt=$1, ip=$2 WHERE tokenHash=$3", lastSeenAt.UTC(), ip, tokenHash)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (s *pqHandler) DeleteSession(ctx context.Context, tokenHash string) bool {
+	rst, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE tokenHash=$1", tokenHash)
 	if err != nil {
 		panic(err)
 	}
@@ -70,40 +612,179 @@ func (s *pqHandler) CompleteTodo(id int, complete bool) bool {
 	return cnt > 0
 }
 
+func (s *pqHandler) GetUserSessions(ctx context.Context, userID int) []*Session {
+	sessions := []*Session{}
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, tokenHash, userId, userAgent, ip, createdAt, lastSeenAt, expiresAt
+		FROM sessions WHERE userId=$1 ORDER BY lastSeenAt DESC`, userID)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var session Session
+		rows.Scan(&session.ID, &session.TokenHash, &session.UserID, &session.UserAgent, &session.IP,
+			&session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt)
+		sessions = append(sessions, &session)
+	}
+	return sessions
+}
+
+func (s *pqHandler) DeleteUserSession(ctx context.Context, userID int, id int) bool {
+	rst, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE id=$1 AND userId=$2", id, userID)
+	if err != nil {
+		panic(err)
+	}
+	cnt, _ := rst.RowsAffected()
+	return cnt > 0
+}
+
+func (s *pqHandler) DeleteUserSessions(ctx context.Context, userID int) int {
+	rst, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE userId=$1", userID)
+	if err != nil {
+		panic(err)
+	}
+	cnt, _ := rst.RowsAffected()
+	return int(cnt)
+}
+
+func (s *pqHandler) DeleteExpiredSessions(ctx context.Context, now time.Time, idleSince time.Time) int {
+	rst, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE expiresAt < $1 OR lastSeenAt < $2", now.UTC(), idleSince.UTC())
+	if err != nil {
+		panic(err)
+	}
+	cnt, _ := rst.RowsAffected()
+	return int(cnt)
+}
+
+func (s *pqHandler) CountActiveSessions(ctx context.Context, now time.Time, idleSince time.Time) int {
+	var cnt int
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sessions WHERE userId <> 0 AND expiresAt >= $1 AND lastSeenAt >= $2", now.UTC(), idleSince.UTC()).Scan(&cnt)
+	if err != nil {
+		panic(err)
+	}
+	return cnt
+}
+
+func (s *pqHandler) CreateAccessToken(ctx context.Context, token *AccessToken) int {
+	var id int
+	err := s.db.QueryRowContext(ctx,
+		`INSERT INTO access_tokens (userId, name, tokenHash, scopes, createdAt, expiresAt, lastUsedIP)
+		VALUES ($1, $2, $3, $4, $5, $6, '') RETURNING id`,
+		token.UserID, token.Name, token.TokenHash, strings.Join(token.Scopes, " "),
+		token.CreatedAt.UTC(), token.ExpiresAt.UTC()).Scan(&id)
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
+
+func (s *pqHandler) GetAccessToken(ctx context.Context, tokenHash string) *AccessToken {
+	token, err := scanAccessToken(s.db.QueryRowContext(ctx,
+		`SELECT id, userId, name, tokenHash, scopes, createdAt, expiresAt, lastUsedAt, lastUsedIP
+		FROM access_tokens WHERE tokenHash=$1`, tokenHash).Scan)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		panic(err)
+	}
+	return token
+}
+
+func (s *pqHandler) GetAccessTokens(ctx context.Context, userID int) []*AccessToken {
+	tokens := []*AccessToken{}
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, userId, name, tokenHash, scopes, createdAt, expiresAt, lastUsedAt, lastUsedIP
+		FROM access_tokens WHERE userId=$1 ORDER BY id`, userID)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		token, err := scanAccessToken(rows.Scan)
+		if err != nil {
+			panic(err)
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
+
+func (s *pqHandler) RevokeAccessToken(ctx context.Context, userID int, id int) bool {
+	rst, err := s.db.ExecContext(ctx, "DELETE FROM access_tokens WHERE id=$1 AND userId=$2", id, userID)
+	if err != nil {
+		panic(err)
+	}
+	cnt, _ := rst.RowsAffected()
+	return cnt > 0
+}
+
+func (s *pqHandler) TouchAccessToken(ctx context.Context, id int, lastUsedAt time.Time, ip string) {
+	_, err := s.db.ExecContext(ctx, "UPDATE access_tokens SET lastUsedAt=$1, lastUsedIP=$2 WHERE id=$3", lastUsedAt.UTC(), ip, id)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (s *pqHandler) Stats() sql.DBStats {
+	return s.db.Stats()
+}
+
+func (s *pqHandler) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *pqHandler) SchemaVersion(ctx context.Context) (int, int, error) {
+	applied, err := appliedVersion(ctx, s.db)
+	return applied, len(pqMigrations), err
+}
+
 func (s *pqHandler) Close() {
 	s.db.Close()
 }
 
-func newPQHandler(dbConn string) DBHandler {
+func newPQHandler(ctx context.Context, dbConn string) DBHandler {
 	database, err := sql.Open("postgres", dbConn)
 	if err != nil {
 		panic(err)
 	}
-	statement, err := database.Prepare(
-		`CREATE TABLE IF NOT EXISTS todos (
-			id        SERIAL PRIMARY KEY, 
-			sessionId VARCHAR(256),
-			name      TEXT,
-			completed BOOLEAN,
-			createdAt TIMESTAMP
-		);`)
+	migrate(ctx, database, pqMigrations)
+	return &pqHandler{db: database}
+}
+
+func (s *pqHandler) TakeToken(ctx context.Context, key string, capacity int, interval time.Duration, now time.Time) (Bucket, bool) {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		panic(err)
 	}
-	_, err = statement.Exec()
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, "INSERT INTO rate_limits (bucketKey, tokens, updatedAt) VALUES ($1, $2, $3) ON CONFLICT (bucketKey) DO NOTHING",
+		key, float64(capacity), now.UTC())
 	if err != nil {
 		panic(err)
 	}
-	statement, err = database.Prepare(
-		`CREATE INDEX IF NOT EXISTS sessionIdIndexOnTodos ON todos (
-			sessionId ASC
-		);`)
+	var bucket Bucket
+	err = tx.QueryRowContext(ctx, "SELECT tokens, updatedAt FROM rate_limits WHERE bucketKey=$1 FOR UPDATE", key).
+		Scan(&bucket.Tokens, &bucket.UpdatedAt)
 	if err != nil {
 		panic(err)
 	}
-	_, err = statement.Exec()
+	ok := bucket.Take(capacity, interval, now)
+	if _, err = tx.ExecContext(ctx, "UPDATE rate_limits SET tokens=$1, updatedAt=$2 WHERE bucketKey=$3", bucket.Tokens, now.UTC(), key); err != nil {
+		panic(err)
+	}
+	if err = tx.Commit(); err != nil {
+		panic(err)
+	}
+	return bucket, ok
+}
+
+func (s *pqHandler) DeleteIdleBuckets(ctx context.Context, idleSince time.Time) int {
+	rst, err := s.db.ExecContext(ctx, "DELETE FROM rate_limits WHERE updatedAt < $1", idleSince.UTC())
 	if err != nil {
 		panic(err)
 	}
-	return &pqHandler{db: database}
+	cnt, _ := rst.RowsAffected()
+	return int(cnt)
 }
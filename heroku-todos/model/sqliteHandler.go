@@ -1,19 +1,142 @@
 package model
 
 import (
+	"context"
 	"database/sql"
+	"strings"
 	"time"
 
+	"tuckersWeb/todos/logging"
+
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/sirupsen/logrus"
 )
 
 type sqliteHandler struct {
 	db *sql.DB
 }
 
-func (s *sqliteHandler) GetTodos(sessionId string) []*Todo {
+var sqliteMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS todos (
+		id        INTEGER  PRIMARY KEY AUTOINCREMENT,
+		sessionId STRING,
+		name      TEXT,
+		completed BOOLEAN,
+		createdAt DATETIME
+	);
+	CREATE INDEX IF NOT EXISTS sessionIdIndexOnTodos ON todos (
+		sessionId ASC
+	);`,
+	`CREATE TABLE IF NOT EXISTS users (
+		id          INTEGER  PRIMARY KEY AUTOINCREMENT,
+		googleId    STRING   NOT NULL UNIQUE,
+		email       STRING,
+		picture     TEXT,
+		createdAt   DATETIME,
+		lastLoginAt DATETIME
+	);
+	ALTER TABLE todos ADD COLUMN userId INTEGER REFERENCES users(id);
+	CREATE INDEX IF NOT EXISTS userIdIndexOnTodos ON todos (
+		userId ASC
+	);`,
+	`CREATE TABLE IF NOT EXISTS identities (
+		id        INTEGER  PRIMARY KEY AUTOINCREMENT,
+		userId    INTEGER  NOT NULL REFERENCES users(id),
+		provider  STRING   NOT NULL,
+		subject   STRING   NOT NULL,
+		email     STRING,
+		createdAt DATETIME,
+		UNIQUE (provider, subject)
+	);
+	CREATE INDEX IF NOT EXISTS userIdIndexOnIdentities ON identities (
+		userId ASC
+	);
+	INSERT INTO identities (userId, provider, subject, email, createdAt)
+		SELECT id, 'google', googleId, email, createdAt FROM users;
+	CREATE TABLE users_new (
+		id          INTEGER  PRIMARY KEY AUTOINCREMENT,
+		email       STRING,
+		name        STRING   NOT NULL DEFAULT '',
+		picture     TEXT,
+		createdAt   DATETIME,
+		lastLoginAt DATETIME
+	);
+	INSERT INTO users_new (id, email, picture, createdAt, lastLoginAt)
+		SELECT id, email, picture, createdAt, lastLoginAt FROM users;
+	DROP TABLE users;
+	ALTER TABLE users_new RENAME TO users;`,
+	`CREATE TABLE IF NOT EXISTS passwords (
+		userId       INTEGER  PRIMARY KEY REFERENCES users(id),
+		passwordHash STRING   NOT NULL,
+		verifiedAt   DATETIME,
+		updatedAt    DATETIME
+	);
+	CREATE TABLE IF NOT EXISTS email_tokens (
+		id        INTEGER  PRIMARY KEY AUTOINCREMENT,
+		userId    INTEGER  NOT NULL REFERENCES users(id),
+		purpose   STRING   NOT NULL,
+		tokenHash STRING   NOT NULL UNIQUE,
+		expiresAt DATETIME NOT NULL,
+		usedAt    DATETIME,
+		createdAt DATETIME
+	);`,
+	`CREATE TABLE IF NOT EXISTS sessions (
+		id         INTEGER  PRIMARY KEY AUTOINCREMENT,
+		tokenHash  STRING   NOT NULL UNIQUE,
+		userId     INTEGER  NOT NULL DEFAULT 0,
+		data       BLOB,
+		userAgent  TEXT,
+		ip         STRING,
+		createdAt  DATETIME,
+		lastSeenAt DATETIME,
+		expiresAt  DATETIME
+	);
+	CREATE INDEX IF NOT EXISTS userIdIndexOnSessions ON sessions (
+		userId ASC
+	);`,
+	`CREATE TABLE IF NOT EXISTS access_tokens (
+		id         INTEGER  PRIMARY KEY AUTOINCREMENT,
+		userId     INTEGER  NOT NULL REFERENCES users(id),
+		name       STRING   NOT NULL,
+		tokenHash  STRING   NOT NULL UNIQUE,
+		scopes     STRING   NOT NULL,
+		createdAt  DATETIME,
+		expiresAt  DATETIME NOT NULL,
+		lastUsedAt DATETIME,
+		lastUsedIP STRING
+	);
+	CREATE INDEX IF NOT EXISTS userIdIndexOnAccessTokens ON access_tokens (
+		userId ASC
+	);`,
+	`CREATE TABLE IF NOT EXISTS rate_limits (
+		bucketKey STRING   PRIMARY KEY,
+		tokens    REAL     NOT NULL,
+		updatedAt DATETIME NOT NULL
+	);`,
+	`CREATE TABLE IF NOT EXISTS todo_tags (
+		todoId INTEGER NOT NULL REFERENCES todos(id),
+		tag    STRING  NOT NULL,
+		PRIMARY KEY (todoId, tag)
+	);
+	CREATE INDEX IF NOT EXISTS tagIndexOnTodoTags ON todo_tags (
+		tag ASC
+	);
+	CREATE TABLE IF NOT EXISTS todo_history (
+		id        INTEGER  PRIMARY KEY AUTOINCREMENT,
+		todoId    INTEGER  NOT NULL REFERENCES todos(id),
+		type      STRING   NOT NULL,
+		name      TEXT,
+		completed BOOLEAN,
+		createdAt DATETIME
+	);
+	CREATE INDEX IF NOT EXISTS todoIdIndexOnTodoHistory ON todo_history (
+		todoId ASC
+	);`,
+}
+
+func (s *sqliteHandler) GetTodos(ctx context.Context, userID int) []*Todo {
 	todos := []*Todo{}
-	rows, err := s.db.Query("SELECT id, name, completed, createdAt FROM todos WHERE sessionId=?", sessionId)
+	rows, err := s.db.QueryContext(ctx, "SELECT id, name, completed, createdAt FROM todos WHERE userId=?", userID)
 	if err != nil {
 		panic(err)
 	}
@@ -26,16 +149,65 @@ func (s *sqliteHandler) GetTodos(sessionId string) []*Todo {
 	return todos
 }
 
-func (s *sqliteHandler) AddTodo(name string, sessionId string) *Todo {
-	stmt, err := s.db.Prepare("INSERT INTO todos (sessionId, name, completed, createdAt) VALUES (?, ?, ?, datetime('now'))")
+func (s *sqliteHandler) FindTodos(ctx context.Context, userID int, filter TodoFilter) ([]*Todo, int) {
+	where := "userId=?"
+	args := []interface{}{userID}
+	if filter.Completed != nil {
+		where += " AND completed=?"
+		args = append(args, *filter.Completed)
+	}
+	if filter.Search != "" {
+		where += ` AND name LIKE ? ESCAPE '\'`
+		args = append(args, likePattern(filter.Search))
+	}
+	if filter.Tag != "" {
+		where += " AND id IN (SELECT todoId FROM todo_tags WHERE tag=?)"
+		args = append(args, filter.Tag)
+	}
+	var total int
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM todos WHERE "+where, args...).Scan(&total); err != nil {
+		panic(err)
+	}
+
+	todos := []*Todo{}
+	rows, err := s.db.QueryContext(ctx, "SELECT id, name, completed, createdAt FROM todos WHERE "+where+" AND id>? ORDER BY id LIMIT ?",
+		append(args, filter.AfterID, filter.Limit)...)
 	if err != nil {
 		panic(err)
 	}
-	rst, err := stmt.Exec(sessionId, name, false)
+	defer rows.Close()
+	for rows.Next() {
+		var todo Todo
+		rows.Scan(&todo.ID, &todo.Name, &todo.Completed, &todo.CreatedAt)
+		todos = append(todos, &todo)
+	}
+	return todos, total
+}
+
+func (s *sqliteHandler) GetTodo(ctx context.Context, userID int, id int) *Todo {
+	var todo Todo
+	err := s.db.QueryRowContext(ctx, "SELECT id, name, completed, createdAt FROM todos WHERE id=? AND userId=?", id, userID).
+		Scan(&todo.ID, &todo.Name, &todo.Completed, &todo.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil
+	}
 	if err != nil {
 		panic(err)
 	}
+	return &todo
+}
+
+func (s *sqliteHandler) AddTodo(ctx context.Context, userID int, name string) *Todo {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		panic(err)
+	}
+	rst := mustExec(ctx, tx, "INSERT INTO todos (userId, name, completed, createdAt) VALUES (?, ?, ?, datetime('now'))", userID, name, false)
 	id, _ := rst.LastInsertId()
+	s.recordTodoChange(ctx, tx, int(id), TodoAdded)
+	if err = tx.Commit(); err != nil {
+		panic(err)
+	}
 	var todo Todo
 	todo.ID = int(id)
 	todo.Name = name
@@ -44,12 +216,340 @@ func (s *sqliteHandler) AddTodo(name string, sessionId string) *Todo {
 	return &todo
 }
 
-func (s *sqliteHandler) RemoveTodo(id int) bool {
-	stmt, err := s.db.Prepare("DELETE FROM todos WHERE id=?")
+func (s *sqliteHandler) RemoveTodo(ctx context.Context, userID int, id int) bool {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		panic(err)
+	}
+	rst := mustExec(ctx, tx, "DELETE FROM todos WHERE id=? AND userId=?", id, userID)
+	if cnt, _ := rst.RowsAffected(); cnt == 0 {
+		tx.Rollback()
+		return false
+	}
+	mustExec(ctx, tx, "DELETE FROM todo_tags WHERE todoId=?", id)
+	mustExec(ctx, tx, "DELETE FROM todo_history WHERE todoId=?", id)
+	if err = tx.Commit(); err != nil {
+		panic(err)
+	}
+	return true
+}
+
+func (s *sqliteHandler) CompleteTodo(ctx context.Context, userID int, id int, complete bool) bool {
+	return s.updateTodo(ctx, userID, id, completedChange(complete), "UPDATE todos SET completed=? WHERE id=? AND userId=?", complete, id, userID)
+}
+
+func (s *sqliteHandler) RenameTodo(ctx context.Context, userID int, id int, name string) bool {
+	return s.updateTodo(ctx, userID, id, TodoRenamed, "UPDATE todos SET name=? WHERE id=? AND userId=?", name, id, userID)
+}
+
+// updateTodo runs query, which updates the todo if the user owns it, and
+// records the change.
+func (s *sqliteHandler) updateTodo(ctx context.Context, userID int, id int, change string, query string, args ...interface{}) bool {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		panic(err)
+	}
+	rst := mustExec(ctx, tx, query, args...)
+	if cnt, _ := rst.RowsAffected(); cnt == 0 {
+		tx.Rollback()
+		return false
+	}
+	s.recordTodoChange(ctx, tx, id, change)
+	if err = tx.Commit(); err != nil {
+		panic(err)
+	}
+	return true
+}
+
+func (s *sqliteHandler) SetTodoTags(ctx context.Context, userID int, id int, tags []string) bool {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		panic(err)
+	}
+	var owned int
+	if err = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM todos WHERE id=? AND userId=?", id, userID).Scan(&owned); err != nil {
+		tx.Rollback()
+		panic(err)
+	}
+	if owned == 0 {
+		tx.Rollback()
+		return false
+	}
+	mustExec(ctx, tx, "DELETE FROM todo_tags WHERE todoId=?", id)
+	for _, tag := range tags {
+		mustExec(ctx, tx, "INSERT INTO todo_tags (todoId, tag) VALUES (?, ?) ON CONFLICT DO NOTHING", id, tag)
+	}
+	s.recordTodoChange(ctx, tx, id, TodoTagged)
+	if err = tx.Commit(); err != nil {
+		panic(err)
+	}
+	return true
+}
+
+// recordTodoChange adds the todo as it is now to its history.
+func (s *sqliteHandler) recordTodoChange(ctx context.Context, tx *sql.Tx, id int, change string) {
+	mustExec(ctx, tx, "INSERT INTO todo_history (todoId, type, name, completed, createdAt) SELECT id, ?, name, completed, datetime('now') FROM todos WHERE id=?", change, id)
+}
+
+func (s *sqliteHandler) GetTagsByTodos(ctx context.Context, ids []int) map[int][]string {
+	byTodo := map[int][]string{}
+	if len(ids) == 0 {
+		return byTodo
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	placeholders := strings.Repeat(",?", len(ids))[1:]
+	rows, err := s.db.QueryContext(ctx, "SELECT todoId, tag FROM todo_tags WHERE todoId IN ("+placeholders+") ORDER BY todoId, tag", args...)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var todoID int
+		var tag string
+		rows.Scan(&todoID, &tag)
+		byTodo[todoID] = append(byTodo[todoID], tag)
+	}
+	return byTodo
+}
+
+func (s *sqliteHandler) GetHistoryByTodos(ctx context.Context, ids []int) map[int][]*TodoChange {
+	byTodo := map[int][]*TodoChange{}
+	if len(ids) == 0 {
+		return byTodo
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	placeholders := strings.Repeat(",?", len(ids))[1:]
+	rows, err := s.db.QueryContext(ctx, "SELECT todoId, type, name, completed, createdAt FROM todo_history WHERE todoId IN ("+placeholders+") ORDER BY id", args...)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var todoID int
+		var change TodoChange
+		rows.Scan(&todoID, &change.Type, &change.Name, &change.Completed, &change.CreatedAt)
+		byTodo[todoID] = append(byTodo[todoID], &change)
+	}
+	return byTodo
+}
+
+func (s *sqliteHandler) SignInUser(ctx context.Context, identity *Identity) *User {
+	var userID int
+	err := s.db.QueryRowContext(ctx, "SELECT userId FROM identities WHERE provider=? AND subject=?", identity.Provider, identity.Subject).Scan(&userID)
+	if err == sql.ErrNoRows {
+		userID = s.createUser(ctx, identity)
+	} else if err != nil {
+		panic(err)
+	}
+
+	_, err = s.db.ExecContext(ctx,
+		`UPDATE users SET email=COALESCE(NULLIF(?, ''), email), name=COALESCE(NULLIF(?, ''), name),
+		picture=COALESCE(NULLIF(?, ''), picture), lastLoginAt=datetime('now') WHERE id=?`,
+		identity.Email, identity.Name, identity.Picture, userID)
+	if err != nil {
+		panic(err)
+	}
+	_, err = s.db.ExecContext(ctx, "UPDATE identities SET email=? WHERE provider=? AND subject=?", identity.Email, identity.Provider, identity.Subject)
+	if err != nil {
+		panic(err)
+	}
+	// todos.sessionId used to hold the Google ID of the owner
+	if identity.Provider == "google" {
+		rst, err := s.db.ExecContext(ctx, "UPDATE todos SET userId=? WHERE sessionId=? AND userId IS NULL", userID, identity.Subject)
+		if err != nil {
+			panic(err)
+		}
+		if cnt, _ := rst.RowsAffected(); cnt > 0 {
+			logging.FromContext(ctx).WithFields(logrus.Fields{"user_id": userID, "todos": cnt}).Info("linked legacy todos to user")
+		}
+	}
+	return s.GetUser(ctx, userID)
+}
+
+// createUser creates a user owning identity. If another request linked the
+// identity first, that user is returned instead.
+func (s *sqliteHandler) createUser(ctx context.Context, identity *Identity) int {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		panic(err)
+	}
+	rst, err := tx.ExecContext(ctx, "INSERT INTO users (email, name, picture, createdAt, lastLoginAt) VALUES (?, ?, ?, datetime('now'), datetime('now'))",
+		identity.Email, identity.Name, identity.Picture)
+	if err != nil {
+		tx.Rollback()
+		panic(err)
+	}
+	id, _ := rst.LastInsertId()
+	userID := int(id)
+	rst, err = tx.ExecContext(ctx, "INSERT INTO identities (userId, provider, subject, email, createdAt) VALUES (?, ?, ?, ?, datetime('now')) ON CONFLICT (provider, subject) DO NOTHING",
+		userID, identity.Provider, identity.Subject, identity.Email)
+	if err != nil {
+		tx.Rollback()
+		panic(err)
+	}
+	if cnt, _ := rst.RowsAffected(); cnt == 0 {
+		tx.Rollback()
+		err = s.db.QueryRowContext(ctx, "SELECT userId FROM identities WHERE provider=? AND subject=?", identity.Provider, identity.Subject).Scan(&userID)
+		if err != nil {
+			panic(err)
+		}
+		return userID
+	}
+	if err = tx.Commit(); err != nil {
+		panic(err)
+	}
+	return userID
+}
+
+func (s *sqliteHandler) LinkIdentity(ctx context.Context, userID int, identity *Identity) bool {
+	_, err := s.db.ExecContext(ctx, "INSERT INTO identities (userId, provider, subject, email, createdAt) VALUES (?, ?, ?, ?, datetime('now')) ON CONFLICT (provider, subject) DO NOTHING",
+		userID, identity.Provider, identity.Subject, identity.Email)
+	if err != nil {
+		panic(err)
+	}
+	var owner int
+	err = s.db.QueryRowContext(ctx, "SELECT userId FROM identities WHERE provider=? AND subject=?", identity.Provider, identity.Subject).Scan(&owner)
+	if err != nil {
+		panic(err)
+	}
+	return owner == userID
+}
+
+func (s *sqliteHandler) GetUser(ctx context.Context, id int) *User {
+	var user User
+	err := s.db.QueryRowContext(ctx, "SELECT id, email, name, picture, createdAt, lastLoginAt FROM users WHERE id=?", id).
+		Scan(&user.ID, &user.Email, &user.Name, &user.Picture, &user.CreatedAt, &user.LastLoginAt)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		panic(err)
+	}
+	return &user
+}
+
+func (s *sqliteHandler) GetUsers(ctx context.Context, ids []int) []*User {
+	users := []*User{}
+	if len(ids) == 0 {
+		return users
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	placeholders := strings.Repeat(",?", len(ids))[1:]
+	rows, err := s.db.QueryContext(ctx, "SELECT id, email, name, picture, createdAt, lastLoginAt FROM users WHERE id IN ("+placeholders+")", args...)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var user User
+		rows.Scan(&user.ID, &user.Email, &user.Name, &user.Picture, &user.CreatedAt, &user.LastLoginAt)
+		users = append(users, &user)
+	}
+	return users
+}
+
+func (s *sqliteHandler) GetIdentities(ctx context.Context, userID int) []*Identity {
+	identities := []*Identity{}
+	rows, err := s.db.QueryContext(ctx, "SELECT provider, subject, email, createdAt FROM identities WHERE userId=? ORDER BY id", userID)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var identity Identity
+		rows.Scan(&identity.Provider, &identity.Subject, &identity.Email, &identity.CreatedAt)
+		identities = append(identities, &identity)
+	}
+	return identities
+}
+
+func (s *sqliteHandler) GetIdentitiesByUsers(ctx context.Context, ids []int) map[int][]*Identity {
+	byUser := map[int][]*Identity{}
+	if len(ids) == 0 {
+		return byUser
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	placeholders := strings.Repeat(",?", len(ids))[1:]
+	rows, err := s.db.QueryContext(ctx, "SELECT userId, provider, subject, email, createdAt FROM identities WHERE userId IN ("+placeholders+") ORDER BY id", args...)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID int
+		var identity Identity
+		rows.Scan(&userID, &identity.Provider, &identity.Subject, &identity.Email, &identity.CreatedAt)
+		byUser[userID] = append(byUser[userID], &identity)
+	}
+	return byUser
+}
+
+func (s *sqliteHandler) CreateLocalAccount(ctx context.Context, email string, passwordHash []byte) *User {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		panic(err)
+	}
+	rst, err := tx.ExecContext(ctx, "INSERT INTO users (email, name, picture, createdAt, lastLoginAt) VALUES (?, '', '', datetime('now'), datetime('now'))", email)
+	if err != nil {
+		tx.Rollback()
+		panic(err)
+	}
+	id, _ := rst.LastInsertId()
+	userID := int(id)
+	rst, err = tx.ExecContext(ctx, "INSERT INTO identities (userId, provider, subject, email, createdAt) VALUES (?, 'local', ?, ?, datetime('now')) ON CONFLICT (provider, subject) DO NOTHING",
+		userID, email, email)
+	if err != nil {
+		tx.Rollback()
+		panic(err)
+	}
+	if cnt, _ := rst.RowsAffected(); cnt == 0 {
+		tx.Rollback()
+		return nil
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO passwords (userId, passwordHash, updatedAt) VALUES (?, ?, datetime('now'))", userID, string(passwordHash))
+	if err != nil {
+		tx.Rollback()
+		panic(err)
+	}
+	if err = tx.Commit(); err != nil {
+		panic(err)
+	}
+	return s.GetUser(ctx, userID)
+}
+
+func (s *sqliteHandler) GetLocalAccount(ctx context.Context, email string) *LocalAccount {
+	var account LocalAccount
+	var passwordHash string
+	var verifiedAt sql.NullTime
+	err := s.db.QueryRowContext(ctx,
+		`SELECT i.userId, i.email, p.passwordHash, p.verifiedAt FROM identities i
+		JOIN passwords p ON p.userId = i.userId WHERE i.provider='local' AND i.subject=?`, email).
+		Scan(&account.UserID, &account.Email, &passwordHash, &verifiedAt)
+	if err == sql.ErrNoRows {
+		return nil
+	}
 	if err != nil {
 		panic(err)
 	}
-	rst, err := stmt.Exec(id)
+	account.PasswordHash = []byte(passwordHash)
+	account.Verified = verifiedAt.Valid
+	return &account
+}
+
+func (s *sqliteHandler) SetPasswordHash(ctx context.Context, userID int, passwordHash []byte) bool {
+	rst, err := s.db.ExecContext(ctx, "UPDATE passwords SET passwordHash=?, updatedAt=datetime('now') WHERE userId=?", string(passwordHash), userID)
 	if err != nil {
 		panic(err)
 	}
@@ -57,12 +557,121 @@ func (s *sqliteHandler) RemoveTodo(id int) bool {
 	return cnt > 0
 }
 
-func (s *sqliteHandler) CompleteTodo(id int, complete bool) bool {
-	stmt, err := s.db.Prepare("UPDATE todos SET completed=? WHERE id=?")
+func (s *sqliteHandler) SetEmailVerified(ctx context.Context, userID int) bool {
+	rst, err := s.db.ExecContext(ctx, "UPDATE passwords SET verifiedAt=COALESCE(verifiedAt, datetime('now')) WHERE userId=?", userID)
 	if err != nil {
 		panic(err)
 	}
-	rst, err := stmt.Exec(complete, id)
+	cnt, _ := rst.RowsAffected()
+	return cnt > 0
+}
+
+func (s *sqliteHandler) CreateEmailToken(ctx context.Context, userID int, purpose string, tokenHash string, expiresAt time.Time) {
+	_, err := s.db.ExecContext(ctx, "INSERT INTO email_tokens (userId, purpose, tokenHash, expiresAt, createdAt) VALUES (?, ?, ?, ?, datetime('now'))",
+		userID, purpose, tokenHash, expiresAt.UTC())
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (s *sqliteHandler) UseEmailToken(ctx context.Context, purpose string, tokenHash string) int {
+	var id, userID int
+	var expiresAt time.Time
+	err := s.db.QueryRowContext(ctx, "SELECT id, userId, expiresAt FROM email_tokens WHERE purpose=? AND tokenHash=? AND usedAt IS NULL", purpose, tokenHash).
+		Scan(&id, &userID, &expiresAt)
+	if err == sql.ErrNoRows {
+		return 0
+	}
+	if err != nil {
+		panic(err)
+	}
+	if time.Now().After(expiresAt) {
+		return 0
+	}
+	rst, err := s.db.ExecContext(ctx, "UPDATE email_tokens SET usedAt=datetime('now') WHERE id=? AND usedAt IS NULL", id)
+	if err != nil {
+		panic(err)
+	}
+	if cnt, _ := rst.RowsAffected(); cnt == 0 {
+		return 0
+	}
+	return userID
+}
+
+func (s *sqliteHandler) CreateSession(ctx context.Context, session *Session) int {
+	rst, err := s.db.ExecContext(ctx,
+		`INSERT INTO sessions (tokenHash, userId, data, userAgent, ip, createdAt, lastSeenAt, expiresAt)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		session.TokenHash, session.UserID, session.Data, session.UserAgent, session.IP,
+		session.CreatedAt.UTC(), session.LastSeenAt.UTC(), session.ExpiresAt.UTC())
+	if err != nil {
+		panic(err)
+	}
+	id, _ := rst.LastInsertId()
+	return int(id)
+}
+
+func (s *sqliteHandler) GetSession(ctx context.Context, tokenHash string) *Session {
+	var session Session
+	err := s.db.QueryRowContext(ctx,
+		`SELECT id, tokenHash, userId, data, userAgent, ip, createdAt, lastSeenAt, expiresAt
+		FROM sessions WHERE tokenHash=?`, tokenHash).
+		Scan(&session.ID, &session.TokenHash, &session.UserID, &session.Data, &session.UserAgent, &session.IP,
+			&session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		panic(err)
+	}
+	return &session
+}
+
+func (s *sqliteHandler) UpdateSession(ctx context.Context, tokenHash string, userID int, data []byte) bool {
+	rst, err := s.db.ExecContext(ctx, "UPDATE sessions SET userId=?, data=? WHERE tokenHash=?", userID, data, tokenHash)
+	if err != nil {
+		panic(err)
+	}
+	cnt, _ := rst.RowsAffected()
+	return cnt > 0
+}
+
+func (s *sqliteHandler) TouchSession(ctx context.Context, tokenHash string, lastSeenAt time.Time, ip string) {
+	_, err := s.db.ExecContext(ctx, "UPDATE sessions SET lastSeenAt=?, ip=? WHERE tokenHash=?", lastSeenAt.UTC(), ip, tokenHash)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (s *sqliteHandler) DeleteSession(ctx context.Context, tokenHash string) bool {
+	rst, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE tokenHash=?", tokenHash)
+	if err != nil {
+		panic(err)
+	}
+	cnt, _ := rst.RowsAffected()
+	return cnt > 0
+}
+
+func (s *sqliteHandler) GetUserSessions(ctx context.Context, userID int) []*Session {
+	sessions := []*Session{}
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, tokenHash, userId, userAgent, ip, createdAt, lastSeenAt, expiresAt
+		FROM sessions WHERE userId=? ORDER BY lastSeenAt DESC`, userID)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var session Session
+		rows.Scan(&session.ID, &session.TokenHash, &session.UserID, &session.UserAgent, &session.IP,
+			&session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt)
+		sessions = append(sessions, &session)
+	}
+	return sessions
+}
+
+func (s *sqliteHandler) DeleteUserSession(ctx context.Context, userID int, id int) bool {
+	rst, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE id=? AND userId=?", id, userID)
 	if err != nil {
 		panic(err)
 	}
@@ -70,26 +679,154 @@ func (s *sqliteHandler) CompleteTodo(id int, complete bool) bool {
 	return cnt > 0
 }
 
+func (s *sqliteHandler) DeleteUserSessions(ctx context.Context, userID int) int {
+	rst, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE userId=?", userID)
+	if err != nil {
+		panic(err)
+	}
+	cnt, _ := rst.RowsAffected()
+	return int(cnt)
+}
+
+func (s *sqliteHandler) DeleteExpiredSessions(ctx context.Context, now time.Time, idleSince time.Time) int {
+	rst, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE expiresAt < ? OR lastSeenAt < ?", now.UTC(), idleSince.UTC())
+	if err != nil {
+		panic(err)
+	}
+	cnt, _ := rst.RowsAffected()
+	return int(cnt)
+}
+
+func (s *sqliteHandler) CountActiveSessions(ctx context.Context, now time.Time, idleSince time.Time) int {
+	var cnt int
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sessions WHERE userId <> 0 AND expiresAt >= ? AND lastSeenAt >= ?", now.UTC(), idleSince.UTC()).Scan(&cnt)
+	if err != nil {
+		panic(err)
+	}
+	return cnt
+}
+
+func (s *sqliteHandler) CreateAccessToken(ctx context.Context, token *AccessToken) int {
+	rst, err := s.db.ExecContext(ctx,
+		`INSERT INTO access_tokens (userId, name, tokenHash, scopes, createdAt, expiresAt, lastUsedIP)
+		VALUES (?, ?, ?, ?, ?, ?, '')`,
+		token.UserID, token.Name, token.TokenHash, strings.Join(token.Scopes, " "),
+		token.CreatedAt.UTC(), token.ExpiresAt.UTC())
+	if err != nil {
+		panic(err)
+	}
+	id, _ := rst.LastInsertId()
+	return int(id)
+}
+
+func (s *sqliteHandler) GetAccessToken(ctx context.Context, tokenHash string) *AccessToken {
+	token, err := scanAccessToken(s.db.QueryRowContext(ctx,
+		`SELECT id, userId, name, tokenHash, scopes, createdAt, expiresAt, lastUsedAt, lastUsedIP
+		FROM access_tokens WHERE tokenHash=?`, tokenHash).Scan)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		panic(err)
+	}
+	return token
+}
+
+func (s *sqliteHandler) GetAccessTokens(ctx context.Context, userID int) []*AccessToken {
+	tokens := []*AccessToken{}
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, userId, name, tokenHash, scopes, createdAt, expiresAt, lastUsedAt, lastUsedIP
+		FROM access_tokens WHERE userId=? ORDER BY id`, userID)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		token, err := scanAccessToken(rows.Scan)
+		if err != nil {
+			panic(err)
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
+
+func (s *sqliteHandler) RevokeAccessToken(ctx context.Context, userID int, id int) bool {
+	rst, err := s.db.ExecContext(ctx, "DELETE FROM access_tokens WHERE id=? AND userId=?", id, userID)
+	if err != nil {
+		panic(err)
+	}
+	cnt, _ := rst.RowsAffected()
+	return cnt > 0
+}
+
+func (s *sqliteHandler) TouchAccessToken(ctx context.Context, id int, lastUsedAt time.Time, ip string) {
+	_, err := s.db.ExecContext(ctx, "UPDATE access_tokens SET lastUsedAt=?, lastUsedIP=? WHERE id=?", lastUsedAt.UTC(), ip, id)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (s *sqliteHandler) Stats() sql.DBStats {
+	return s.db.Stats()
+}
+
+func (s *sqliteHandler) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *sqliteHandler) SchemaVersion(ctx context.Context) (int, int, error) {
+	applied, err := appliedVersion(ctx, s.db)
+	return applied, len(sqliteMigrations), err
+}
+
 func (s *sqliteHandler) Close() {
 	s.db.Close()
 }
 
-func newSqliteHandler(filepath string) DBHandler {
+func newSqliteHandler(ctx context.Context, filepath string) DBHandler {
 	database, err := sql.Open("sqlite3", filepath)
 	if err != nil {
 		panic(err)
 	}
-	statement, _ := database.Prepare(
-		`CREATE TABLE IF NOT EXISTS todos (
-			id        INTEGER  PRIMARY KEY AUTOINCREMENT,
-			sessionId STRING,
-			name      TEXT,
-			completed BOOLEAN,
-			createdAt DATETIME
-		);
-		CREATE INDEX IF NOT EXISTS sessionIdIndexOnTodos ON todos (
-			sessionId ASC
-		);`)
-	statement.Exec()
+	migrate(ctx, database, sqliteMigrations)
 	return &sqliteHandler{db: database}
 }
+
+func (s *sqliteHandler) TakeToken(ctx context.Context, key string, capacity int, interval time.Duration, now time.Time) (Bucket, bool) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		panic(err)
+	}
+	defer tx.Rollback()
+	// The insert takes the write lock, so no one else reads the bucket
+	// until this transaction is done with it.
+	_, err = tx.ExecContext(ctx, "INSERT INTO rate_limits (bucketKey, tokens, updatedAt) VALUES (?, ?, ?) ON CONFLICT (bucketKey) DO NOTHING",
+		key, float64(capacity), now.UTC())
+	if err != nil {
+		panic(err)
+	}
+	var bucket Bucket
+	err = tx.QueryRowContext(ctx, "SELECT tokens, updatedAt FROM rate_limits WHERE bucketKey=?", key).
+		Scan(&bucket.Tokens, &bucket.UpdatedAt)
+	if err != nil {
+		panic(err)
+	}
+	ok := bucket.Take(capacity, interval, now)
+	if _, err = tx.ExecContext(ctx, "UPDATE rate_limits SET tokens=?, updatedAt=? WHERE bucketKey=?", bucket.Tokens, now.UTC(), key); err != nil {
+		panic(err)
+	}
+	if err = tx.Commit(); err != nil {
+		panic(err)
+	}
+	return bucket, ok
+}
+
+func (s *sqliteHandler) DeleteIdleBuckets(ctx context.Context, idleSince time.Time) int {
+	rst, err := s.db.ExecContext(ctx, "DELETE FROM rate_limits WHERE updatedAt < ?", idleSince.UTC())
+	if err != nil {
+		panic(err)
+	}
+	cnt, _ := rst.RowsAffected()
+	return int(cnt)
+}
@@ -0,0 +1,5 @@
+// Package todopb holds the protobuf messages and gRPC service of the todos
+// API.
+package todopb
+
+//go:generate buf generate
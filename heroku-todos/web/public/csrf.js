@@ -0,0 +1,32 @@
+// Sends the CSRF token from the XSRF-TOKEN cookie with every request that
+// changes data: as a header on jQuery requests and as a field on forms.
+(function() {
+'use strict';
+function csrfToken() {
+    var match = document.cookie.match(/(?:^|;\s*)XSRF-TOKEN=([^;]*)/);
+    return match ? decodeURIComponent(match[1]) : '';
+}
+
+if (window.jQuery) {
+    jQuery.ajaxPrefilter(function(options, originalOptions, xhr) {
+        if (!/^(GET|HEAD|OPTIONS)$/i.test(options.type)) {
+            xhr.setRequestHeader('X-CSRF-Token', csrfToken());
+        }
+    });
+}
+
+document.addEventListener('submit', function(event) {
+    var form = event.target;
+    if (form.method.toLowerCase() !== 'post') {
+        return;
+    }
+    var input = form.querySelector('input[name="csrf_token"]');
+    if (!input) {
+        input = document.createElement('input');
+        input.type = 'hidden';
+        input.name = 'csrf_token';
+        form.appendChild(input);
+    }
+    input.value = csrfToken();
+}, true);
+})();
@@ -0,0 +1,134 @@
+(function($) {
+'use strict';
+$(function() {
+    var methodClasses = {get: 'primary', post: 'success', put: 'warning', delete: 'danger'};
+
+    var schemaName = function(schema) {
+        if (!schema) {
+            return '';
+        }
+        if (schema.$ref) {
+            return schema.$ref.split('/').pop();
+        }
+        if (schema.type === 'array') {
+            return schemaName(schema.items) + '[]';
+        }
+        return schema.type || 'object';
+    };
+
+    var pathParams = function(path, op) {
+        return (path.parameters || []).concat(op.parameters || []).filter(function(param) {
+            return param.in === 'path' || param.in === 'query';
+        });
+    };
+
+    // tryIt sends the request the way a script would, with the access token
+    // when one is entered and this browser's session otherwise.
+    var tryIt = function(method, template, params, form) {
+        var url = template;
+        var query = {};
+        params.forEach(function(param) {
+            var value = form.find('[data-param="' + param.name + '"]').val();
+            if (param.in === 'path') {
+                url = url.replace('{' + param.name + '}', encodeURIComponent(value));
+            } else if (value) {
+                query[param.name] = value;
+            }
+        });
+        if (!$.isEmptyObject(query)) {
+            url += '?' + $.param(query);
+        }
+        var settings = {url: url, method: method.toUpperCase(), dataType: 'text', headers: {}};
+        var body = form.find('textarea').val();
+        if (body) {
+            settings.data = body;
+            settings.contentType = 'application/json';
+        }
+        var token = $('#bearerToken').val();
+        if (token) {
+            settings.headers.Authorization = 'Bearer ' + token;
+        }
+        var output = form.find('.response');
+        $.ajax(settings).always(function(data, status, xhr) {
+            if (status !== 'success') {
+                xhr = data;
+            }
+            output.removeClass('d-none').text(xhr.status + ' ' + xhr.statusText + '\n\n' + (xhr.responseText || ''));
+        });
+    };
+
+    var renderOperation = function(method, template, path, op) {
+        var card = $('<div class="border rounded p-2 mb-2">');
+        var header = $('<div>').appendTo(card);
+        $('<span class="badge mr-2">').addClass('badge-' + (methodClasses[method] || 'secondary')).text(method.toUpperCase()).appendTo(header);
+        $('<code class="mr-2">').text(template).appendTo(header);
+        $('<span>').text(op.summary || '').appendTo(header);
+        if (op.deprecated) {
+            $('<span class="badge badge-secondary ml-2">').text('deprecated').appendTo(header);
+        }
+        if (op.description) {
+            $('<p class="text-muted small mb-1 mt-1">').text(op.description).appendTo(card);
+        }
+
+        var responses = $('<ul class="small mb-1">').appendTo(card);
+        $.each(op.responses, function(code, response) {
+            var content = response.content ? Object.values(response.content)[0] : null;
+            var item = $('<li>').text(code + ' ' + (response.description || '')).appendTo(responses);
+            if (content) {
+                $('<code class="ml-1">').text(schemaName(content.schema)).appendTo(item);
+            }
+        });
+
+        var form = $('<form class="d-none">').appendTo(card);
+        var params = pathParams(path, op);
+        params.forEach(function(param) {
+            $('<input class="form-control form-control-sm mb-1">')
+                .attr('data-param', param.name)
+                .attr('placeholder', param.name + (param.required ? '' : ' (optional)'))
+                .appendTo(form);
+        });
+        var body = op.requestBody && op.requestBody.content['application/json'];
+        if (body) {
+            $('<textarea class="form-control form-control-sm mb-1" rows="3">')
+                .attr('placeholder', schemaName(body.schema) + ' as JSON')
+                .appendTo(form);
+        }
+        $('<button type="submit" class="btn btn-sm btn-primary">').text('Send').appendTo(form);
+        $('<pre class="response d-none mt-2 p-2 bg-light small">').appendTo(form);
+        form.on('submit', function(event) {
+            event.preventDefault();
+            tryIt(method, template, params, form);
+        });
+        $('<button class="btn btn-sm btn-link">').text('Try it').appendTo(header).on('click', function() {
+            form.toggleClass('d-none');
+        });
+        return card;
+    };
+
+    $.getJSON('/openapi.json', function(spec) {
+        $('.api-title').text(spec.info.title + ' API ' + spec.info.version);
+        $('.api-description').text(spec.info.description);
+        var sections = {};
+        (spec.tags || []).forEach(function(tag) {
+            sections[tag.name] = $('<div class="mb-4">').appendTo('.operations');
+            $('<h5>').text(tag.name).appendTo(sections[tag.name]);
+            if (tag.description) {
+                $('<p class="text-muted">').text(tag.description).appendTo(sections[tag.name]);
+            }
+        });
+        $.each(spec.paths, function(template, path) {
+            $.each(path, function(method, op) {
+                if (method === 'parameters') {
+                    return;
+                }
+                var tag = (op.tags || ['other'])[0];
+                if (!sections[tag]) {
+                    sections[tag] = $('<div class="mb-4">').appendTo('.operations');
+                    $('<h5>').text(tag).appendTo(sections[tag]);
+                }
+                sections[tag].append(renderOperation(method, template, path, op));
+            });
+        });
+    });
+});
+})(jQuery);
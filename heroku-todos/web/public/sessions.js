@@ -0,0 +1,51 @@
+(function($) {
+'use strict';
+$(function() {
+    var sessionList = $('.sessions-table tbody');
+
+    var formatTime = function(value) {
+        return new Date(value).toLocaleString();
+    };
+
+    var addSession = function(session) {
+        var row = $('<tr></tr>').attr('id', session.id);
+        $('<td></td>').text(session.user_agent).appendTo(row);
+        $('<td></td>').text(session.ip).appendTo(row);
+        $('<td></td>').text(formatTime(session.created_at)).appendTo(row);
+        $('<td></td>').text(formatTime(session.last_seen_at)).appendTo(row);
+        if (session.current) {
+            $('<td><span class="badge badge-primary">This device</span></td>').appendTo(row);
+        } else {
+            $('<td><button class="btn btn-sm btn-outline-danger revoke">Sign out</button></td>').appendTo(row);
+        }
+        sessionList.append(row);
+    };
+
+    $.get('/sessions', function(sessions) {
+        sessions.forEach(addSession);
+    });
+
+    sessionList.on('click', '.revoke', function() {
+        var $row = $(this).closest('tr');
+        $.ajax({
+            url: 'sessions/' + $row.attr('id'),
+            type: 'DELETE',
+            success: function(data) {
+                if (data.success) {
+                    $row.remove();
+                }
+            }
+        });
+    });
+
+    $('.sign-out-everywhere').on('click', function() {
+        $.ajax({
+            url: 'sessions',
+            type: 'DELETE',
+            success: function() {
+                window.location.href = '/signin.html';
+            }
+        });
+    });
+});
+})(jQuery);
@@ -0,0 +1,69 @@
+(function() {
+'use strict';
+var titles = {
+    google: 'Google',
+    github: 'GitHub',
+    dev: 'a test identity'
+};
+
+var messages = {
+    'verify-sent': 'Check your email for a link to verify your account.',
+    'reset-sent': 'If that email has an account, we sent it a password reset link.',
+    'password-reset': 'Your password was reset. Sign in with the new password.'
+};
+
+var errors = {
+    'invalid-email': 'Enter a valid email address.',
+    'invalid-password': 'Passwords must be 8 to 72 characters long.',
+    'invalid-login': 'Wrong email or password.',
+    'invalid-token': 'This link is invalid or expired.',
+    'invalid-state': 'Your sign in attempt expired. Please try again.',
+    'provider-error': 'The sign in provider did not let you in.',
+    'unverified': 'Verify your email before signing in. Sign up again to resend the link.'
+};
+
+var addProviderButton = function(container, name) {
+    var title = titles[name] || name;
+    var button = document.createElement('a');
+    button.className = 'btn btn-lg btn-block text-uppercase ' + (titles[name] ? 'btn-' + name : 'btn-oidc');
+    button.href = '/auth/' + encodeURIComponent(name) + '/login';
+    if (params.get('return_to')) {
+        button.href += '?return_to=' + encodeURIComponent(params.get('return_to'));
+    }
+    var icon = document.createElement('i');
+    icon.className = 'fab fa-' + name + ' mr-2';
+    button.appendChild(icon);
+    button.appendChild(document.createTextNode(' Sign in with ' + title));
+    container.appendChild(button);
+};
+
+var showAlert = function(text, className) {
+    var alert = document.querySelector('.signin-alert');
+    alert.textContent = text;
+    alert.classList.add(className);
+    alert.classList.remove('d-none');
+};
+
+var params = new URLSearchParams(window.location.search);
+if (messages[params.get('message')]) {
+    showAlert(messages[params.get('message')], 'alert-success');
+}
+if (errors[params.get('error')]) {
+    showAlert(errors[params.get('error')], 'alert-danger');
+}
+if (params.get('reset_token')) {
+    var reset = document.querySelector('.signin-reset');
+    reset.elements.token.value = params.get('reset_token');
+    reset.classList.remove('d-none');
+    document.querySelector('.signin-local').classList.add('d-none');
+}
+
+fetch('/auth/providers').then(function(resp) {
+    return resp.json();
+}).then(function(names) {
+    var container = document.querySelector('.signin-providers');
+    names.forEach(function(name) {
+        addProviderButton(container, name);
+    });
+});
+})();
@@ -0,0 +1,73 @@
+// The list is rendered on the server and its forms work without scripts.
+// This only sends them in the background to save reloading the page.
+(function($) {
+'use strict';
+$(function() {
+    var todoListItem = $('.todo-list');
+    var todoListInput = $('.todo-list-input');
+
+    $('.add-items').on('submit', function(event) {
+        event.preventDefault();
+
+        var item = todoListInput.val();
+
+        if (item) {
+            $.post("/todos", {name:item}, addItem).fail(function(xhr) {
+                var problem = xhr.responseJSON;
+                todoListInput.val(item);
+                alert(problem && problem.detail ? problem.detail : "Could not add the todo");
+            });
+            todoListInput.val("");
+        }
+    });
+
+    // addItem adds the same markup as templates/todos.html. The name goes
+    // in as text, never as markup.
+    var addItem = function(item) {
+        var li = $('<li></li>').attr('id', item.id);
+        var complete = $('<form class="complete-form form-check" method="post"></form>').attr('action', '/todos/' + item.id + '/completion').appendTo(li);
+        $('<input type="hidden" name="complete" value="true">').appendTo(complete);
+        var label = $('<label class="form-check-label"></label>').appendTo(complete);
+        $('<input class="checkbox" type="checkbox">').appendTo(label);
+        label.append(document.createTextNode(' ' + item.name + ' '));
+        $('<i class="input-helper"></i>').appendTo(label);
+        var remove = $('<form class="remove-form" method="post"></form>').attr('action', '/todos/' + item.id + '/delete').appendTo(li);
+        $('<button class="remove mdi mdi-close-circle-outline" type="submit" aria-label="Remove"></button>').appendTo(remove);
+        todoListItem.append(li);
+    };
+
+    todoListItem.on('change', '.checkbox', function() {
+        var id = $(this).closest("li").attr('id');
+        var $self = $(this);
+        var complete = $self.prop('checked');
+        $.ajax({
+            url: "/todos/" + id + "/completion",
+            type: "PUT",
+            data: {complete: complete},
+            success: function(data) {
+                $self.closest("li").toggleClass('completed', complete);
+                $self.closest("form").find("input[name='complete']").val(String(!complete));
+            },
+            error: function() {
+                $self.prop('checked', !complete);
+            }
+        })
+    });
+
+    todoListItem.on('submit', '.remove-form', function(event) {
+        event.preventDefault();
+        var id = $(this).closest("li").attr('id');
+        var $self = $(this);
+        $.ajax({
+            url: "/todos/" + id,
+            type: "DELETE",
+            success: function(data) {
+                if (data.success) {
+                    $self.closest("li").remove();
+                }
+            }
+        })
+    });
+
+});
+})(jQuery);
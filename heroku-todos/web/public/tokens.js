@@ -0,0 +1,48 @@
+(function($) {
+'use strict';
+$(function() {
+    var tokenList = $('.tokens-table tbody');
+
+    var formatTime = function(value) {
+        return value ? new Date(value).toLocaleString() : 'never';
+    };
+
+    var addToken = function(token) {
+        var row = $('<tr></tr>').attr('id', token.id);
+        $('<td></td>').text(token.name).appendTo(row);
+        $('<td></td>').text(token.scopes.join(', ')).appendTo(row);
+        $('<td></td>').text(formatTime(token.expires_at)).appendTo(row);
+        $('<td></td>').text(token.last_used_at ? formatTime(token.last_used_at) + ' from ' + token.last_used_ip : 'never').appendTo(row);
+        $('<td><button class="btn btn-sm btn-outline-danger revoke">Revoke</button></td>').appendTo(row);
+        tokenList.append(row);
+    };
+
+    $.get('/tokens', function(tokens) {
+        tokens.forEach(addToken);
+    });
+
+    $('.new-token').on('submit', function(event) {
+        event.preventDefault();
+        var $form = $(this);
+        $.post('/tokens', $form.serialize(), function(token) {
+            addToken(token);
+            $('.new-token-secret code').text(token.token);
+            $('.new-token-secret').removeClass('d-none');
+            $form.find('input[name=name]').val('');
+        });
+    });
+
+    tokenList.on('click', '.revoke', function() {
+        var $row = $(this).closest('tr');
+        $.ajax({
+            url: 'tokens/' + $row.attr('id'),
+            type: 'DELETE',
+            success: function(data) {
+                if (data.success) {
+                    $row.remove();
+                }
+            }
+        });
+    });
+});
+})(jQuery);
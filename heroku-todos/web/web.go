@@ -0,0 +1,9 @@
+// Package web holds the files the app serves: public/ as they are and the
+// page templates in templates/. They are embedded so that the binary runs
+// from any directory.
+package web
+
+import "embed"
+
+//go:embed public templates
+var FS embed.FS